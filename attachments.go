@@ -328,26 +328,70 @@ func (br *DiscordBridge) copyAttachmentToMatrix(intent *appservice.IntentAPI, ur
 }
 
 func (portal *Portal) getEmojiMXCByDiscordID(emojiID, name string, animated bool) id.ContentURI {
-	mxc := portal.bridge.DMA.EmojiMXC(emojiID, name, animated)
+	mxc, err := portal.bridge.getEmojiMXC(portal.MainIntent(), emojiID, name, animated)
+	if err != nil {
+		portal.log.Warn().Err(err).Str("emoji_id", emojiID).Msg("Failed to copy emoji to Matrix")
+	}
+	return mxc
+}
+
+func emojiMimeType(animated bool) string {
+	if animated {
+		return "image/gif"
+	}
+	return "image/png"
+}
+
+func (br *DiscordBridge) getEmojiMXC(intent *appservice.IntentAPI, emojiID, name string, animated bool) (id.ContentURI, error) {
+	mxc := br.DMA.EmojiMXC(emojiID, name, animated)
 	if !mxc.IsEmpty() {
-		return mxc
+		return mxc, nil
 	}
-	var url, mimeType string
+	var url string
 	if animated {
 		url = discordgo.EndpointEmojiAnimated(emojiID)
-		mimeType = "image/gif"
 	} else {
 		url = discordgo.EndpointEmoji(emojiID)
-		mimeType = "image/png"
 	}
-	dbFile, err := portal.bridge.copyAttachmentToMatrix(portal.MainIntent(), url, false, AttachmentMeta{
+	dbFile, err := br.copyAttachmentToMatrix(intent, url, false, AttachmentMeta{
 		AttachmentID: emojiID,
-		MimeType:     mimeType,
+		MimeType:     emojiMimeType(animated),
 		EmojiName:    name,
 	})
 	if err != nil {
-		portal.log.Warn().Err(err).Str("emoji_id", emojiID).Msg("Failed to copy emoji to Matrix")
-		return id.ContentURI{}
+		return id.ContentURI{}, err
+	}
+	return dbFile.MXC, nil
+}
+
+func stickerMimeType(format discordgo.StickerFormat) string {
+	switch format {
+	case discordgo.StickerFormatTypePNG:
+		return "image/png"
+	case discordgo.StickerFormatTypeAPNG:
+		return "image/apng"
+	case discordgo.StickerFormatTypeLottie:
+		return "application/json"
+	case discordgo.StickerFormatTypeGIF:
+		return "image/gif"
+	default:
+		return ""
+	}
+}
+
+func (br *DiscordBridge) getStickerMXC(intent *appservice.IntentAPI, sticker *discordgo.Sticker) (id.ContentURI, error) {
+	mxc := br.DMA.StickerMXC(sticker.ID, sticker.FormatType)
+	if !mxc.IsEmpty() {
+		return mxc, nil
+	} else if sticker.FormatType == discordgo.StickerFormatTypeLottie {
+		return id.ContentURI{}, errors.New("lottie stickers can only be bridged with direct media")
+	}
+	dbFile, err := br.copyAttachmentToMatrix(intent, sticker.URL(), false, AttachmentMeta{
+		AttachmentID: sticker.ID,
+		MimeType:     stickerMimeType(sticker.FormatType),
+	})
+	if err != nil {
+		return id.ContentURI{}, err
 	}
-	return dbFile.MXC
+	return dbFile.MXC, nil
 }
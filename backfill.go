@@ -4,8 +4,13 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/url"
 	"sort"
+	"strconv"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
 	"github.com/rs/zerolog"
@@ -22,18 +27,22 @@ func (portal *Portal) forwardBackfillInitial(source *User, thread *Thread) {
 		log.Debug().Msg("Forward backfill finished, unlocking lock")
 		portal.forwardBackfillLock.Unlock()
 	}()
-	// This should only be called from CreateMatrixRoom which locks forwardBackfillLock before creating the room.
+	// This should only be called from CreateMatrixRoom or Thread.maybeInitialBackfill, which lock forwardBackfillLock before calling this.
 	if portal.forwardBackfillLock.TryLock() {
 		panic("forwardBackfillInitial() called without locking forwardBackfillLock")
 	}
 
 	limit := portal.bridge.Config.Bridge.Backfill.Limits.Initial.Channel
-	if portal.GuildID == "" {
+	if thread != nil {
+		limit = portal.bridge.Config.Bridge.Backfill.Limits.Initial.Thread
+		thread.initialBackfillAttempted = true
+	} else if portal.IsThread() {
+		limit = portal.bridge.Config.Bridge.Backfill.Limits.Initial.Thread
+	} else if portal.GuildID == "" {
 		limit = portal.bridge.Config.Bridge.Backfill.Limits.Initial.DM
-		if thread != nil {
-			limit = portal.bridge.Config.Bridge.Backfill.Limits.Initial.Thread
-			thread.initialBackfillAttempted = true
-		}
+	} else if portal.IsForum() {
+		// Forums don't have messages of their own, posts are bridged when they receive messages
+		limit = 0
 	}
 	if limit == 0 {
 		return
@@ -49,6 +58,7 @@ func (portal *Portal) forwardBackfillInitial(source *User, thread *Thread) {
 	log = with.Logger()
 
 	portal.backfillLimited(log, source, limit, "", thread)
+	portal.enqueueBackwardBackfill(source, thread)
 }
 
 func (portal *Portal) ForwardBackfillMissed(source *User, serverLastMessageID string, thread *Thread) {
@@ -57,11 +67,12 @@ func (portal *Portal) ForwardBackfillMissed(source *User, serverLastMessageID st
 	}
 
 	limit := portal.bridge.Config.Bridge.Backfill.Limits.Missed.Channel
-	if portal.GuildID == "" {
+	if thread != nil || portal.IsThread() {
+		limit = portal.bridge.Config.Bridge.Backfill.Limits.Missed.Thread
+	} else if portal.GuildID == "" {
 		limit = portal.bridge.Config.Bridge.Backfill.Limits.Missed.DM
-		if thread != nil {
-			limit = portal.bridge.Config.Bridge.Backfill.Limits.Missed.Thread
-		}
+	} else if portal.IsForum() {
+		limit = 0
 	}
 	if limit == 0 {
 		return
@@ -84,6 +95,9 @@ func (portal *Portal) ForwardBackfillMissed(source *User, serverLastMessageID st
 	} else {
 		lastMessage = portal.bridge.DB.Message.GetLast(portal.Key)
 	}
+	if lastMessage != nil {
+		portal.enqueueBackwardBackfill(source, thread)
+	}
 	if lastMessage == nil || serverLastMessageID == "" {
 		log.Debug().Msg("Not backfilling, no last message in database or no last message in metadata")
 		return
@@ -107,9 +121,37 @@ func (portal *Portal) ForwardBackfillMissed(source *User, serverLastMessageID st
 
 const messageFetchChunkSize = 50
 
-func (portal *Portal) collectBackfillMessages(log zerolog.Logger, source *User, limit int, until string, thread *Thread) ([]*discordgo.Message, bool, error) {
+// fetchMessages is like discordgo's ChannelMessages, but also caches the snapshots of forwarded messages from the response.
+func (portal *Portal) fetchMessages(log zerolog.Logger, source *User, channelID, before, after string) ([]*discordgo.Message, error) {
+	query := url.Values{}
+	query.Set("limit", strconv.Itoa(messageFetchChunkSize))
+	if before != "" {
+		query.Set("before", before)
+	}
+	if after != "" {
+		query.Set("after", after)
+	}
+	endpoint := discordgo.EndpointChannelMessages(channelID)
+	resp, err := source.Session.RequestWithBucketID(http.MethodGet, endpoint+"?"+query.Encode(), nil, endpoint, portal.RefererOptIfUser(source.Session, channelID)...)
+	if err != nil {
+		return nil, err
+	}
+	var messages []*discordgo.Message
+	err = json.Unmarshal(resp, &messages)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range messages {
+		if isPossibleForward(msg) {
+			portal.bridge.cacheForwardSnapshots(log, resp, true)
+			break
+		}
+	}
+	return messages, nil
+}
+
+func (portal *Portal) collectBackfillMessages(log zerolog.Logger, source *User, limit int, before, until string, thread *Thread) ([]*discordgo.Message, bool, error) {
 	var messages []*discordgo.Message
-	var before string
 	var foundAll bool
 	protoChannelID := portal.Key.ChannelID
 	if thread != nil {
@@ -117,7 +159,7 @@ func (portal *Portal) collectBackfillMessages(log zerolog.Logger, source *User,
 	}
 	for {
 		log.Debug().Str("before_id", before).Msg("Fetching messages for backfill")
-		newMessages, err := source.Session.ChannelMessages(protoChannelID, messageFetchChunkSize, before, "", "", portal.RefererOptIfUser(source.Session, protoChannelID)...)
+		newMessages, err := portal.fetchMessages(log, source, protoChannelID, before, "")
 		if err != nil {
 			return nil, false, err
 		}
@@ -149,7 +191,7 @@ func (portal *Portal) collectBackfillMessages(log zerolog.Logger, source *User,
 }
 
 func (portal *Portal) backfillLimited(log zerolog.Logger, source *User, limit int, after string, thread *Thread) {
-	messages, foundAll, err := portal.collectBackfillMessages(log, source, limit, after, thread)
+	messages, foundAll, err := portal.collectBackfillMessages(log, source, limit, "", after, thread)
 	if err != nil {
 		if source.handlePossible40002(err) {
 			panic(err)
@@ -183,7 +225,7 @@ func (portal *Portal) backfillUnlimitedMissed(log zerolog.Logger, source *User,
 	}
 	for {
 		log.Debug().Str("after_id", after).Msg("Fetching chunk of messages to backfill")
-		messages, err := source.Session.ChannelMessages(protoChannelID, messageFetchChunkSize, "", after, "", portal.RefererOptIfUser(source.Session, protoChannelID)...)
+		messages, err := portal.fetchMessages(log, source, protoChannelID, "", after)
 		if err != nil {
 			log.Err(err).Msg("Error fetching chunk of messages to forward backfill")
 			return
@@ -205,7 +247,7 @@ func (portal *Portal) backfillUnlimitedMissed(log zerolog.Logger, source *User,
 func (portal *Portal) sendBackfillBatch(log zerolog.Logger, source *User, messages []*discordgo.Message, thread *Thread) {
 	if portal.bridge.SpecVersions.Supports(mautrix.BeeperFeatureBatchSending) {
 		log.Debug().Msg("Using hungryserv, sending messages with batch send endpoint")
-		portal.forwardBatchSend(log, source, messages, thread)
+		_ = portal.batchSend(log, source, messages, thread, true)
 	} else {
 		log.Debug().Msg("Not using hungryserv, sending messages one by one")
 		for _, msg := range messages {
@@ -214,20 +256,20 @@ func (portal *Portal) sendBackfillBatch(log zerolog.Logger, source *User, messag
 	}
 }
 
-func (portal *Portal) forwardBatchSend(log zerolog.Logger, source *User, messages []*discordgo.Message, thread *Thread) {
-	evts, metas, dbMessages := portal.convertMessageBatch(log, source, messages, thread)
+func (portal *Portal) batchSend(log zerolog.Logger, source *User, messages []*discordgo.Message, thread *Thread, forward bool) error {
+	evts, metas, dbMessages := portal.convertMessageBatch(log, source, messages, thread, forward)
 	if len(evts) == 0 {
 		log.Warn().Msg("Didn't get any events to backfill")
-		return
+		return nil
 	}
 	log.Info().Int("events", len(evts)).Msg("Converted messages to backfill")
 	resp, err := portal.MainIntent().BeeperBatchSend(portal.MXID, &mautrix.ReqBeeperBatchSend{
-		Forward: true,
+		Forward: forward,
 		Events:  evts,
 	})
 	if err != nil {
 		log.Err(err).Msg("Error sending backfill batch")
-		return
+		return err
 	}
 	for i, evtID := range resp.EventIDs {
 		dbMessages[i].MXID = evtID
@@ -238,9 +280,144 @@ func (portal *Portal) forwardBatchSend(log zerolog.Logger, source *User, message
 		}
 	}
 	portal.bridge.DB.Message.MassInsert(portal.Key, dbMessages)
+	return nil
+}
+
+// enqueueBackwardBackfill adds the portal or thread to the backwards backfill queue,
+// starting from the oldest message that has been bridged so far.
+func (portal *Portal) enqueueBackwardBackfill(source *User, thread *Thread) {
+	if !portal.bridge.Config.Bridge.Backfill.Backward.Enabled || !portal.bridge.SpecVersions.Supports(mautrix.BeeperFeatureBatchSending) {
+		return
+	}
+	if maxMembers := portal.bridge.Config.Bridge.Backfill.MaxGuildMembers; portal.GuildID != "" && maxMembers >= 0 && source.Session != nil {
+		guild, err := source.Session.State.Guild(portal.GuildID)
+		if err == nil && guild.MemberCount >= maxMembers {
+			return
+		}
+	}
+	var threadID string
+	if thread != nil {
+		threadID = thread.ID
+	}
+	firstMessage := portal.bridge.DB.Message.GetFirstInThread(portal.Key, threadID)
+	if firstMessage == nil {
+		return
+	}
+	task := portal.bridge.DB.Backfill.New()
+	task.Channel = portal.Key
+	task.ThreadID = threadID
+	task.BeforeID = firstMessage.DiscordID
+	task.Insert()
+}
+
+// getBackfillSource finds a logged-in user who can read the portal.
+func (portal *Portal) getBackfillSource() *User {
+	if portal.Key.Receiver != "" {
+		user := portal.bridge.GetCachedUserByID(portal.Key.Receiver)
+		if user != nil && user.Session != nil {
+			return user
+		}
+		return nil
+	}
+	var users []id.UserID
+	if portal.GuildID != "" {
+		users = portal.bridge.DB.GetUsersInPortal(portal.GuildID)
+	} else {
+		users = portal.bridge.DB.GetUsersInPortal(portal.Key.ChannelID)
+	}
+	for _, userID := range users {
+		user := portal.bridge.GetCachedUserByMXID(userID)
+		if user == nil || user.Session == nil {
+			continue
+		}
+		perms, err := user.Session.State.UserChannelPermissions(user.DiscordID, portal.Key.ChannelID)
+		if err == nil && perms&discordgo.PermissionReadMessageHistory == 0 {
+			continue
+		}
+		return user
+	}
+	return nil
+}
+
+const backwardBackfillIdleDelay = 1 * time.Minute
+
+// runBackwardBackfillQueue processes the backwards backfill queue one batch at a time until the stop channel is closed.
+func (br *DiscordBridge) runBackwardBackfillQueue(stop <-chan struct{}) {
+	log := br.ZLog.With().Str("component", "backward backfill").Logger()
+	if !br.SpecVersions.Supports(mautrix.BeeperFeatureBatchSending) {
+		log.Warn().Msg("Homeserver doesn't support batch sending, backwards backfill is disabled")
+		return
+	}
+	batchDelay := time.Duration(br.Config.Bridge.Backfill.Backward.BatchDelay) * time.Second
+	for {
+		delay := batchDelay
+		if task := br.DB.Backfill.GetNext(); task != nil {
+			br.backfillBackwards(log, task)
+		} else {
+			delay = backwardBackfillIdleDelay
+		}
+		select {
+		case <-stop:
+			log.Debug().Msg("Stopping backwards backfill queue")
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (br *DiscordBridge) backfillBackwards(log zerolog.Logger, task *database.Backfill) {
+	task.DispatchedAt = time.Now()
+	defer task.Update()
+	log = log.With().
+		Str("channel_id", task.Channel.ChannelID).
+		Str("channel_receiver", task.Channel.Receiver).
+		Str("thread_id", task.ThreadID).
+		Str("before_id", task.BeforeID).
+		Logger()
+	portal := br.GetExistingPortalByID(task.Channel)
+	if portal == nil || portal.MXID == "" {
+		log.Debug().Msg("Portal doesn't exist, marking backwards backfill as completed")
+		task.Completed = true
+		return
+	}
+	var thread *Thread
+	if task.ThreadID != "" {
+		thread = br.GetThreadByID(task.ThreadID, nil)
+		if thread == nil {
+			log.Debug().Msg("Thread doesn't exist, marking backwards backfill as completed")
+			task.Completed = true
+			return
+		}
+	}
+	source := portal.getBackfillSource()
+	if source == nil {
+		log.Debug().Msg("No logged-in users with access to channel, postponing backwards backfill")
+		return
+	}
+
+	portal.forwardBackfillLock.Lock()
+	defer portal.forwardBackfillLock.Unlock()
+	batchSize := br.Config.Bridge.Backfill.Backward.BatchSize
+	messages, _, err := portal.collectBackfillMessages(log, source, batchSize, task.BeforeID, "", thread)
+	if err != nil {
+		log.Err(err).Msg("Error collecting messages for backwards backfill")
+		return
+	}
+	if len(messages) > 0 {
+		sort.Sort(MessageSlice(messages))
+		log.Info().Int("count", len(messages)).Msg("Collected messages for backwards backfill")
+		if portal.batchSend(log, source, messages, thread, false) != nil {
+			return
+		}
+		task.BeforeID = messages[0].ID
+	}
+	if len(messages) < batchSize {
+		log.Info().Msg("Reached start of channel, backwards backfill completed")
+		task.Completed = true
+	}
 }
 
-func (portal *Portal) convertMessageBatch(log zerolog.Logger, source *User, messages []*discordgo.Message, thread *Thread) ([]*event.Event, []*discordgo.Message, []database.Message) {
+func (portal *Portal) convertMessageBatch(log zerolog.Logger, source *User, messages []*discordgo.Message, thread *Thread, forward bool) ([]*event.Event, []*discordgo.Message, []database.Message) {
 	var discordThreadID string
 	var threadRootEvent, lastThreadEvent id.EventID
 	if thread != nil {
@@ -248,7 +425,8 @@ func (portal *Portal) convertMessageBatch(log zerolog.Logger, source *User, mess
 		threadRootEvent = thread.RootMXID
 		lastThreadEvent = threadRootEvent
 		lastInThread := portal.bridge.DB.Message.GetLastInThread(portal.Key, thread.ID)
-		if lastInThread != nil {
+		// Backwards batches are inserted before everything else in the thread, so they start from the root.
+		if lastInThread != nil && forward {
 			lastThreadEvent = lastInThread.MXID
 		}
 	}
@@ -266,7 +444,6 @@ func (portal *Portal) convertMessageBatch(log zerolog.Logger, source *User, mess
 		puppet := portal.bridge.GetPuppetByID(msg.Author.ID)
 		puppet.UpdateInfo(source, msg.Author, msg)
 		intent := puppet.IntentFor(portal)
-		replyTo := portal.getReplyTarget(source, discordThreadID, msg.MessageReference, msg.Embeds, true)
 		mentions := portal.convertDiscordMentions(msg, false)
 
 		ts, _ := discordgo.SnowflakeTimestamp(msg.ID)
@@ -275,9 +452,18 @@ func (portal *Portal) convertMessageBatch(log zerolog.Logger, source *User, mess
 			Int("message_type", int(msg.Type)).
 			Str("author_id", msg.Author.ID).
 			Logger()
-		parts := portal.convertDiscordMessage(log.WithContext(ctx), puppet, intent, msg)
+		var replyTo *event.InReplyTo
+		var parts []*ConvertedMessage
+		if snapshot := portal.getForwardSnapshot(msg); snapshot != nil {
+			parts = portal.convertDiscordForward(log.WithContext(ctx), source, puppet, intent, msg, snapshot)
+		} else {
+			replyTo = portal.getReplyTarget(source, discordThreadID, msg.MessageReference, msg.Embeds, true)
+			parts = portal.convertDiscordMessage(log.WithContext(ctx), puppet, intent, msg)
+		}
 		for i, part := range parts {
-			if (replyTo != nil || threadRootEvent != "") && part.Content.RelatesTo == nil {
+			if part.Type == EventUnstablePollEnd {
+				// Poll ends already reference the poll start event
+			} else if (replyTo != nil || threadRootEvent != "") && part.Content.RelatesTo == nil {
 				part.Content.RelatesTo = &event.RelatesTo{}
 			}
 			if threadRootEvent != "" {
@@ -323,6 +509,7 @@ func (portal *Portal) convertMessageBatch(log zerolog.Logger, source *User, mess
 				SenderID:     msg.Author.ID,
 				Timestamp:    ts,
 				AttachmentID: part.AttachmentID,
+				ThreadID:     discordThreadID,
 				SenderMXID:   intent.UserID,
 			})
 			if i == 0 {
@@ -29,6 +29,7 @@ import (
 
 	"github.com/bwmarrin/discordgo"
 	"github.com/skip2/go-qrcode"
+	"golang.org/x/exp/slices"
 
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/appservice"
@@ -55,6 +56,7 @@ func (br *DiscordBridge) RegisterCommands() {
 	proc.AddHandlers(
 		cmdLoginToken,
 		cmdLoginQR,
+		cmdLoginPassword,
 		cmdLogout,
 		cmdPing,
 		cmdReconnect,
@@ -70,6 +72,10 @@ func (br *DiscordBridge) RegisterCommands() {
 		cmdDeleteAllPortals,
 		cmdExec,
 		cmdCommands,
+		cmdClick,
+		cmdForward,
+		cmdEvents,
+		cmdThreadRooms,
 	)
 }
 
@@ -173,6 +179,15 @@ var cmdLoginQR = &commands.FullHandler{
 	},
 }
 
+type qrLoginState struct {
+	cancel context.CancelFunc
+}
+
+// Cancel is called when the command state is replaced, e.g. by the cancel command.
+func (qls *qrLoginState) Cancel() {
+	qls.cancel()
+}
+
 func fnLoginQR(ce *WrappedCommandEvent) {
 	if ce.User.IsLoggedIn() {
 		ce.Reply("You're already logged in")
@@ -189,14 +204,24 @@ func fnLoginQR(ce *WrappedCommandEvent) {
 	doneChan := make(chan struct{})
 
 	var qrCodeEvent id.EventID
+	qrSenderDone := make(chan struct{})
 
 	go func() {
-		code := <-qrChan
-		resp := sendQRCode(ce, code)
-		qrCodeEvent = resp
+		defer close(qrSenderDone)
+		for code := range qrChan {
+			// New codes are sent when the previous one expires, so edit the existing image instead of spamming the room
+			qrCodeEvent = sendQRCode(ce, code, qrCodeEvent)
+		}
 	}()
 
-	ctx := context.Background()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	state := &commands.CommandState{
+		Action: "QR login",
+		Meta:   &qrLoginState{cancel: cancel},
+	}
+	ce.User.SetCommandState(state)
+	defer ce.User.clearCommandState(state)
 
 	if err = client.Dial(ctx, qrChan, doneChan); err != nil {
 		close(qrChan)
@@ -206,17 +231,29 @@ func fnLoginQR(ce *WrappedCommandEvent) {
 	}
 
 	<-doneChan
+	<-qrSenderDone
 
 	if qrCodeEvent != "" {
 		_, _ = ce.MainIntent().RedactEvent(ce.RoomID, qrCodeEvent)
 	}
 
 	user, err := client.Result()
-	if err != nil || len(user.Token) == 0 {
-		if restErr := (&discordgo.RESTError{}); errors.As(err, &restErr) &&
-			restErr.Response.StatusCode == http.StatusBadRequest &&
-			bytes.Contains(restErr.ResponseBody, []byte("captcha-required")) {
-			ce.Reply("Error logging in: %v\n\nCAPTCHAs are currently not supported - use token login instead", err)
+	if errors.Is(err, context.Canceled) {
+		// The cancel command already replied
+		return
+	} else if errors.Is(err, remoteauth.ErrTimedOut) {
+		ce.Reply("Login timed out: the QR code wasn't scanned in time. Use `$cmdprefix login-qr` to try again.")
+		return
+	} else if errors.Is(err, remoteauth.ErrCancelled) {
+		ce.Reply("Login was cancelled on the mobile app")
+		return
+	} else if err != nil || len(user.Token) == 0 {
+		if isCaptchaError(err) {
+			ce.User.sendProvisioningEvent(ProvisioningEventLoginCaptcha, provisioningEventLoginError{
+				Error:   "Discord requires a CAPTCHA to log in",
+				ErrCode: ErrCodeCaptchaRequired,
+			})
+			ce.Reply("Error logging in: Discord requires a CAPTCHA to finish QR login. Use `$cmdprefix login-password` or token login instead.")
 		} else {
 			ce.Reply("Error logging in: %v", err)
 		}
@@ -232,10 +269,21 @@ func fnLoginQR(ce *WrappedCommandEvent) {
 	ce.Reply("Successfully logged in as @%s", user.Username)
 }
 
-func sendQRCode(ce *WrappedCommandEvent, code string) id.EventID {
+func isCaptchaError(err error) bool {
+	captchaErr := &remoteauth.CaptchaError{}
+	if errors.As(err, &captchaErr) {
+		return true
+	}
+	restErr := &discordgo.RESTError{}
+	return errors.As(err, &restErr) &&
+		restErr.Response.StatusCode == http.StatusBadRequest &&
+		bytes.Contains(restErr.ResponseBody, []byte("captcha-required"))
+}
+
+func sendQRCode(ce *WrappedCommandEvent, code string, editEventID id.EventID) id.EventID {
 	url, ok := uploadQRCode(ce, code)
 	if !ok {
-		return ""
+		return editEventID
 	}
 
 	content := event.MessageEventContent{
@@ -243,11 +291,16 @@ func sendQRCode(ce *WrappedCommandEvent, code string) id.EventID {
 		Body:    code,
 		URL:     url.CUString(),
 	}
+	if editEventID != "" {
+		content.SetEdit(editEventID)
+	}
 
 	resp, err := ce.Bot.SendMessageEvent(ce.RoomID, event.EventMessage, &content)
 	if err != nil {
 		ce.Log.Errorfln("Failed to send QR code: %v", err)
-		return ""
+		return editEventID
+	} else if editEventID != "" {
+		return editEventID
 	}
 
 	return resp.EventID
@@ -387,6 +440,30 @@ func fnRejoinSpace(ce *WrappedCommandEvent) {
 
 var roomModerator = event.Type{Type: "fi.mau.discord.admin", Class: event.StateEventType}
 
+// canManageGuild checks if the user is allowed to change the bridge settings of a guild.
+// Bridge admins always are, other users need the Manage Server permission in the guild on Discord.
+func (user *User) canManageGuild(guildID string) bool {
+	if user.PermissionLevel >= bridgeconfig.PermissionLevelAdmin {
+		return true
+	} else if user.Session == nil {
+		return false
+	}
+	if guild, err := user.Session.State.Guild(guildID); err == nil && guild.OwnerID == user.DiscordID {
+		return true
+	}
+	member, err := user.Session.State.Member(guildID, user.DiscordID)
+	if err != nil {
+		return false
+	}
+	var perms int64
+	for _, role := range user.bridge.DB.Role.GetAll(guildID) {
+		if role.ID == guildID || slices.Contains(member.Roles, role.ID) {
+			perms |= role.Permissions
+		}
+	}
+	return perms&(discordgo.PermissionAdministrator|discordgo.PermissionManageGuild) != 0
+}
+
 var cmdSetRelay = &commands.FullHandler{
 	Func: wrapCommand(fnSetRelay),
 	Name: "set-relay",
@@ -446,6 +523,7 @@ func fnSetRelay(ce *WrappedCommandEvent) {
 	}
 	createType := strings.ToLower(strings.TrimLeft(ce.Args[0], "-"))
 	var webhookMeta *discordgo.Webhook
+	var err error
 	switch createType {
 	case "url":
 		if len(ce.Args) < 2 {
@@ -453,59 +531,90 @@ func fnSetRelay(ce *WrappedCommandEvent) {
 			return
 		}
 		ce.Redact()
-		var webhookID int64
-		var webhookSecret string
-		_, err := fmt.Sscanf(ce.Args[1], webhookURLFormat, &webhookID, &webhookSecret)
-		if err != nil {
-			log.Warn().Str("webhook_url", ce.Args[1]).Err(err).Msg("Failed to parse provided webhook URL")
-			ce.Reply("Invalid webhook URL")
-			return
-		}
-		webhookMeta, err = relayClient.WebhookWithToken(strconv.FormatInt(webhookID, 10), webhookSecret)
-		if err != nil {
-			log.Warn().Err(err).Msg("Failed to get webhook info")
-			ce.Reply("Failed to get webhook info: %v", err)
-			return
-		}
+		webhookMeta, err = getRelayWebhookByURL(ce.Args[1])
 	case "create":
-		perms, err := ce.User.Session.UserChannelPermissions(ce.User.DiscordID, portal.Key.ChannelID, portal.RefererOptIfUser(ce.User.Session, "")...)
-		if err != nil {
-			log.Warn().Err(err).Msg("Failed to check user permissions")
-			ce.Reply("Failed to check if you have permission to create webhooks")
-			return
-		} else if perms&discordgo.PermissionManageWebhooks == 0 {
-			log.Debug().Int64("perms", perms).Msg("User doesn't have permissions to manage webhooks in channel")
-			ce.Reply("You don't have permission to manage webhooks in that channel")
-			return
-		}
 		name := "mautrix"
 		if len(ce.Args) > 1 {
 			name = strings.Join(ce.Args[1:], " ")
 		}
-		log.Debug().Str("webhook_name", name).Msg("Creating webhook")
-		webhookMeta, err = ce.User.Session.WebhookCreate(portal.Key.ChannelID, name, "", portal.RefererOptIfUser(ce.User.Session, "")...)
-		if err != nil {
-			log.Warn().Err(err).Msg("Failed to create webhook")
-			ce.Reply("Failed to create webhook: %v", err)
-			return
-		}
+		webhookMeta, err = ce.User.createRelayWebhook(portal, name)
 	default:
 		ce.Reply(selectRelayHelp)
 		return
 	}
-	if portal.Key.ChannelID != webhookMeta.ChannelID {
-		log.Debug().
-			Str("portal_channel_id", portal.Key.ChannelID).
-			Str("webhook_channel_id", webhookMeta.ChannelID).
-			Msg("Provided webhook is for wrong channel")
-		ce.Reply("That webhook is not for the right channel (expected %s, webhook is for %s)", portal.Key.ChannelID, webhookMeta.ChannelID)
+	if err == nil {
+		err = portal.setRelayWebhook(webhookMeta)
+	}
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to set relay webhook")
+		ce.Reply("Failed to set relay webhook: %v", err)
 		return
 	}
-	log.Debug().Str("webhook_id", webhookMeta.ID).Msg("Setting portal relay webhook")
+	ce.Reply("Saved webhook %s (%s) as portal relay webhook", webhookMeta.Name, portal.RelayWebhookID)
+}
+
+var (
+	errInvalidWebhookURL    = errors.New("invalid webhook URL")
+	errNoWebhookPermission  = errors.New("you don't have permission to manage webhooks in that channel")
+	errWebhookWrongChannel  = errors.New("that webhook is not for the right channel")
+	errRelayWebhookNotFound = errors.New("this portal doesn't have a relay webhook")
+)
+
+func getRelayWebhookByURL(webhookURL string) (*discordgo.Webhook, error) {
+	var webhookID int64
+	var webhookSecret string
+	_, err := fmt.Sscanf(webhookURL, webhookURLFormat, &webhookID, &webhookSecret)
+	if err != nil {
+		return nil, errInvalidWebhookURL
+	}
+	webhookMeta, err := relayClient.WebhookWithToken(strconv.FormatInt(webhookID, 10), webhookSecret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get webhook info: %w", err)
+	}
+	return webhookMeta, nil
+}
+
+func (user *User) createRelayWebhook(portal *Portal, name string) (*discordgo.Webhook, error) {
+	log := user.log.With().Str("channel_id", portal.Key.ChannelID).Logger()
+	perms, err := user.Session.UserChannelPermissions(user.DiscordID, portal.Key.ChannelID, portal.RefererOptIfUser(user.Session, "")...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check permissions: %w", err)
+	} else if perms&discordgo.PermissionManageWebhooks == 0 {
+		log.Debug().Int64("perms", perms).Msg("User doesn't have permissions to manage webhooks in channel")
+		return nil, errNoWebhookPermission
+	}
+	log.Debug().Str("webhook_name", name).Msg("Creating webhook")
+	webhookMeta, err := user.Session.WebhookCreate(portal.Key.ChannelID, name, "", portal.RefererOptIfUser(user.Session, "")...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create webhook: %w", err)
+	}
+	return webhookMeta, nil
+}
+
+func (portal *Portal) setRelayWebhook(webhookMeta *discordgo.Webhook) error {
+	if portal.Key.ChannelID != webhookMeta.ChannelID {
+		return fmt.Errorf("%w (expected %s, webhook is for %s)", errWebhookWrongChannel, portal.Key.ChannelID, webhookMeta.ChannelID)
+	}
+	portal.log.Debug().Str("webhook_id", webhookMeta.ID).Msg("Setting portal relay webhook")
 	portal.RelayWebhookID = webhookMeta.ID
 	portal.RelayWebhookSecret = webhookMeta.Token
 	portal.Update()
-	ce.Reply("Saved webhook %s (%s) as portal relay webhook", webhookMeta.Name, portal.RelayWebhookID)
+	return nil
+}
+
+func (portal *Portal) unsetRelayWebhook(deleteWebhook bool) error {
+	if portal.RelayWebhookID == "" {
+		return errRelayWebhookNotFound
+	} else if deleteWebhook {
+		err := relayClient.WebhookDeleteWithToken(portal.RelayWebhookID, portal.RelayWebhookSecret)
+		if err != nil {
+			return fmt.Errorf("failed to delete webhook: %w", err)
+		}
+	}
+	portal.RelayWebhookID = ""
+	portal.RelayWebhookSecret = ""
+	portal.Update()
+	return nil
 }
 
 var cmdUnsetRelay = &commands.FullHandler{
@@ -521,24 +630,16 @@ var cmdUnsetRelay = &commands.FullHandler{
 }
 
 func fnUnsetRelay(ce *WrappedCommandEvent) {
-	if ce.Portal.RelayWebhookID == "" {
+	deleteWebhook := len(ce.Args) > 0 && ce.Args[0] == "--delete"
+	if err := ce.Portal.unsetRelayWebhook(deleteWebhook); errors.Is(err, errRelayWebhookNotFound) {
 		ce.Reply("This portal doesn't have a relay webhook")
-		return
-	}
-	if len(ce.Args) > 0 && ce.Args[0] == "--delete" {
-		err := relayClient.WebhookDeleteWithToken(ce.Portal.RelayWebhookID, ce.Portal.RelayWebhookSecret)
-		if err != nil {
-			ce.Reply("Failed to delete webhook: %v", err)
-			return
-		} else {
-			ce.Reply("Successfully deleted webhook")
-		}
+	} else if err != nil {
+		ce.Reply("Failed to delete webhook: %v", err)
+	} else if deleteWebhook {
+		ce.Reply("Successfully deleted webhook")
 	} else {
 		ce.Reply("Relay webhook disabled")
 	}
-	ce.Portal.RelayWebhookID = ""
-	ce.Portal.RelayWebhookSecret = ""
-	ce.Portal.Update()
 }
 
 var cmdGuilds = &commands.FullHandler{
@@ -703,76 +804,21 @@ func fnBridge(ce *WrappedCommandEvent) {
 		ce.Reply("**Usage**: `$cmdprefix bridge [--replace[=delete]] <channel ID>`")
 		return
 	}
-	portal := ce.User.GetExistingPortalByID(channelID)
-	if portal == nil {
-		ce.Reply("Channel not found")
-		return
-	}
-	portal.roomCreateLock.Lock()
-	defer portal.roomCreateLock.Unlock()
-	if portal.MXID != "" {
-		hasUnbridgePermission := ce.User.PermissionLevel >= bridgeconfig.PermissionLevelAdmin
-		if !hasUnbridgePermission {
-			levels, err := portal.MainIntent().PowerLevels(portal.MXID)
-			if errors.Is(err, mautrix.MNotFound) {
-				ce.ZLog.Debug().Err(err).Msg("Got M_NOT_FOUND trying to get power levels to check if user can unbridge it, assuming the room is gone")
-				hasUnbridgePermission = true
-			} else if err != nil {
-				ce.ZLog.Warn().Err(err).Msg("Failed to check room power levels")
-				ce.Reply("Failed to get power levels in old room to see if you're allowed to unbridge it")
-				return
-			} else {
-				hasUnbridgePermission = levels.GetUserLevel(ce.User.GetMXID()) >= levels.GetEventLevel(roomModerator)
-			}
-		}
-		if !unbridgeOld || !hasUnbridgePermission {
-			extraHelp := "Rerun the command with `--replace` or `--replace=delete` to unbridge the old room."
-			if !hasUnbridgePermission {
-				extraHelp = "Additionally, you do not have the permissions to unbridge the old room."
-			}
-			ce.Reply("That channel is already bridged to [%s](https://matrix.to/#/%s). %s", portal.Name, portal.MXID, extraHelp)
-			return
+	portal, err := ce.User.bridgeChannel(channelID, ce.RoomID, unbridgeOld, deleteOld)
+	if errors.Is(err, errChannelAlreadyBridged) || errors.Is(err, errNoUnbridgePermission) {
+		extraHelp := "Rerun the command with `--replace` or `--replace=delete` to unbridge the old room."
+		if errors.Is(err, errNoUnbridgePermission) {
+			extraHelp = "Additionally, you do not have the permissions to unbridge the old room."
 		}
-		ce.ZLog.Debug().
-			Str("old_room_id", portal.MXID.String()).
-			Bool("delete", deleteOld).
-			Msg("Unbridging old room")
-		portal.removeFromSpace()
-		portal.cleanup(!deleteOld)
-		portal.RemoveMXID()
-		ce.ZLog.Info().
-			Str("old_room_id", portal.MXID.String()).
-			Bool("delete", deleteOld).
-			Msg("Unbridged old room to make space for new bridge")
-	}
-	if portal.Guild != nil && portal.Guild.BridgingMode < database.GuildBridgeIfPortalExists {
-		ce.ZLog.Debug().Str("guild_id", portal.Guild.ID).Msg("Bumping bridging mode of portal guild to if-portal-exists")
-		portal.Guild.BridgingMode = database.GuildBridgeIfPortalExists
-		portal.Guild.Update()
-	}
-	ce.ZLog.Debug().Str("channel_id", portal.Key.ChannelID).Msg("Bridging room")
-	portal.MXID = ce.RoomID
-	portal.bridge.portalsLock.Lock()
-	portal.bridge.portalsByMXID[portal.MXID] = portal
-	portal.bridge.portalsLock.Unlock()
-	portal.updateRoomName()
-	portal.updateRoomAvatar()
-	portal.updateRoomTopic()
-	portal.updateSpace(ce.User)
-	portal.UpdateBridgeInfo()
-	state, err := portal.MainIntent().State(portal.MXID)
-	if err != nil {
-		ce.ZLog.Error().Err(err).Msg("Failed to update state cache for room")
+		ce.Reply("That channel is already bridged to [%s](https://matrix.to/#/%s). %s", portal.Name, portal.MXID, extraHelp)
+	} else if errors.Is(err, errChannelNotFound) {
+		ce.Reply("Channel not found")
+	} else if err != nil {
+		ce.ZLog.Warn().Err(err).Msg("Failed to bridge room")
+		ce.Reply("Failed to bridge room: %v", err)
 	} else {
-		encryptionEvent, isEncrypted := state[event.StateEncryption][""]
-		portal.Encrypted = isEncrypted && encryptionEvent.Content.AsEncryption().Algorithm == id.AlgorithmMegolmV1
+		ce.Reply("Room successfully bridged")
 	}
-	portal.Update()
-	ce.Reply("Room successfully bridged")
-	ce.ZLog.Info().
-		Str("channel_id", portal.Key.ChannelID).
-		Bool("encrypted", portal.Encrypted).
-		Msg("Manual bridging complete")
 }
 
 var cmdUnbridge = &commands.FullHandler{
@@ -798,27 +844,20 @@ var cmdCreatePortal = &commands.FullHandler{
 }
 
 func fnCreatePortal(ce *WrappedCommandEvent) {
-	meta, err := ce.User.Session.Channel(ce.Args[0])
-	if err != nil {
-		ce.Reply("Failed to get channel info: %v", err)
+	if len(ce.Args) == 0 {
+		ce.Reply("**Usage**: `$cmdprefix create-portal <channel ID>`")
 		return
-	} else if meta == nil {
+	}
+	portal, err := ce.User.createPortal(ce.Args[0])
+	if errors.Is(err, errChannelNotFound) {
 		ce.Reply("Channel not found")
-		return
-	} else if !ce.User.channelIsBridgeable(meta) {
+	} else if errors.Is(err, errChannelNotBridgeable) {
 		ce.Reply("That channel can't be bridged")
-		return
-	}
-	portal := ce.User.GetPortalByMeta(meta)
-	if portal.Guild != nil && portal.Guild.BridgingMode == database.GuildBridgeNothing {
+	} else if errors.Is(err, errGuildBridgesNothing) {
 		ce.Reply("That guild is set to not bridge any messages. Bridge the guild with `$cmdprefix guilds bridge %s` first", portal.Guild.ID)
-		return
-	} else if portal.MXID != "" {
+	} else if errors.Is(err, errChannelAlreadyBridged) {
 		ce.Reply("That channel is already bridged: [%s](%s)", portal.Name, portal.MXID.URI(portal.bridge.Config.Homeserver.Domain).MatrixToURL())
-		return
-	}
-	err = portal.CreateMatrixRoom(ce.User, meta)
-	if err != nil {
+	} else if err != nil {
 		ce.Reply("Failed to create portal: %v", err)
 	} else {
 		ce.Reply("Portal created: [%s](%s)", portal.Name, portal.MXID.URI(portal.bridge.Config.Homeserver.Domain).MatrixToURL())
@@ -837,11 +876,7 @@ var cmdDeletePortal = &commands.FullHandler{
 }
 
 func fnUnbridge(ce *WrappedCommandEvent) {
-	ce.Portal.roomCreateLock.Lock()
-	defer ce.Portal.roomCreateLock.Unlock()
-	ce.Portal.removeFromSpace()
-	ce.Portal.cleanup(ce.Command == "unbridge")
-	ce.Portal.RemoveMXID()
+	ce.Portal.Unbridge(ce.Command == "delete-portal")
 }
 
 var cmdDeleteAllPortals = &commands.FullHandler{
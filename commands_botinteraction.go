@@ -18,6 +18,9 @@ package main
 
 import (
 	"fmt"
+	"html"
+	"net/http"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -26,6 +29,8 @@ import (
 	"github.com/google/shlex"
 
 	"maunium.net/go/mautrix/bridge/commands"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
 )
 
 var HelpSectionDiscordBots = commands.HelpSection{Name: "Discord bot interaction", Order: 30}
@@ -56,6 +61,19 @@ var cmdExec = &commands.FullHandler{
 	RequiresPortal: true,
 }
 
+var cmdClick = &commands.FullHandler{
+	Func:    wrapCommand(fnClick),
+	Name:    "click",
+	Aliases: []string{"press", "select"},
+	Help: commands.HelpMeta{
+		Section:     HelpSectionDiscordBots,
+		Description: "Click a button or choose a select menu option in a Discord bot message. Reply to the message, or omit the reply to use the most recent message with buttons.",
+		Args:        "<_number_>",
+	},
+	RequiresLogin:  true,
+	RequiresPortal: true,
+}
+
 func (portal *Portal) getCommand(user *User, command string) (*discordgo.ApplicationCommand, error) {
 	portal.commandsLock.Lock()
 	defer portal.commandsLock.Unlock()
@@ -84,7 +102,7 @@ func getCommandOptionTypeName(optType discordgo.ApplicationCommandOptionType) st
 	case discordgo.ApplicationCommandOptionSubCommand:
 		return "subcommand"
 	case discordgo.ApplicationCommandOptionSubCommandGroup:
-		return "subcommand group (unsupported)"
+		return "subcommand group"
 	case discordgo.ApplicationCommandOptionString:
 		return "string"
 	case discordgo.ApplicationCommandOptionInteger:
@@ -92,17 +110,17 @@ func getCommandOptionTypeName(optType discordgo.ApplicationCommandOptionType) st
 	case discordgo.ApplicationCommandOptionBoolean:
 		return "boolean"
 	case discordgo.ApplicationCommandOptionUser:
-		return "user (unsupported)"
+		return "user"
 	case discordgo.ApplicationCommandOptionChannel:
-		return "channel (unsupported)"
+		return "channel"
 	case discordgo.ApplicationCommandOptionRole:
-		return "role (unsupported)"
+		return "role"
 	case discordgo.ApplicationCommandOptionMentionable:
-		return "mentionable (unsupported)"
+		return "mentionable"
 	case discordgo.ApplicationCommandOptionNumber:
 		return "number"
 	case discordgo.ApplicationCommandOptionAttachment:
-		return "attachment (unsupported)"
+		return "attachment (reply to a file)"
 	default:
 		return fmt.Sprintf("unknown type %d", optType)
 	}
@@ -110,28 +128,185 @@ func getCommandOptionTypeName(optType discordgo.ApplicationCommandOptionType) st
 
 func parseCommandOptionValue(optType discordgo.ApplicationCommandOptionType, value string) (any, error) {
 	switch optType {
-	case discordgo.ApplicationCommandOptionSubCommandGroup:
-		return nil, fmt.Errorf("subcommand groups aren't supported")
 	case discordgo.ApplicationCommandOptionString:
 		return value, nil
 	case discordgo.ApplicationCommandOptionInteger:
 		return strconv.ParseInt(value, 10, 64)
 	case discordgo.ApplicationCommandOptionBoolean:
 		return strconv.ParseBool(value)
+	case discordgo.ApplicationCommandOptionNumber:
+		return strconv.ParseFloat(value, 64)
+	default:
+		return nil, fmt.Errorf("unknown option type %d", optType)
+	}
+}
+
+// commandArgContext resolves command arguments that refer to Matrix entities or files.
+type commandArgContext struct {
+	ce *WrappedCommandEvent
+	// pills maps the text of pills in the command message to the Matrix IDs they point at.
+	pills       map[string]string
+	attachments []*discordgo.MessageAttachment
+}
+
+var pillRegex = regexp.MustCompile(`<a href="(https://matrix\.to/#/[^"]+)">(.*?)</a>`)
+
+func newCommandArgContext(ce *WrappedCommandEvent) *commandArgContext {
+	ctx := &commandArgContext{ce: ce, pills: make(map[string]string)}
+	evt, err := ce.Portal.getEvent(ce.EventID)
+	if err != nil {
+		ce.ZLog.Warn().Err(err).Msg("Failed to get command event to find pills")
+		return ctx
+	}
+	content, ok := evt.Content.Parsed.(*event.MessageEventContent)
+	if ok && content.Format == event.FormatHTML {
+		ctx.pills = parseCommandPills(content.FormattedBody)
+	}
+	return ctx
+}
+
+// parseCommandPills maps the display text of each matrix.to link in the given HTML to the Matrix ID it points at.
+func parseCommandPills(formattedBody string) map[string]string {
+	pills := make(map[string]string)
+	for _, match := range pillRegex.FindAllStringSubmatch(formattedBody, -1) {
+		uri, err := id.ParseMatrixToURL(html.UnescapeString(match[1]))
+		if err != nil {
+			continue
+		}
+		pills[html.UnescapeString(match[2])] = uri.PrimaryIdentifier()
+	}
+	return pills
+}
+
+func (ctx *commandArgContext) matrixIdentifier(value string) string {
+	if pillTarget, ok := ctx.pills[value]; ok {
+		return pillTarget
+	} else if uri, err := id.ParseMatrixURIOrMatrixToURL(value); err == nil {
+		return uri.PrimaryIdentifier()
+	}
+	return value
+}
+
+// trimDiscordMention extracts the ID from a Discord mention like <@123>, or from a plain numeric ID.
+func trimDiscordMention(value, prefix string) (string, bool) {
+	if strings.HasPrefix(value, prefix) && strings.HasSuffix(value, ">") {
+		value = strings.TrimSuffix(strings.TrimPrefix(value, prefix), ">")
+	}
+	return value, value != "" && isNumber(value)
+}
+
+func (ctx *commandArgContext) resolveUser(value string) (string, error) {
+	if userID, ok := trimDiscordMention(strings.Replace(value, "<@!", "<@", 1), "<@"); ok {
+		return userID, nil
+	}
+	mxid := id.UserID(ctx.matrixIdentifier(value))
+	if discordID, ok := ctx.ce.Bridge.ParsePuppetMXID(mxid); ok {
+		return discordID, nil
+	} else if user := ctx.ce.Bridge.GetCachedUserByMXID(mxid); user != nil && user.DiscordID != "" {
+		return user.DiscordID, nil
+	}
+	return "", fmt.Errorf("%q is not a Discord user", value)
+}
+
+func (ctx *commandArgContext) resolveChannel(value string) (string, error) {
+	if channelID, ok := trimDiscordMention(value, "<#"); ok {
+		return channelID, nil
+	}
+	identifier := ctx.matrixIdentifier(value)
+	roomID := id.RoomID(identifier)
+	if strings.HasPrefix(identifier, "#") {
+		resp, err := ctx.ce.Bot.ResolveAlias(id.RoomAlias(identifier))
+		if err != nil {
+			return "", fmt.Errorf("failed to resolve %s: %w", identifier, err)
+		}
+		roomID = resp.RoomID
+	}
+	if portal := ctx.ce.Bridge.GetPortalByMXID(roomID); portal != nil {
+		return portal.Key.ChannelID, nil
+	}
+	return "", fmt.Errorf("%q is not a Discord channel", value)
+}
+
+func (ctx *commandArgContext) resolveRole(value string) (string, error) {
+	if roleID, ok := trimDiscordMention(value, "<@&"); ok {
+		return roleID, nil
+	}
+	name := strings.TrimPrefix(value, "@")
+	for _, role := range ctx.ce.Bridge.DB.Role.GetAll(ctx.ce.Portal.GuildID) {
+		if strings.EqualFold(role.Name, name) {
+			return role.ID, nil
+		}
+	}
+	return "", fmt.Errorf("%q is not a role in this server", value)
+}
+
+// uploadReplyAttachment uploads the media in the message the command is replying to.
+// The returned value is the attachment ID to use as the option value.
+func (ctx *commandArgContext) uploadReplyAttachment() (string, error) {
+	if len(ctx.attachments) > 0 {
+		return "", fmt.Errorf("only one attachment argument is supported")
+	} else if ctx.ce.ReplyTo == "" {
+		return "", fmt.Errorf("reply to a file to use it as an attachment argument")
+	}
+	evt, err := ctx.ce.Portal.getEvent(ctx.ce.ReplyTo)
+	if err != nil {
+		return "", fmt.Errorf("failed to get replied-to event: %w", err)
+	}
+	content, ok := evt.Content.Parsed.(*event.MessageEventContent)
+	if !ok || content.URL == "" && content.File == nil {
+		return "", fmt.Errorf("replied-to event is not a file")
+	}
+	data, err := downloadMatrixAttachment(ctx.ce.Portal.MainIntent(), content)
+	if err != nil {
+		return "", fmt.Errorf("failed to download file: %w", err)
+	}
+	filename := content.Body
+	if content.FileName != "" {
+		filename = content.FileName
+	}
+	prep, err := ctx.ce.User.Session.ChannelAttachmentCreate(ctx.ce.Portal.Key.ChannelID, &discordgo.ReqPrepareAttachments{
+		Files: []*discordgo.FilePrepare{{
+			Size: len(data),
+			Name: filename,
+			ID:   ctx.ce.User.NextDiscordUploadID(),
+		}},
+	}, ctx.ce.Portal.RefererOpt(""))
+	if err != nil {
+		return "", fmt.Errorf("failed to prepare upload: %w", err)
+	}
+	prepared := prep.Attachments[0]
+	err = uploadDiscordAttachment(ctx.ce.User.Session.Client, prepared.UploadURL, data)
+	if err != nil {
+		return "", fmt.Errorf("failed to upload file: %w", err)
+	}
+	attachmentID := strconv.Itoa(len(ctx.attachments))
+	ctx.attachments = append(ctx.attachments, &discordgo.MessageAttachment{
+		ID:               attachmentID,
+		Filename:         filename,
+		UploadedFilename: prepared.UploadFilename,
+	})
+	return attachmentID, nil
+}
+
+func (ctx *commandArgContext) parseValue(optType discordgo.ApplicationCommandOptionType, value string) (any, error) {
+	switch optType {
 	case discordgo.ApplicationCommandOptionUser:
-		return nil, fmt.Errorf("user options aren't supported")
+		return ctx.resolveUser(value)
 	case discordgo.ApplicationCommandOptionChannel:
-		return nil, fmt.Errorf("channel options aren't supported")
+		return ctx.resolveChannel(value)
 	case discordgo.ApplicationCommandOptionRole:
-		return nil, fmt.Errorf("role options aren't supported")
+		return ctx.resolveRole(value)
 	case discordgo.ApplicationCommandOptionMentionable:
-		return nil, fmt.Errorf("mentionable options aren't supported")
-	case discordgo.ApplicationCommandOptionNumber:
-		return strconv.ParseFloat(value, 64)
+		if userID, err := ctx.resolveUser(value); err == nil {
+			return userID, nil
+		} else if roleID, err := ctx.resolveRole(value); err == nil {
+			return roleID, nil
+		}
+		return nil, fmt.Errorf("%q is not a Discord user or role", value)
 	case discordgo.ApplicationCommandOptionAttachment:
-		return nil, fmt.Errorf("attachment options aren't supported")
+		return ctx.uploadReplyAttachment()
 	default:
-		return nil, fmt.Errorf("unknown option type %d", optType)
+		return parseCommandOptionValue(optType, value)
 	}
 }
 
@@ -179,53 +354,48 @@ func formatCommand(cmd *discordgo.ApplicationCommand) string {
 	return baseText
 }
 
-func parseCommandOptions(opts []*discordgo.ApplicationCommandOption, subcommands []string, namedArgs map[string]string) (res []*discordgo.ApplicationCommandOptionInput, err error) {
+func (ctx *commandArgContext) parseCommandOptions(opts []*discordgo.ApplicationCommandOption, subcommands []string, namedArgs map[string]string) (res []*discordgo.ApplicationCommandOptionInput, err error) {
 	subcommandDone := false
 	for _, opt := range opts {
 		optRes := &discordgo.ApplicationCommandOptionInput{
 			Type: opt.Type,
 			Name: opt.Name,
 		}
-		if opt.Type == discordgo.ApplicationCommandOptionSubCommand {
+		argVal, hasArg := namedArgs[opt.Name]
+		if opt.Type == discordgo.ApplicationCommandOptionSubCommand || opt.Type == discordgo.ApplicationCommandOptionSubCommandGroup {
 			if !subcommandDone && len(subcommands) > 0 && subcommands[0] == opt.Name {
 				subcommandDone = true
-				optRes.Options, err = parseCommandOptions(opt.Options, subcommands[1:], namedArgs)
+				optRes.Options, err = ctx.parseCommandOptions(opt.Options, subcommands[1:], namedArgs)
 				if err != nil {
 					err = fmt.Errorf("error parsing subcommand %s: %v", opt.Name, err)
 					break
 				}
-				subcommands = subcommands[1:]
+				// The nested call checks that all subcommands were consumed
+				subcommands = nil
 			} else {
 				continue
 			}
-		} else if argVal, ok := namedArgs[opt.Name]; ok {
-			optRes.Value, err = parseCommandOptionValue(opt.Type, argVal)
+		} else if hasArg || (opt.Type == discordgo.ApplicationCommandOptionAttachment && opt.Required && ctx.ce.ReplyTo != "") {
+			optRes.Value, err = ctx.parseValue(opt.Type, argVal)
 			if err != nil {
 				err = fmt.Errorf("error parsing parameter %s: %v", opt.Name, err)
 				break
 			}
 		} else if opt.Required {
-			switch opt.Type {
-			case discordgo.ApplicationCommandOptionSubCommandGroup, discordgo.ApplicationCommandOptionUser,
-				discordgo.ApplicationCommandOptionChannel, discordgo.ApplicationCommandOptionRole,
-				discordgo.ApplicationCommandOptionMentionable, discordgo.ApplicationCommandOptionAttachment:
-				err = fmt.Errorf("missing required parameter %s (which is not supported by the bridge)", opt.Name)
-			default:
-				err = fmt.Errorf("missing required parameter %s", opt.Name)
-			}
+			err = fmt.Errorf("missing required parameter %s", opt.Name)
 			break
 		} else {
 			continue
 		}
 		res = append(res, optRes)
 	}
-	if len(subcommands) > 0 {
+	if err == nil && len(subcommands) > 0 {
 		err = fmt.Errorf("unparsed subcommands left over (did you forget quoting for parameters with spaces?)")
 	}
 	return
 }
 
-func executeCommand(cmd *discordgo.ApplicationCommand, args []string) (res []*discordgo.ApplicationCommandOptionInput, err error) {
+func (ctx *commandArgContext) executeCommand(cmd *discordgo.ApplicationCommand, args []string) (res []*discordgo.ApplicationCommandOptionInput, err error) {
 	namedArgs := map[string]string{}
 	n := 0
 	for _, arg := range args {
@@ -237,7 +407,65 @@ func executeCommand(cmd *discordgo.ApplicationCommand, args []string) (res []*di
 			n++
 		}
 	}
-	return parseCommandOptions(cmd.Options, args[:n], namedArgs)
+	return ctx.parseCommandOptions(cmd.Options, args[:n], namedArgs)
+}
+
+type commandInteractionData struct {
+	Version       string                           `json:"version"`
+	ID            string                           `json:"id"`
+	ApplicationID string                           `json:"application_id"`
+	Name          string                           `json:"name"`
+	Type          discordgo.ApplicationCommandType `json:"type"`
+
+	Options     []*discordgo.ApplicationCommandOptionInput `json:"options"`
+	Attachments []*discordgo.MessageAttachment             `json:"attachments"`
+
+	ApplicationCommand *discordgo.ApplicationCommand `json:"application_command"`
+}
+
+type reqCommandInteraction struct {
+	Type          discordgo.InteractionType `json:"type"`
+	ApplicationID string                    `json:"application_id"`
+	GuildID       string                    `json:"guild_id,omitempty"`
+	ChannelID     string                    `json:"channel_id"`
+	SessionID     string                    `json:"session_id"`
+	Data          commandInteractionData    `json:"data"`
+	Nonce         string                    `json:"nonce"`
+}
+
+// sendCommandInteraction is like discordgo's SendInteractions, but supports attachment options.
+func (portal *Portal) sendCommandInteraction(user *User, cmd *discordgo.ApplicationCommand, options []*discordgo.ApplicationCommandOptionInput, attachments []*discordgo.MessageAttachment, nonce string) error {
+	if options == nil {
+		options = make([]*discordgo.ApplicationCommandOptionInput, 0)
+	}
+	if attachments == nil {
+		attachments = make([]*discordgo.MessageAttachment, 0)
+	}
+	req := &reqCommandInteraction{
+		Type:          discordgo.InteractionApplicationCommand,
+		ApplicationID: cmd.ApplicationID,
+		GuildID:       portal.GuildID,
+		ChannelID:     portal.Key.ChannelID,
+		SessionID:     user.Session.State.SessionID,
+		Data: commandInteractionData{
+			Version:            cmd.Version,
+			ID:                 cmd.ID,
+			ApplicationID:      cmd.ApplicationID,
+			Name:               cmd.Name,
+			Type:               cmd.Type,
+			Options:            options,
+			Attachments:        attachments,
+			ApplicationCommand: cmd,
+		},
+		Nonce: nonce,
+	}
+	contentType, body, err := discordgo.MultipartBodyWithJSON(req, nil)
+	if err != nil {
+		return err
+	}
+	endpoint := discordgo.EndpointInteractions
+	_, err = user.Session.RequestWithLockedBucket(http.MethodPost, endpoint, contentType, body, user.Session.Ratelimiter.LockBucket(endpoint), 0, portal.RefererOpt(""))
+	return err
 }
 
 func fnCommands(ce *WrappedCommandEvent) {
@@ -288,31 +516,165 @@ func fnExec(ce *WrappedCommandEvent) {
 	cmd, err := ce.Portal.getCommand(ce.User, command)
 	if err != nil {
 		ce.Reply("Error searching for commands: %v", err)
+		return
 	} else if cmd == nil {
 		ce.Reply("Command %q not found", command)
-	} else if options, err := executeCommand(cmd, args[1:]); err != nil {
+		return
+	}
+	argCtx := newCommandArgContext(ce)
+	options, err := argCtx.executeCommand(cmd, args[1:])
+	if err != nil {
 		ce.Reply("Error parsing arguments: %v\n\n**Usage:** "+formatCommand(cmd), err)
+		return
+	}
+	ce.User.sendPendingInteraction(ce, func(nonce string) error {
+		return ce.Portal.sendCommandInteraction(ce.User, cmd, options, argCtx.attachments, nonce)
+	})
+}
+
+// sendPendingInteraction sends an interaction and reacts to the command once Discord confirms it.
+func (user *User) sendPendingInteraction(ce *WrappedCommandEvent, send func(nonce string) error) {
+	nonce := generateNonce()
+	user.pendingInteractionsLock.Lock()
+	user.pendingInteractions[nonce] = ce
+	user.pendingInteractionsLock.Unlock()
+	err := send(nonce)
+	if err != nil {
+		ce.Reply("Error sending interaction: %v", err)
+		user.pendingInteractionsLock.Lock()
+		delete(user.pendingInteractions, nonce)
+		user.pendingInteractionsLock.Unlock()
 	} else {
-		nonce := generateNonce()
-		ce.User.pendingInteractionsLock.Lock()
-		ce.User.pendingInteractions[nonce] = ce
-		ce.User.pendingInteractionsLock.Unlock()
-		err = ce.User.Session.SendInteractions(ce.Portal.GuildID, ce.Portal.Key.ChannelID, cmd, options, nonce, ce.Portal.RefererOpt(""))
+		go func() {
+			time.Sleep(10 * time.Second)
+			user.pendingInteractionsLock.Lock()
+			if _, stillWaiting := user.pendingInteractions[nonce]; stillWaiting {
+				delete(user.pendingInteractions, nonce)
+				ce.Reply("Timed out waiting for interaction success")
+			}
+			user.pendingInteractionsLock.Unlock()
+		}()
+	}
+}
+
+type componentInteractionData struct {
+	ComponentType discordgo.ComponentType `json:"component_type"`
+	CustomID      string                  `json:"custom_id"`
+	Type          discordgo.ComponentType `json:"type,omitempty"`
+	Values        []string                `json:"values,omitempty"`
+}
+
+type reqComponentInteraction struct {
+	Type          discordgo.InteractionType `json:"type"`
+	Nonce         string                    `json:"nonce"`
+	GuildID       string                    `json:"guild_id,omitempty"`
+	ChannelID     string                    `json:"channel_id"`
+	MessageFlags  discordgo.MessageFlags    `json:"message_flags"`
+	MessageID     string                    `json:"message_id"`
+	ApplicationID string                    `json:"application_id"`
+	SessionID     string                    `json:"session_id"`
+	Data          componentInteractionData  `json:"data"`
+}
+
+func (portal *Portal) sendComponentInteraction(user *User, channelID string, msg *discordgo.Message, opt *DiscordComponentOption, nonce string) error {
+	applicationID := msg.ApplicationID
+	if applicationID == "" {
+		applicationID = msg.Author.ID
+	}
+	req := &reqComponentInteraction{
+		Type:          discordgo.InteractionMessageComponent,
+		Nonce:         nonce,
+		GuildID:       portal.GuildID,
+		ChannelID:     channelID,
+		MessageFlags:  msg.Flags,
+		MessageID:     msg.ID,
+		ApplicationID: applicationID,
+		SessionID:     user.Session.State.SessionID,
+		Data: componentInteractionData{
+			ComponentType: opt.ComponentType,
+			CustomID:      opt.CustomID,
+		},
+	}
+	if opt.ComponentType == discordgo.SelectMenuComponent {
+		req.Data.Type = opt.ComponentType
+		req.Data.Values = []string{opt.Value}
+	}
+	_, err := user.Session.RequestWithBucketID(http.MethodPost, discordgo.EndpointInteractions, req, discordgo.EndpointInteractions, portal.RefererOpt(channelID))
+	return err
+}
+
+// findComponentMessage finds the Discord message the click command targets:
+// the message being replied to, or the most recent message with components in the channel.
+func (portal *Portal) findComponentMessage(user *User, replyTo id.EventID) (*discordgo.Message, string, error) {
+	channelID := portal.Key.ChannelID
+	if replyTo == "" {
+		msgs, err := user.Session.ChannelMessages(channelID, 25, "", "", "", portal.RefererOptIfUser(user.Session, "")...)
 		if err != nil {
-			ce.Reply("Error sending interaction: %v", err)
-			ce.User.pendingInteractionsLock.Lock()
-			delete(ce.User.pendingInteractions, nonce)
-			ce.User.pendingInteractionsLock.Unlock()
-		} else {
-			go func() {
-				time.Sleep(10 * time.Second)
-				ce.User.pendingInteractionsLock.Lock()
-				if _, stillWaiting := ce.User.pendingInteractions[nonce]; stillWaiting {
-					delete(ce.User.pendingInteractions, nonce)
-					ce.Reply("Timed out waiting for interaction success")
-				}
-				ce.User.pendingInteractionsLock.Unlock()
-			}()
+			return nil, "", fmt.Errorf("failed to fetch recent messages: %w", err)
+		}
+		for _, msg := range msgs {
+			if len(msg.Components) > 0 {
+				return msg, channelID, nil
+			}
+		}
+		return nil, "", nil
+	}
+	dbMsg := portal.bridge.DB.Message.GetByMXID(portal.Key, replyTo)
+	if dbMsg == nil {
+		return nil, "", nil
+	}
+	if dbMsg.ThreadID != "" {
+		channelID = dbMsg.ThreadID
+	}
+	if msg, ok := portal.recentMessages.Get(dbMsg.DiscordID); ok {
+		return msg, channelID, nil
+	}
+	if !user.Session.IsUser {
+		msg, err := user.Session.ChannelMessage(channelID, dbMsg.DiscordID)
+		return msg, channelID, err
+	}
+	msgs, err := user.Session.ChannelMessages(channelID, 1, "", "", dbMsg.DiscordID, portal.RefererOpt(channelID))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to fetch message: %w", err)
+	}
+	for _, msg := range msgs {
+		if msg.ID == dbMsg.DiscordID {
+			return msg, channelID, nil
 		}
 	}
+	return nil, "", nil
+}
+
+func fnClick(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 {
+		ce.Reply("**Usage**: `$cmdprefix click <number>`")
+		return
+	}
+	index, err := strconv.Atoi(ce.Args[0])
+	if err != nil || index <= 0 {
+		ce.Reply("**Usage**: `$cmdprefix click <number>`")
+		return
+	}
+	msg, channelID, err := ce.Portal.findComponentMessage(ce.User, ce.ReplyTo)
+	if err != nil {
+		ce.Reply("Error finding message: %v", err)
+		return
+	} else if msg == nil {
+		ce.Reply("Message with interactive elements not found")
+		return
+	}
+	var target *DiscordComponentOption
+	for _, opt := range flattenDiscordComponents(msg.Components) {
+		if opt.Index == index {
+			target = opt
+			break
+		}
+	}
+	if target == nil {
+		ce.Reply("That message doesn't have an option numbered %d", index)
+		return
+	}
+	ce.User.sendPendingInteraction(ce, func(nonce string) error {
+		return ce.Portal.sendComponentInteraction(ce.User, channelID, msg, target, nonce)
+	})
 }
@@ -0,0 +1,173 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/google/shlex"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCommandPills(t *testing.T) {
+	type pillTest struct {
+		name     string
+		input    string
+		expected map[string]string
+	}
+
+	tests := []pillTest{
+		{"User pill", `hi <a href="https://matrix.to/#/@john:example.com">John</a>`, map[string]string{"John": "@john:example.com"}},
+		{"Multi-word name", `<a href="https://matrix.to/#/@john:example.com">John Doe</a>`, map[string]string{"John Doe": "@john:example.com"}},
+		{"Room alias", `<a href="https://matrix.to/#/%23general:example.com">#general</a>`, map[string]string{"#general": "#general:example.com"}},
+		{"Escaped name", `<a href="https://matrix.to/#/@tom:example.com">Tom &amp; Jerry</a>`, map[string]string{"Tom & Jerry": "@tom:example.com"}},
+		{"Multiple pills", `<a href="https://matrix.to/#/@a:example.com">A</a> and <a href="https://matrix.to/#/@b:example.com">B</a>`, map[string]string{"A": "@a:example.com", "B": "@b:example.com"}},
+		{"Normal link", `<a href="https://example.com">John</a>`, map[string]string{}},
+		{"No links", `plain text`, map[string]string{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, parseCommandPills(test.input))
+		})
+	}
+}
+
+func TestCommandArgPillQuoting(t *testing.T) {
+	type quotingTest struct {
+		name     string
+		rawArgs  string
+		expected map[string]string
+	}
+
+	ctx := &commandArgContext{pills: parseCommandPills(
+		`<a href="https://matrix.to/#/@john:example.com">John Doe</a> ` +
+			`<a href="https://matrix.to/#/%23general:example.com">#general chat</a>`,
+	)}
+	tests := []quotingTest{
+		{"Quoted whole argument", `"user=John Doe"`, map[string]string{"user": "@john:example.com"}},
+		{"Quoted value", `user="John Doe"`, map[string]string{"user": "@john:example.com"}},
+		{"Single quotes", `user='John Doe' channel='#general chat'`, map[string]string{"user": "@john:example.com", "channel": "#general:example.com"}},
+		{"Unknown name", `user="Jane Doe"`, map[string]string{"user": "Jane Doe"}},
+		{"Matrix URI", `user=matrix:u/john:example.com`, map[string]string{"user": "@john:example.com"}},
+		{"Plain ID", `user=@jane:example.com`, map[string]string{"user": "@jane:example.com"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			args, err := shlex.Split(test.rawArgs)
+			require.NoError(t, err)
+			resolved := make(map[string]string)
+			for _, arg := range args {
+				name, value, _ := strings.Cut(arg, "=")
+				resolved[name] = ctx.matrixIdentifier(value)
+			}
+			assert.Equal(t, test.expected, resolved)
+		})
+	}
+}
+
+func TestExecuteCommandArgs(t *testing.T) {
+	type argTest struct {
+		name     string
+		rawArgs  string
+		expected []*discordgo.ApplicationCommandOptionInput
+		err      string
+	}
+
+	cmd := &discordgo.ApplicationCommand{
+		Name: "test",
+		Options: []*discordgo.ApplicationCommandOption{{
+			Type: discordgo.ApplicationCommandOptionSubCommandGroup,
+			Name: "config",
+			Options: []*discordgo.ApplicationCommandOption{{
+				Type: discordgo.ApplicationCommandOptionSubCommand,
+				Name: "set",
+				Options: []*discordgo.ApplicationCommandOption{
+					{Type: discordgo.ApplicationCommandOptionString, Name: "key", Required: true},
+					{Type: discordgo.ApplicationCommandOptionString, Name: "value"},
+				},
+			}},
+		}, {
+			Type: discordgo.ApplicationCommandOptionSubCommand,
+			Name: "ping",
+			Options: []*discordgo.ApplicationCommandOption{
+				{Type: discordgo.ApplicationCommandOptionInteger, Name: "count"},
+				{Type: discordgo.ApplicationCommandOptionBoolean, Name: "loud"},
+				{Type: discordgo.ApplicationCommandOptionNumber, Name: "ratio"},
+				{Type: discordgo.ApplicationCommandOptionUser, Name: "target"},
+				{Type: discordgo.ApplicationCommandOptionChannel, Name: "where"},
+				{Type: discordgo.ApplicationCommandOptionRole, Name: "role"},
+			},
+		}},
+	}
+	subcommand := func(name string, opts ...*discordgo.ApplicationCommandOptionInput) *discordgo.ApplicationCommandOptionInput {
+		return &discordgo.ApplicationCommandOptionInput{Type: discordgo.ApplicationCommandOptionSubCommand, Name: name, Options: opts}
+	}
+	value := func(optType discordgo.ApplicationCommandOptionType, name string, val any) *discordgo.ApplicationCommandOptionInput {
+		return &discordgo.ApplicationCommandOptionInput{Type: optType, Name: name, Value: val}
+	}
+
+	tests := []argTest{
+		{"Primitive values", `ping count=3 loud=true ratio=0.5`, []*discordgo.ApplicationCommandOptionInput{subcommand("ping",
+			value(discordgo.ApplicationCommandOptionInteger, "count", int64(3)),
+			value(discordgo.ApplicationCommandOptionBoolean, "loud", true),
+			value(discordgo.ApplicationCommandOptionNumber, "ratio", 0.5),
+		)}, ""},
+		{"Discord mentions", `ping target=<@!123> where=<#456> role=<@&789>`, []*discordgo.ApplicationCommandOptionInput{subcommand("ping",
+			value(discordgo.ApplicationCommandOptionUser, "target", "123"),
+			value(discordgo.ApplicationCommandOptionChannel, "where", "456"),
+			value(discordgo.ApplicationCommandOptionRole, "role", "789"),
+		)}, ""},
+		{"Plain user ID", `ping target=123`, []*discordgo.ApplicationCommandOptionInput{subcommand("ping",
+			value(discordgo.ApplicationCommandOptionUser, "target", "123"),
+		)}, ""},
+		{"Subcommand group", `config set key=name "value=hello world"`, []*discordgo.ApplicationCommandOptionInput{{
+			Type:    discordgo.ApplicationCommandOptionSubCommandGroup,
+			Name:    "config",
+			Options: []*discordgo.ApplicationCommandOptionInput{subcommand("set", value(discordgo.ApplicationCommandOptionString, "key", "name"), value(discordgo.ApplicationCommandOptionString, "value", "hello world"))},
+		}}, ""},
+		{"Value containing equals sign", `config set key=a=b`, []*discordgo.ApplicationCommandOptionInput{{
+			Type:    discordgo.ApplicationCommandOptionSubCommandGroup,
+			Name:    "config",
+			Options: []*discordgo.ApplicationCommandOptionInput{subcommand("set", value(discordgo.ApplicationCommandOptionString, "key", "a=b"))},
+		}}, ""},
+		{"Unquoted spaces", `config set key=name value=hello world`, nil, "unparsed subcommands left over"},
+		{"Missing required", `config set`, nil, "missing required parameter key"},
+		{"Invalid integer", `ping count=many`, nil, "error parsing parameter count"},
+		{"Invalid boolean", `ping loud=maybe`, nil, "error parsing parameter loud"},
+		{"Unknown subcommand", `pong`, nil, "unparsed subcommands left over"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			args, err := shlex.Split(test.rawArgs)
+			require.NoError(t, err)
+			ctx := &commandArgContext{pills: make(map[string]string)}
+			res, err := ctx.executeCommand(cmd, args)
+			if test.err != "" {
+				assert.ErrorContains(t, err, test.err)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, test.expected, res)
+			}
+		})
+	}
+}
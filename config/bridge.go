@@ -56,6 +56,11 @@ type BridgeConfig struct {
 	PrefixWebhookMessages       bool `yaml:"prefix_webhook_messages"`
 	EnableWebhookAvatars        bool `yaml:"enable_webhook_avatars"`
 	UseDiscordCDNUpload         bool `yaml:"use_discord_cdn_upload"`
+	PresenceFromDiscord         bool `yaml:"presence_from_discord"`
+	PresenceToDiscord           bool `yaml:"presence_to_discord"`
+	VoiceStateNotices           bool `yaml:"voice_state_notices"`
+
+	EmojiUploadGuild string `yaml:"emoji_upload_guild"`
 
 	Proxy string `yaml:"proxy"`
 
@@ -81,6 +86,11 @@ type BridgeConfig struct {
 			Initial BackfillLimitPart `yaml:"initial"`
 			Missed  BackfillLimitPart `yaml:"missed"`
 		} `yaml:"forward_limits"`
+		Backward struct {
+			Enabled    bool `yaml:"enabled"`
+			BatchSize  int  `yaml:"batch_size"`
+			BatchDelay int  `yaml:"batch_delay"`
+		} `yaml:"backward"`
 		MaxGuildMembers int `yaml:"max_guild_members"`
 	} `yaml:"backfill"`
 
@@ -140,6 +150,10 @@ func (bc *BridgeConfig) Validate() error {
 	exampleLen := boolToInt(hasWildcard) + boolToInt(hasExampleUser) + boolToInt(hasExampleDomain)
 	if len(bc.Permissions) <= exampleLen {
 		return errors.New("bridge.permissions not configured")
+	} else if bc.Backfill.Backward.Enabled && bc.Backfill.Backward.BatchSize <= 0 {
+		return errors.New("bridge.backfill.backward.batch_size must be positive")
+	} else if bc.Backfill.Backward.BatchDelay < 0 {
+		return errors.New("bridge.backfill.backward.batch_delay can't be negative")
 	}
 	return nil
 }
@@ -228,6 +242,20 @@ func (bc BridgeConfig) FormatChannelName(params ChannelNameParams) string {
 	return buffer.String()
 }
 
+const channelNamePlaceholder = "\x00name\x00"
+
+// ParseChannelName reverses FormatChannelName by stripping the parts that the template adds around the name.
+// The name is returned as-is if it doesn't look like it was generated with the template.
+func (bc BridgeConfig) ParseChannelName(formatted string, params ChannelNameParams) string {
+	params.Name = channelNamePlaceholder
+	prefix, suffix, found := strings.Cut(bc.FormatChannelName(params), channelNamePlaceholder)
+	if !found || len(formatted) < len(prefix)+len(suffix) ||
+		!strings.HasPrefix(formatted, prefix) || !strings.HasSuffix(formatted, suffix) {
+		return formatted
+	}
+	return formatted[len(prefix) : len(formatted)-len(suffix)]
+}
+
 type GuildNameParams struct {
 	Name string
 }
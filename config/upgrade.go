@@ -63,6 +63,10 @@ func DoUpgrade(helper *up.Helper) {
 	helper.Copy(up.Bool, "bridge", "prefix_webhook_messages")
 	helper.Copy(up.Bool, "bridge", "enable_webhook_avatars")
 	helper.Copy(up.Bool, "bridge", "use_discord_cdn_upload")
+	helper.Copy(up.Bool, "bridge", "presence_from_discord")
+	helper.Copy(up.Bool, "bridge", "presence_to_discord")
+	helper.Copy(up.Bool, "bridge", "voice_state_notices")
+	helper.Copy(up.Str, "bridge", "emoji_upload_guild")
 	helper.Copy(up.Str|up.Null, "bridge", "proxy")
 	helper.Copy(up.Str, "bridge", "cache_media")
 	helper.Copy(up.Bool, "bridge", "direct_media", "enabled")
@@ -94,6 +98,9 @@ func DoUpgrade(helper *up.Helper) {
 	helper.Copy(up.Int, "bridge", "backfill", "forward_limits", "missed", "dm")
 	helper.Copy(up.Int, "bridge", "backfill", "forward_limits", "missed", "channel")
 	helper.Copy(up.Int, "bridge", "backfill", "forward_limits", "missed", "thread")
+	helper.Copy(up.Bool, "bridge", "backfill", "backward", "enabled")
+	helper.Copy(up.Int, "bridge", "backfill", "backward", "batch_size")
+	helper.Copy(up.Int, "bridge", "backfill", "backward", "batch_delay")
 	helper.Copy(up.Int, "bridge", "backfill", "max_guild_members")
 	helper.Copy(up.Bool, "bridge", "encryption", "allow")
 	helper.Copy(up.Bool, "bridge", "encryption", "default")
@@ -0,0 +1,99 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"go.mau.fi/util/dbutil"
+	log "maunium.net/go/maulogger/v2"
+)
+
+type BackfillQuery struct {
+	db  *Database
+	log log.Logger
+}
+
+// language=postgresql
+const (
+	backfillSelect = "SELECT dc_chan_id, dc_chan_receiver, dc_thread_id, before_id, completed, dispatched_at FROM backfill_queue"
+	backfillInsert = `
+		INSERT INTO backfill_queue (dc_chan_id, dc_chan_receiver, dc_thread_id, before_id, completed, dispatched_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (dc_chan_id, dc_chan_receiver, dc_thread_id) DO NOTHING
+	`
+	backfillUpdate = `
+		UPDATE backfill_queue SET before_id=$4, completed=$5, dispatched_at=$6
+		WHERE dc_chan_id=$1 AND dc_chan_receiver=$2 AND dc_thread_id=$3
+	`
+)
+
+func (bq *BackfillQuery) New() *Backfill {
+	return &Backfill{
+		db:  bq.db,
+		log: bq.log,
+	}
+}
+
+func (bq *BackfillQuery) Get(key PortalKey, threadID string) *Backfill {
+	query := backfillSelect + " WHERE dc_chan_id=$1 AND dc_chan_receiver=$2 AND dc_thread_id=$3"
+	return bq.New().Scan(bq.db.QueryRow(query, key.ChannelID, key.Receiver, threadID))
+}
+
+// GetNext returns the incomplete backfill task that was dispatched least recently.
+func (bq *BackfillQuery) GetNext() *Backfill {
+	query := backfillSelect + " WHERE completed=false ORDER BY dispatched_at ASC LIMIT 1"
+	return bq.New().Scan(bq.db.QueryRow(query))
+}
+
+type Backfill struct {
+	db  *Database
+	log log.Logger
+
+	Channel  PortalKey
+	ThreadID string
+	// BeforeID is the ID of the oldest Discord message that has been bridged so far.
+	BeforeID     string
+	Completed    bool
+	DispatchedAt time.Time
+}
+
+func (b *Backfill) Scan(row dbutil.Scannable) *Backfill {
+	var dispatchedAt int64
+	err := row.Scan(&b.Channel.ChannelID, &b.Channel.Receiver, &b.ThreadID, &b.BeforeID, &b.Completed, &dispatchedAt)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			b.log.Errorln("Database scan failed:", err)
+			panic(err)
+		}
+		return nil
+	}
+	if dispatchedAt != 0 {
+		b.DispatchedAt = time.UnixMilli(dispatchedAt)
+	}
+	return b
+}
+
+func (b *Backfill) dispatchedAtMilli() int64 {
+	if b.DispatchedAt.IsZero() {
+		return 0
+	}
+	return b.DispatchedAt.UnixMilli()
+}
+
+// Insert adds the backfill task to the queue, unless there's already a task for the same channel and thread.
+func (b *Backfill) Insert() {
+	_, err := b.db.Exec(backfillInsert, b.Channel.ChannelID, b.Channel.Receiver, b.ThreadID, b.BeforeID, b.Completed, b.dispatchedAtMilli())
+	if err != nil {
+		b.log.Warnfln("Failed to insert backfill task for %s/%s: %v", b.Channel, b.ThreadID, err)
+		panic(err)
+	}
+}
+
+func (b *Backfill) Update() {
+	_, err := b.db.Exec(backfillUpdate, b.Channel.ChannelID, b.Channel.Receiver, b.ThreadID, b.BeforeID, b.Completed, b.dispatchedAtMilli())
+	if err != nil {
+		b.log.Warnfln("Failed to update backfill task for %s/%s: %v", b.Channel, b.ThreadID, err)
+		panic(err)
+	}
+}
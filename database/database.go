@@ -14,15 +14,18 @@ import (
 type Database struct {
 	*dbutil.Database
 
-	User     *UserQuery
-	Portal   *PortalQuery
-	Puppet   *PuppetQuery
-	Message  *MessageQuery
-	Thread   *ThreadQuery
-	Reaction *ReactionQuery
-	Guild    *GuildQuery
-	Role     *RoleQuery
-	File     *FileQuery
+	User           *UserQuery
+	Portal         *PortalQuery
+	Puppet         *PuppetQuery
+	Message        *MessageQuery
+	Thread         *ThreadQuery
+	Reaction       *ReactionQuery
+	Guild          *GuildQuery
+	Role           *RoleQuery
+	File           *FileQuery
+	Backfill       *BackfillQuery
+	PollVote       *PollVoteQuery
+	ScheduledEvent *ScheduledEventQuery
 }
 
 func New(baseDB *dbutil.Database, log maulogger.Logger) *Database {
@@ -64,6 +67,18 @@ func New(baseDB *dbutil.Database, log maulogger.Logger) *Database {
 		db:  db,
 		log: log.Sub("File"),
 	}
+	db.Backfill = &BackfillQuery{
+		db:  db,
+		log: log.Sub("Backfill"),
+	}
+	db.PollVote = &PollVoteQuery{
+		db:  db,
+		log: log.Sub("PollVote"),
+	}
+	db.ScheduledEvent = &ScheduledEventQuery{
+		db:  db,
+		log: log.Sub("ScheduledEvent"),
+	}
 	return db
 }
 
@@ -43,6 +43,11 @@ func (fq *FileQuery) GetEmojiByMXC(mxc id.ContentURI) *File {
 	return fq.New().Scan(fq.db.QueryRow(query, mxc.String()))
 }
 
+func (fq *FileQuery) GetStickerByMXC(mxc id.ContentURI) *File {
+	query := fileSelect + " WHERE mxc=$1 AND url LIKE '%/stickers/%' AND id<>'' LIMIT 1"
+	return fq.New().Scan(fq.db.QueryRow(query, mxc.String()))
+}
+
 type File struct {
 	db  *Database
 	log log.Logger
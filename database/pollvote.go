@@ -0,0 +1,93 @@
+package database
+
+import (
+	log "maunium.net/go/maulogger/v2"
+)
+
+type PollVoteQuery struct {
+	db  *Database
+	log log.Logger
+}
+
+// language=postgresql
+const (
+	pollVoteInsert = `
+		INSERT INTO poll_vote (dc_chan_id, dc_chan_receiver, dc_msg_id, dc_user_id, answer_id)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (dc_chan_id, dc_chan_receiver, dc_msg_id, dc_user_id, answer_id) DO NOTHING
+	`
+	pollVoteDelete = `
+		DELETE FROM poll_vote
+		WHERE dc_chan_id=$1 AND dc_chan_receiver=$2 AND dc_msg_id=$3 AND dc_user_id=$4 AND answer_id=$5
+	`
+	pollVoteDeleteAllOfUser = `
+		DELETE FROM poll_vote WHERE dc_chan_id=$1 AND dc_chan_receiver=$2 AND dc_msg_id=$3 AND dc_user_id=$4
+	`
+)
+
+// GetAnswers returns the IDs of the answers the given user has voted for in a poll.
+func (pq *PollVoteQuery) GetAnswers(key PortalKey, messageID, userID string) []int {
+	query := "SELECT answer_id FROM poll_vote WHERE dc_chan_id=$1 AND dc_chan_receiver=$2 AND dc_msg_id=$3 AND dc_user_id=$4 ORDER BY answer_id"
+	rows, err := pq.db.Query(query, key.ChannelID, key.Receiver, messageID, userID)
+	if err != nil {
+		pq.log.Errorfln("Failed to query votes of %s in %s: %v", userID, messageID, err)
+		return nil
+	}
+	var answers []int
+	for rows.Next() {
+		var answerID int
+		err = rows.Scan(&answerID)
+		if err != nil {
+			pq.log.Errorln("Database scan failed:", err)
+			panic(err)
+		}
+		answers = append(answers, answerID)
+	}
+	return answers
+}
+
+// Add stores a vote and returns false if it was already stored.
+func (pq *PollVoteQuery) Add(key PortalKey, messageID, userID string, answerID int) bool {
+	res, err := pq.db.Exec(pollVoteInsert, key.ChannelID, key.Receiver, messageID, userID, answerID)
+	if err != nil {
+		pq.log.Warnfln("Failed to insert vote of %s in %s: %v", userID, messageID, err)
+		panic(err)
+	}
+	affected, _ := res.RowsAffected()
+	return affected > 0
+}
+
+// Remove deletes a vote and returns false if it wasn't stored.
+func (pq *PollVoteQuery) Remove(key PortalKey, messageID, userID string, answerID int) bool {
+	res, err := pq.db.Exec(pollVoteDelete, key.ChannelID, key.Receiver, messageID, userID, answerID)
+	if err != nil {
+		pq.log.Warnfln("Failed to delete vote of %s in %s: %v", userID, messageID, err)
+		panic(err)
+	}
+	affected, _ := res.RowsAffected()
+	return affected > 0
+}
+
+// Replace replaces all votes of the given user in a poll.
+func (pq *PollVoteQuery) Replace(key PortalKey, messageID, userID string, answerIDs []int) {
+	txn, err := pq.db.Begin()
+	if err != nil {
+		pq.log.Errorln("Failed to start transaction for replacing votes:", err)
+		panic(err)
+	}
+	_, err = txn.Exec(pollVoteDeleteAllOfUser, key.ChannelID, key.Receiver, messageID, userID)
+	for _, answerID := range answerIDs {
+		if err != nil {
+			break
+		}
+		_, err = txn.Exec(pollVoteInsert, key.ChannelID, key.Receiver, messageID, userID, answerID)
+	}
+	if err == nil {
+		err = txn.Commit()
+	}
+	if err != nil {
+		pq.log.Warnfln("Failed to replace votes of %s in %s: %v", userID, messageID, err)
+		_ = txn.Rollback()
+		panic(err)
+	}
+}
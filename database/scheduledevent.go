@@ -0,0 +1,81 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	"go.mau.fi/util/dbutil"
+	log "maunium.net/go/maulogger/v2"
+	"maunium.net/go/mautrix/id"
+)
+
+type ScheduledEventQuery struct {
+	db  *Database
+	log log.Logger
+}
+
+const (
+	scheduledEventSelect = "SELECT dcid, dc_guild_id, mx_room_id, mxid, content FROM scheduled_event"
+)
+
+func (sq *ScheduledEventQuery) New() *ScheduledEvent {
+	return &ScheduledEvent{
+		db:  sq.db,
+		log: sq.log,
+	}
+}
+
+func (sq *ScheduledEventQuery) GetByDiscordID(discordID string) *ScheduledEvent {
+	query := scheduledEventSelect + " WHERE dcid=$1"
+	return sq.New().Scan(sq.db.QueryRow(query, discordID))
+}
+
+type ScheduledEvent struct {
+	db  *Database
+	log log.Logger
+
+	DiscordID string
+	GuildID   string
+	RoomID    id.RoomID
+	MXID      id.EventID
+	// Content is the last rendered notice, used to skip edits when nothing visible changed.
+	Content string
+}
+
+func (se *ScheduledEvent) Scan(row dbutil.Scannable) *ScheduledEvent {
+	err := row.Scan(&se.DiscordID, &se.GuildID, &se.RoomID, &se.MXID, &se.Content)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			se.log.Errorln("Database scan failed:", err)
+			panic(err)
+		}
+		return nil
+	}
+	return se
+}
+
+func (se *ScheduledEvent) Insert() {
+	query := "INSERT INTO scheduled_event (dcid, dc_guild_id, mx_room_id, mxid, content) VALUES ($1, $2, $3, $4, $5)"
+	_, err := se.db.Exec(query, se.DiscordID, se.GuildID, se.RoomID, se.MXID, se.Content)
+	if err != nil {
+		se.log.Warnfln("Failed to insert scheduled event %s: %v", se.DiscordID, err)
+		panic(err)
+	}
+}
+
+func (se *ScheduledEvent) Update() {
+	query := "UPDATE scheduled_event SET mx_room_id=$1, mxid=$2, content=$3 WHERE dcid=$4"
+	_, err := se.db.Exec(query, se.RoomID, se.MXID, se.Content, se.DiscordID)
+	if err != nil {
+		se.log.Warnfln("Failed to update scheduled event %s: %v", se.DiscordID, err)
+		panic(err)
+	}
+}
+
+func (se *ScheduledEvent) Delete() {
+	_, err := se.db.Exec("DELETE FROM scheduled_event WHERE dcid=$1", se.DiscordID)
+	if err != nil {
+		se.log.Warnfln("Failed to delete scheduled event %s: %v", se.DiscordID, err)
+		panic(err)
+	}
+}
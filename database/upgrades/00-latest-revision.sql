@@ -1,4 +1,4 @@
--- v0 -> v23 (compatible with v19+): Latest revision
+-- v0 -> v27 (compatible with v19+): Latest revision
 
 CREATE TABLE guild (
     dcid       TEXT PRIMARY KEY,
@@ -10,7 +10,9 @@ CREATE TABLE guild (
     avatar_url TEXT NOT NULL,
     avatar_set BOOLEAN NOT NULL,
 
-    bridging_mode INTEGER NOT NULL
+    bridging_mode  INTEGER NOT NULL,
+    events_channel TEXT NOT NULL DEFAULT '',
+    thread_rooms   BOOLEAN NOT NULL DEFAULT false
 );
 
 CREATE TABLE portal (
@@ -177,3 +179,36 @@ CREATE TABLE discord_file (
 );
 
 CREATE INDEX discord_file_mxc_idx ON discord_file (mxc);
+
+CREATE TABLE backfill_queue (
+    dc_chan_id       TEXT,
+    dc_chan_receiver TEXT,
+    dc_thread_id     TEXT NOT NULL DEFAULT '',
+    before_id        TEXT NOT NULL,
+    completed        BOOLEAN NOT NULL DEFAULT false,
+    dispatched_at    BIGINT NOT NULL DEFAULT 0,
+
+    PRIMARY KEY (dc_chan_id, dc_chan_receiver, dc_thread_id),
+    CONSTRAINT backfill_queue_portal_fkey FOREIGN KEY (dc_chan_id, dc_chan_receiver) REFERENCES portal (dcid, receiver) ON DELETE CASCADE
+);
+
+CREATE TABLE poll_vote (
+    dc_chan_id       TEXT,
+    dc_chan_receiver TEXT,
+    dc_msg_id        TEXT,
+    dc_user_id       TEXT,
+    answer_id        INTEGER,
+
+    PRIMARY KEY (dc_chan_id, dc_chan_receiver, dc_msg_id, dc_user_id, answer_id),
+    CONSTRAINT poll_vote_portal_fkey FOREIGN KEY (dc_chan_id, dc_chan_receiver) REFERENCES portal (dcid, receiver) ON DELETE CASCADE
+);
+
+CREATE TABLE scheduled_event (
+    dcid        TEXT PRIMARY KEY,
+    dc_guild_id TEXT NOT NULL,
+    mx_room_id  TEXT NOT NULL,
+    mxid        TEXT NOT NULL,
+    content     TEXT NOT NULL,
+
+    CONSTRAINT scheduled_event_guild_fkey FOREIGN KEY (dc_guild_id) REFERENCES guild (dcid) ON DELETE CASCADE
+);
@@ -0,0 +1,12 @@
+-- v24 (compatible with v19+): Add queue for backwards backfill
+CREATE TABLE backfill_queue (
+    dc_chan_id       TEXT,
+    dc_chan_receiver TEXT,
+    dc_thread_id     TEXT NOT NULL DEFAULT '',
+    before_id        TEXT NOT NULL,
+    completed        BOOLEAN NOT NULL DEFAULT false,
+    dispatched_at    BIGINT NOT NULL DEFAULT 0,
+
+    PRIMARY KEY (dc_chan_id, dc_chan_receiver, dc_thread_id),
+    CONSTRAINT backfill_queue_portal_fkey FOREIGN KEY (dc_chan_id, dc_chan_receiver) REFERENCES portal (dcid, receiver) ON DELETE CASCADE
+);
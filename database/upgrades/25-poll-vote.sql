@@ -0,0 +1,11 @@
+-- v25 (compatible with v19+): Store Discord poll votes
+CREATE TABLE poll_vote (
+    dc_chan_id       TEXT,
+    dc_chan_receiver TEXT,
+    dc_msg_id        TEXT,
+    dc_user_id       TEXT,
+    answer_id        INTEGER,
+
+    PRIMARY KEY (dc_chan_id, dc_chan_receiver, dc_msg_id, dc_user_id, answer_id),
+    CONSTRAINT poll_vote_portal_fkey FOREIGN KEY (dc_chan_id, dc_chan_receiver) REFERENCES portal (dcid, receiver) ON DELETE CASCADE
+);
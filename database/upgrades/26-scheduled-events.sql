@@ -0,0 +1,12 @@
+-- v26 (compatible with v19+): Store bridged guild scheduled events
+ALTER TABLE guild ADD COLUMN events_channel TEXT NOT NULL DEFAULT '';
+
+CREATE TABLE scheduled_event (
+    dcid        TEXT PRIMARY KEY,
+    dc_guild_id TEXT NOT NULL,
+    mx_room_id  TEXT NOT NULL,
+    mxid        TEXT NOT NULL,
+    content     TEXT NOT NULL,
+
+    CONSTRAINT scheduled_event_guild_fkey FOREIGN KEY (dc_guild_id) REFERENCES guild (dcid) ON DELETE CASCADE
+);
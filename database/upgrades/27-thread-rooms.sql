@@ -0,0 +1,2 @@
+-- v27 (compatible with v19+): Add option to bridge threads as separate rooms
+ALTER TABLE guild ADD COLUMN thread_rooms BOOLEAN NOT NULL DEFAULT false;
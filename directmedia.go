@@ -404,6 +404,21 @@ func (dma *DirectMediaAPI) GetEmojiInfo(contentURI id.ContentURI) *EmojiMediaDat
 
 }
 
+func (dma *DirectMediaAPI) GetStickerInfo(contentURI id.ContentURI) *StickerMediaData {
+	if dma == nil || contentURI.IsEmpty() || contentURI.Homeserver != dma.cfg.ServerName {
+		return nil
+	}
+	mediaID, err := ParseMediaID(contentURI.FileID, dma.signatureKey)
+	if err != nil {
+		return nil
+	}
+	stickerData, ok := mediaID.Data.(*StickerMediaData)
+	if !ok {
+		return nil
+	}
+	return stickerData
+}
+
 func (dma *DirectMediaAPI) getMediaURL(ctx context.Context, encodedMediaID string) (url string, expiry time.Time, err error) {
 	var mediaID *MediaID
 	mediaID, err = ParseMediaID(encodedMediaID, dma.signatureKey)
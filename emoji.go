@@ -0,0 +1,245 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gabriel-vasile/mimetype"
+	"maunium.net/go/mautrix/id"
+)
+
+// Discord rejects emoji images larger than 256 KiB.
+const maxDiscordEmojiSize = 256 * 1024
+
+var errEmojiTooLarge = errors.New("emoji image is too large for Discord")
+
+var imgTagRegex = regexp.MustCompile(`(?i)<img\s(?:[^>"']|"[^"]*"|'[^']*')*>`)
+var htmlAttributeRegex = regexp.MustCompile(`([a-zA-Z_:][-a-zA-Z0-9_:.]*)(?:\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'=<>` + "`" + `]+)))?`)
+var invalidEmojiNameChars = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+func formatDiscordEmoji(emojiID string, animated bool) string {
+	if animated {
+		return fmt.Sprintf("<a:%s>", emojiID)
+	}
+	return fmt.Sprintf("<:%s>", emojiID)
+}
+
+func sanitizeEmojiName(name string) string {
+	name = invalidEmojiNameChars.ReplaceAllString(strings.Trim(name, ":"), "_")
+	if len(name) < 2 {
+		name = "emoji_" + name
+	}
+	if len(name) > 32 {
+		name = name[:32]
+	}
+	return name
+}
+
+// getDiscordEmojiByMXC finds the Discord emoji for a Matrix custom emoji, uploading it to the
+// configured emoji guild if it didn't come from Discord. The returned ID is in the name:id format.
+func (portal *Portal) getDiscordEmojiByMXC(sender *User, mxc id.ContentURI, name string) (emojiID string, animated bool, err error) {
+	if emojiInfo := portal.bridge.DMA.GetEmojiInfo(mxc); emojiInfo != nil {
+		discordID := strconv.FormatUint(emojiInfo.EmojiID, 10)
+		if !sender.canUseEmoji(portal.GuildID, sender.findEmojiGuild(discordID), emojiInfo.Animated) {
+			return "", false, fmt.Errorf("%w %s", errEmojiNotUsable, mxc)
+		}
+		return fmt.Sprintf("%s:%s", emojiInfo.Name, discordID), emojiInfo.Animated, nil
+	} else if emojiFile := portal.bridge.DB.File.GetEmojiByMXC(mxc); emojiFile != nil && emojiFile.ID != "" && emojiFile.EmojiName != "" {
+		animated = emojiFile.MimeType == "image/gif"
+		if !sender.canUseEmoji(portal.GuildID, sender.findEmojiGuild(emojiFile.ID), animated) {
+			return "", false, fmt.Errorf("%w %s", errEmojiNotUsable, mxc)
+		}
+		return fmt.Sprintf("%s:%s", emojiFile.EmojiName, emojiFile.ID), animated, nil
+	}
+	uploadGuild := portal.bridge.Config.Bridge.EmojiUploadGuild
+	if uploadGuild == "" || sender == nil || sender.Session == nil {
+		return "", false, fmt.Errorf("%w %s", errUnknownEmoji, mxc)
+	} else if !sender.canUseEmoji(portal.GuildID, uploadGuild, false) {
+		// Don't bother uploading if the sender couldn't use the uploaded emoji here anyway.
+		return "", false, fmt.Errorf("%w %s", errEmojiNotUsable, mxc)
+	}
+	emojiID, animated, err = portal.bridge.uploadMatrixEmoji(sender, mxc, name)
+	if err == nil && !sender.canUseEmoji(portal.GuildID, uploadGuild, animated) {
+		return "", false, fmt.Errorf("%w %s", errEmojiNotUsable, mxc)
+	}
+	return
+}
+
+// findEmojiGuild returns the ID of the guild that the given custom emoji belongs to,
+// or an empty string if the emoji isn't in any of the guilds the user is in.
+func (user *User) findEmojiGuild(emojiID string) string {
+	if user == nil || user.Session == nil {
+		return ""
+	}
+	user.Session.State.RLock()
+	defer user.Session.State.RUnlock()
+	for _, guild := range user.Session.State.Guilds {
+		for _, emoji := range guild.Emojis {
+			if emoji.ID == emojiID {
+				if !emoji.Available {
+					return ""
+				}
+				return guild.ID
+			}
+		}
+	}
+	return ""
+}
+
+// canUseEmoji checks whether the user can send a custom emoji from emojiGuildID in a channel of portalGuildID.
+// Emojis can only be used outside their own guild (or animated at all) with Nitro. Messages without a user
+// session are sent through webhooks, which aren't restricted, so they're always allowed.
+func (user *User) canUseEmoji(portalGuildID, emojiGuildID string, animated bool) bool {
+	if user == nil || user.Session == nil {
+		return true
+	} else if emojiGuildID == "" {
+		return false
+	} else if emojiGuildID == portalGuildID && !animated {
+		return true
+	}
+	self := user.Session.State.User
+	return self != nil && self.PremiumType != discordgo.UserPremiumTypeNone
+}
+
+// getDiscordStickerByMXC returns the ID of the Discord sticker that was bridged to the given Matrix URI, if any.
+func (portal *Portal) getDiscordStickerByMXC(mxc id.ContentURI) string {
+	if stickerInfo := portal.bridge.DMA.GetStickerInfo(mxc); stickerInfo != nil {
+		return strconv.FormatUint(stickerInfo.StickerID, 10)
+	} else if stickerFile := portal.bridge.DB.File.GetStickerByMXC(mxc); stickerFile != nil {
+		return stickerFile.ID
+	}
+	return ""
+}
+
+func (br *DiscordBridge) uploadMatrixEmoji(sender *User, mxc id.ContentURI, name string) (string, bool, error) {
+	br.emojiUploadLock.Lock()
+	defer br.emojiUploadLock.Unlock()
+	// Another message may have uploaded the same emoji while we were waiting for the lock.
+	if emojiFile := br.DB.File.GetEmojiByMXC(mxc); emojiFile != nil && emojiFile.ID != "" {
+		return fmt.Sprintf("%s:%s", emojiFile.EmojiName, emojiFile.ID), emojiFile.MimeType == "image/gif", nil
+	}
+	data, err := br.Bot.DownloadBytes(mxc)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to download emoji: %w", err)
+	} else if len(data) > maxDiscordEmojiSize {
+		return "", false, errEmojiTooLarge
+	}
+	mime := mimetype.Detect(data).String()
+	emoji, err := sender.Session.GuildEmojiCreate(br.Config.Bridge.EmojiUploadGuild, &discordgo.EmojiParams{
+		Name:  sanitizeEmojiName(name),
+		Image: fmt.Sprintf("data:%s;base64,%s", mime, base64.StdEncoding.EncodeToString(data)),
+	})
+	if err != nil {
+		return "", false, fmt.Errorf("failed to upload emoji: %w", err)
+	}
+	br.ZLog.Debug().
+		Str("mxc", mxc.String()).
+		Str("emoji_id", emoji.ID).
+		Str("guild_id", br.Config.Bridge.EmojiUploadGuild).
+		Msg("Uploaded Matrix emoji to Discord")
+
+	dbFile := br.DB.File.New()
+	if emoji.Animated {
+		dbFile.URL = discordgo.EndpointEmojiAnimated(emoji.ID)
+	} else {
+		dbFile.URL = discordgo.EndpointEmoji(emoji.ID)
+	}
+	dbFile.MXC = mxc
+	dbFile.ID = emoji.ID
+	dbFile.EmojiName = emoji.Name
+	dbFile.Size = len(data)
+	dbFile.MimeType = mime
+	dbFile.Timestamp = time.Now()
+	dbFile.Insert(nil)
+	return fmt.Sprintf("%s:%s", emoji.Name, emoji.ID), emoji.Animated, nil
+}
+
+func (portal *Portal) convertMatrixEmoticon(sender *User, mxc id.ContentURI, name string) string {
+	emojiID, animated, err := portal.getDiscordEmojiByMXC(sender, mxc, name)
+	if err == nil {
+		return formatDiscordEmoji(emojiID, animated)
+	}
+	portal.log.Debug().Err(err).Str("mxc", mxc.String()).Msg("Couldn't find Discord emoji for Matrix emoticon")
+	if proxyURL := portal.bridge.makeMediaProxyURL(mxc); proxyURL != "" {
+		return fmt.Sprintf("[%s](%s)", escapeDiscordMarkdown(name), proxyURL)
+	}
+	return escapeDiscordMarkdown(name)
+}
+
+// parseHTMLAttributes parses the attributes of a single HTML start tag. Values may be double-quoted,
+// single-quoted or unquoted, and attributes without a value are included with an empty value.
+func parseHTMLAttributes(tag string) map[string]string {
+	tag = strings.TrimSuffix(strings.TrimPrefix(tag, "<"), ">")
+	// Skip the tag name
+	if nameEnd := strings.IndexFunc(tag, unicode.IsSpace); nameEnd >= 0 {
+		tag = tag[nameEnd:]
+	} else {
+		tag = ""
+	}
+	attrs := make(map[string]string)
+	for _, match := range htmlAttributeRegex.FindAllStringSubmatch(tag, -1) {
+		name := strings.ToLower(match[1])
+		if _, alreadySet := attrs[name]; !alreadySet {
+			attrs[name] = html.UnescapeString(match[2] + match[3] + match[4])
+		}
+	}
+	return attrs
+}
+
+// replaceMatrixEmoticons replaces custom emoji images in Matrix HTML with placeholders,
+// because the HTML parser drops images. The returned replacer turns the placeholders
+// into Discord emojis after the rest of the HTML has been converted.
+func (portal *Portal) replaceMatrixEmoticons(sender *User, formattedBody string) (string, *strings.Replacer) {
+	return replaceEmoticonTags(formattedBody, func(mxc id.ContentURI, name string) string {
+		return portal.convertMatrixEmoticon(sender, mxc, name)
+	})
+}
+
+func replaceEmoticonTags(formattedBody string, convert func(mxc id.ContentURI, name string) string) (string, *strings.Replacer) {
+	var replacements []string
+	formattedBody = imgTagRegex.ReplaceAllStringFunc(formattedBody, func(tag string) string {
+		attrs := parseHTMLAttributes(tag)
+		if _, isEmoticon := attrs["data-mx-emoticon"]; !isEmoticon {
+			return tag
+		}
+		name := attrs["alt"]
+		if name == "" {
+			name = attrs["title"]
+		}
+		mxc, err := id.ParseContentURI(attrs["src"])
+		if err != nil {
+			return html.EscapeString(name)
+		}
+		placeholder := fmt.Sprintf("\uE000%d\uE001", len(replacements)/2)
+		replacements = append(replacements, placeholder, convert(mxc, name))
+		return placeholder
+	})
+	if len(replacements) == 0 {
+		return formattedBody, nil
+	}
+	return formattedBody, strings.NewReplacer(replacements...)
+}
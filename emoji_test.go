@@ -0,0 +1,86 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestParseHTMLAttributes(t *testing.T) {
+	type attributeTest struct {
+		name     string
+		input    string
+		expected map[string]string
+	}
+
+	tests := []attributeTest{
+		{"Double quoted", `<img src="mxc://example.com/abc" alt=":cat:">`, map[string]string{"src": "mxc://example.com/abc", "alt": ":cat:"}},
+		{"Single quoted", `<img src='mxc://example.com/abc' alt=':cat:'>`, map[string]string{"src": "mxc://example.com/abc", "alt": ":cat:"}},
+		{"Unquoted", `<img src=mxc://example.com/abc alt=:cat:>`, map[string]string{"src": "mxc://example.com/abc", "alt": ":cat:"}},
+		{"No value", `<img data-mx-emoticon src="mxc://example.com/abc">`, map[string]string{"data-mx-emoticon": "", "src": "mxc://example.com/abc"}},
+		{"Spaces around equals", `<img alt = "cat">`, map[string]string{"alt": "cat"}},
+		{"Quotes inside other quotes", `<img alt="it's" title='say "hi"'>`, map[string]string{"alt": "it's", "title": `say "hi"`}},
+		{"Entities", `<img alt="&lt;3 &amp; more">`, map[string]string{"alt": "<3 & more"}},
+		{"Uppercase name", `<IMG ALT="cat">`, map[string]string{"alt": "cat"}},
+		{"Duplicate attribute", `<img alt="first" alt="second">`, map[string]string{"alt": "first"}},
+		{"Self-closing", `<img alt="cat" />`, map[string]string{"alt": "cat"}},
+		{"No attributes", `<img>`, map[string]string{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, parseHTMLAttributes(test.input))
+		})
+	}
+}
+
+func TestReplaceEmoticonTags(t *testing.T) {
+	type emoticonTest struct {
+		name     string
+		input    string
+		expected string
+	}
+
+	convert := func(mxc id.ContentURI, name string) string {
+		return "[" + name + "|" + mxc.String() + "]"
+	}
+	tests := []emoticonTest{
+		{"Double quoted", `hi <img data-mx-emoticon src="mxc://example.com/abc" alt=":cat:"> there`, "hi [:cat:|mxc://example.com/abc] there"},
+		{"Single quoted", `<img data-mx-emoticon src='mxc://example.com/abc' alt=':cat:'>`, "[:cat:|mxc://example.com/abc]"},
+		{"Unquoted", `<img data-mx-emoticon src=mxc://example.com/abc alt=:cat:>`, "[:cat:|mxc://example.com/abc]"},
+		{"Emoticon attribute with value", `<img alt=":cat:" data-mx-emoticon="" src="mxc://example.com/abc">`, "[:cat:|mxc://example.com/abc]"},
+		{"Title fallback", `<img data-mx-emoticon src="mxc://example.com/abc" title=":cat:">`, "[:cat:|mxc://example.com/abc]"},
+		{"Greater than in attribute", `<img data-mx-emoticon alt="->" src="mxc://example.com/abc">`, "[->|mxc://example.com/abc]"},
+		{"Multiple", `<img data-mx-emoticon src="mxc://example.com/a" alt="a"><img data-mx-emoticon src='mxc://example.com/b' alt=b>`, "[a|mxc://example.com/a][b|mxc://example.com/b]"},
+		{"Invalid source", `<img data-mx-emoticon src="https://example.com/cat.png" alt="<cat>">`, "&lt;cat&gt;"},
+		{"Not an emoticon", `<img src="mxc://example.com/abc" alt="data-mx-emoticon">`, `<img src="mxc://example.com/abc" alt="data-mx-emoticon">`},
+		{"No images", `<b>hello</b>`, `<b>hello</b>`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output, replacer := replaceEmoticonTags(test.input, convert)
+			if replacer != nil {
+				output = replacer.Replace(output)
+			}
+			assert.Equal(t, test.expected, output)
+		})
+	}
+}
@@ -0,0 +1,256 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/bwmarrin/discordgo"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// StateImagePack is the room image pack state event from MSC2545.
+var StateImagePack = event.Type{Type: "im.ponies.room_emotes", Class: event.StateEventType}
+
+type ImagePackUsage string
+
+const (
+	ImagePackUsageEmoticon ImagePackUsage = "emoticon"
+	ImagePackUsageSticker  ImagePackUsage = "sticker"
+)
+
+const (
+	imagePackTypeEmoji   = "emoji"
+	imagePackTypeSticker = "sticker"
+)
+
+type ImagePackImage struct {
+	URL   id.ContentURIString `json:"url"`
+	Body  string              `json:"body,omitempty"`
+	Info  *event.FileInfo     `json:"info,omitempty"`
+	Usage []ImagePackUsage    `json:"usage,omitempty"`
+
+	DiscordID   string `json:"fi.mau.discord.id,omitempty"`
+	DiscordType string `json:"fi.mau.discord.type,omitempty"`
+}
+
+type ImagePackMeta struct {
+	DisplayName string              `json:"display_name,omitempty"`
+	AvatarURL   id.ContentURIString `json:"avatar_url,omitempty"`
+	Usage       []ImagePackUsage    `json:"usage,omitempty"`
+}
+
+type ImagePackEventContent struct {
+	Images map[string]*ImagePackImage `json:"images"`
+	Pack   ImagePackMeta              `json:"pack"`
+}
+
+func (content *ImagePackEventContent) addImage(name string, image *ImagePackImage) {
+	shortcode := strings.Map(func(r rune) rune {
+		if r == ':' || unicode.IsSpace(r) {
+			return '_'
+		}
+		return r
+	}, name)
+	if shortcode == "" {
+		shortcode = image.DiscordID
+	}
+	uniqueShortcode := shortcode
+	for i := 2; content.Images[uniqueShortcode] != nil; i++ {
+		uniqueShortcode = fmt.Sprintf("%s~%d", shortcode, i)
+	}
+	content.Images[uniqueShortcode] = image
+}
+
+func hashEmojis(emojis []*discordgo.Emoji) string {
+	if emojis == nil {
+		return ""
+	}
+	parts := make([]string, len(emojis))
+	for i, emoji := range emojis {
+		parts[i] = fmt.Sprintf("%s:%s:%t:%t", emoji.ID, emoji.Name, emoji.Animated, emoji.Available)
+	}
+	return hashImagePackParts(parts)
+}
+
+func hashStickers(stickers []*discordgo.Sticker) string {
+	if stickers == nil {
+		return ""
+	}
+	parts := make([]string, len(stickers))
+	for i, sticker := range stickers {
+		parts[i] = fmt.Sprintf("%s:%s:%s:%d:%t", sticker.ID, sticker.Name, sticker.Description, sticker.FormatType, sticker.Available)
+	}
+	return hashImagePackParts(parts)
+}
+
+func hashImagePackParts(parts []string) string {
+	sort.Strings(parts)
+	hash := sha256.Sum256([]byte(strings.Join(parts, "\n")))
+	return hex.EncodeToString(hash[:])
+}
+
+// QueueEmotePackUpdate schedules an UpdateEmotePack call in the background. Updates for the same guild are
+// applied one at a time in order, and updates queued while another one is running are merged into one.
+func (guild *Guild) QueueEmotePackUpdate(emojis []*discordgo.Emoji, stickers []*discordgo.Sticker) {
+	guild.emotePackQueueLock.Lock()
+	defer guild.emotePackQueueLock.Unlock()
+	if emojis != nil {
+		guild.pendingEmojis = emojis
+	}
+	if stickers != nil {
+		guild.pendingStickers = stickers
+	}
+	if !guild.emotePackUpdating {
+		guild.emotePackUpdating = true
+		go guild.runEmotePackUpdates()
+	}
+}
+
+func (guild *Guild) runEmotePackUpdates() {
+	for {
+		guild.emotePackQueueLock.Lock()
+		emojis, stickers := guild.pendingEmojis, guild.pendingStickers
+		guild.pendingEmojis, guild.pendingStickers = nil, nil
+		if emojis == nil && stickers == nil {
+			guild.emotePackUpdating = false
+			guild.emotePackQueueLock.Unlock()
+			return
+		}
+		guild.emotePackQueueLock.Unlock()
+		guild.UpdateEmotePack(emojis, stickers)
+	}
+}
+
+// UpdateEmotePack syncs the custom emojis and stickers of the guild into an image pack in the guild space.
+// A nil list means the update didn't include that kind of image, so the existing entries are kept.
+// Lists that are identical to the last ones synced are skipped.
+func (guild *Guild) UpdateEmotePack(emojis []*discordgo.Emoji, stickers []*discordgo.Sticker) {
+	if guild.MXID == "" {
+		return
+	}
+	guild.emotePackLock.Lock()
+	defer guild.emotePackLock.Unlock()
+
+	emojiHash, stickerHash := hashEmojis(emojis), hashStickers(stickers)
+	if emojiHash == guild.emotePackEmojiHash {
+		emojis = nil
+	}
+	if stickerHash == guild.emotePackStickerHash {
+		stickers = nil
+	}
+	if emojis == nil && stickers == nil {
+		return
+	}
+
+	var existing ImagePackEventContent
+	err := guild.bridge.Bot.StateEvent(guild.MXID, StateImagePack, "", &existing)
+	if err != nil && !errors.Is(err, mautrix.MNotFound) {
+		guild.log.Warnln("Failed to get existing image pack:", err)
+	}
+	content := &ImagePackEventContent{
+		Images: make(map[string]*ImagePackImage),
+		Pack: ImagePackMeta{
+			DisplayName: guild.PlainName,
+			AvatarURL:   guild.AvatarURL.CUString(),
+			Usage:       []ImagePackUsage{ImagePackUsageEmoticon, ImagePackUsageSticker},
+		},
+	}
+	for shortcode, image := range existing.Images {
+		if (image.DiscordType == imagePackTypeEmoji && emojis == nil) || (image.DiscordType == imagePackTypeSticker && stickers == nil) {
+			content.Images[shortcode] = image
+		}
+	}
+	copyFailed := false
+	for _, emoji := range emojis {
+		if emoji.ID == "" || !emoji.Available {
+			continue
+		}
+		mxc, err := guild.bridge.getEmojiMXC(guild.bridge.Bot, emoji.ID, emoji.Name, emoji.Animated)
+		if err != nil {
+			guild.log.Warnfln("Failed to copy emoji %s to Matrix for image pack: %v", emoji.ID, err)
+			copyFailed = true
+			continue
+		}
+		content.addImage(emoji.Name, &ImagePackImage{
+			URL:         mxc.CUString(),
+			Body:        emoji.Name,
+			Info:        &event.FileInfo{MimeType: emojiMimeType(emoji.Animated)},
+			Usage:       []ImagePackUsage{ImagePackUsageEmoticon},
+			DiscordID:   emoji.ID,
+			DiscordType: imagePackTypeEmoji,
+		})
+	}
+	for _, sticker := range stickers {
+		if !sticker.Available {
+			continue
+		}
+		mxc, err := guild.bridge.getStickerMXC(guild.bridge.Bot, sticker)
+		if err != nil {
+			guild.log.Warnfln("Failed to copy sticker %s to Matrix for image pack: %v", sticker.ID, err)
+			copyFailed = true
+			continue
+		}
+		body := sticker.Description
+		if body == "" {
+			body = sticker.Name
+		}
+		content.addImage(sticker.Name, &ImagePackImage{
+			URL:  mxc.CUString(),
+			Body: body,
+			Info: &event.FileInfo{
+				MimeType: stickerMimeType(sticker.FormatType),
+				Width:    DiscordStickerSize,
+				Height:   DiscordStickerSize,
+			},
+			Usage:       []ImagePackUsage{ImagePackUsageSticker},
+			DiscordID:   sticker.ID,
+			DiscordType: imagePackTypeSticker,
+		})
+	}
+
+	existingJSON, _ := json.Marshal(&existing)
+	newJSON, _ := json.Marshal(content)
+	if !bytes.Equal(existingJSON, newJSON) {
+		_, err = guild.bridge.Bot.SendStateEvent(guild.MXID, StateImagePack, "", content)
+		if err != nil {
+			guild.log.Warnln("Failed to update image pack:", err)
+			return
+		}
+		guild.log.Debugfln("Updated image pack with %d images", len(content.Images))
+	}
+	if copyFailed {
+		// Don't remember the lists so that the failed images are retried on the next update
+		return
+	}
+	if emojis != nil {
+		guild.emotePackEmojiHash = emojiHash
+	}
+	if stickers != nil {
+		guild.emotePackStickerHash = stickerHash
+	}
+}
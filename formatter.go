@@ -226,7 +226,7 @@ var matrixHTMLParser = &format.HTMLParser{
 	},
 }
 
-func (portal *Portal) parseMatrixHTML(content *event.MessageEventContent) (string, *discordgo.MessageAllowedMentions) {
+func (portal *Portal) parseMatrixHTML(sender *User, content *event.MessageEventContent) (string, *discordgo.MessageAllowedMentions) {
 	allowedMentions := &discordgo.MessageAllowedMentions{
 		Parse:       []discordgo.AllowedMentionType{},
 		Users:       []string{},
@@ -239,7 +239,12 @@ func (portal *Portal) parseMatrixHTML(content *event.MessageEventContent) (strin
 		if content.Mentions != nil {
 			ctx.ReturnData[formatterContextInputAllowedMentionsKey] = content.Mentions.UserIDs
 		}
-		return variationselector.FullyQualify(matrixHTMLParser.Parse(content.FormattedBody, ctx)), allowedMentions
+		formattedBody, emoticons := portal.replaceMatrixEmoticons(sender, content.FormattedBody)
+		parsed := variationselector.FullyQualify(matrixHTMLParser.Parse(formattedBody, ctx))
+		if emoticons != nil {
+			parsed = emoticons.Replace(parsed)
+		}
+		return parsed, allowedMentions
 	} else {
 		return variationselector.FullyQualify(escapeDiscordMarkdown(content.Body)), allowedMentions
 	}
@@ -0,0 +1,255 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+
+	"go.mau.fi/mautrix-discord/database"
+)
+
+// Forum and media channels are bridged as normal rooms where each post is a Matrix thread.
+// The starter message of a post (which has the same ID as the post) is the thread root,
+// and it's prefixed with the title and tags of the post.
+
+const maxForumPostTitleLength = 100
+
+var forumPostTagRegex = regexp.MustCompile(`^\s*\[([^\]]+)]`)
+
+func (portal *Portal) IsForum() bool {
+	return portal.Type == discordgo.ChannelTypeGuildForum || portal.Type == discordgo.ChannelTypeGuildMedia
+}
+
+func (portal *Portal) isForumPostStarter(msg *discordgo.Message) bool {
+	return portal.IsForum() && msg.ChannelID != portal.Key.ChannelID && msg.ID == msg.ChannelID
+}
+
+// getDiscordChannel returns channel metadata from the session state, or fetches it if it's not cached.
+func (user *User) getDiscordChannel(channelID string) (*discordgo.Channel, error) {
+	if channel, err := user.Session.State.Channel(channelID); err == nil {
+		return channel, nil
+	}
+	channel, err := user.Session.Channel(channelID)
+	if err != nil {
+		return nil, err
+	}
+	_ = user.Session.State.ChannelAdd(channel)
+	return channel, nil
+}
+
+func (portal *Portal) renderForumPostHeader(user *User, post *discordgo.Channel) string {
+	header := fmt.Sprintf("<h3>%s</h3>", html.EscapeString(post.Name))
+	if len(post.AppliedTags) == 0 {
+		return header
+	}
+	forum, err := user.getDiscordChannel(portal.Key.ChannelID)
+	if err != nil {
+		portal.log.Warn().Err(err).Msg("Failed to get forum channel info to render post tags")
+		return header
+	}
+	tags := make([]string, 0, len(post.AppliedTags))
+	for _, tagID := range post.AppliedTags {
+		for _, tag := range forum.AvailableTags {
+			if tag.ID != tagID {
+				continue
+			}
+			tagName := html.EscapeString(tag.Name)
+			if tag.EmojiName != "" && tag.EmojiID == "" {
+				tagName = tag.EmojiName + " " + tagName
+			}
+			tags = append(tags, "<code>"+tagName+"</code>")
+		}
+	}
+	if len(tags) > 0 {
+		header += fmt.Sprintf("<p>Tags: %s</p>", strings.Join(tags, " "))
+	}
+	return header
+}
+
+// addForumPostHeader prepends the post title and tags to the text part of a post starter message,
+// or adds a separate text part if the starter message doesn't have text.
+func (portal *Portal) addForumPostHeader(ctx context.Context, user *User, postID string, parts []*ConvertedMessage) []*ConvertedMessage {
+	post, err := user.getDiscordChannel(postID)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to get forum post info")
+		return parts
+	}
+	header := portal.renderForumPostHeader(user, post)
+	if len(parts) > 0 && parts[0].AttachmentID == "" && parts[0].Type == event.EventMessage && parts[0].Content.MsgType == event.MsgText {
+		parts[0].Content.EnsureHasHTML()
+		converted := format.HTMLToContent(header + parts[0].Content.FormattedBody)
+		parts[0].Content.Body = converted.Body
+		parts[0].Content.Format = converted.Format
+		parts[0].Content.FormattedBody = converted.FormattedBody
+		return parts
+	}
+	converted := format.HTMLToContent(header)
+	converted.MsgType = event.MsgText
+	return append([]*ConvertedMessage{{Type: event.EventMessage, Content: &converted}}, parts...)
+}
+
+// handleDiscordForumPostUpdate re-renders the root event of a forum post after its title or tags were changed.
+func (portal *Portal) handleDiscordForumPostUpdate(user *User, post *discordgo.Channel) {
+	log := portal.log.With().
+		Str("action", "discord forum post update").
+		Str("thread_id", post.ID).
+		Logger()
+	ctx := log.WithContext(context.Background())
+	if !portal.IsForum() || portal.MXID == "" {
+		return
+	}
+	var textPart *database.Message
+	for _, part := range portal.bridge.DB.Message.GetByDiscordID(portal.Key, post.ID) {
+		if part.AttachmentID == "" {
+			textPart = part
+			break
+		}
+	}
+	if textPart == nil {
+		log.Debug().Msg("Dropping update of forum post without a bridged starter message")
+		return
+	}
+	intent := portal.bridge.GetPuppetByID(textPart.SenderID).IntentFor(portal)
+	var parts []*ConvertedMessage
+	starter, ok := portal.recentMessages.Get(post.ID)
+	if !ok {
+		var err error
+		starter, err = user.Session.ChannelMessage(post.ID, post.ID, portal.RefererOpt(post.ID))
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to fetch forum post starter message, rendering title only")
+		}
+	}
+	if starter != nil {
+		if converted := portal.convertDiscordTextMessage(ctx, intent, starter); converted != nil {
+			parts = append(parts, converted)
+		}
+	}
+	converted := portal.addForumPostHeader(ctx, user, post.ID, parts)[0]
+	converted.Content.SetEdit(textPart.MXID)
+	converted.Content.Mentions = &event.Mentions{}
+	if converted.Extra != nil {
+		converted.Extra = map[string]any{
+			"m.new_content": converted.Extra,
+		}
+	}
+	resp, err := portal.sendMatrixMessage(intent, event.EventMessage, converted.Content, converted.Extra, 0)
+	if err != nil {
+		log.Err(err).Msg("Failed to send forum post header edit to Matrix")
+		return
+	}
+	log.Debug().Str("event_id", resp.EventID.String()).Msg("Updated forum post header")
+}
+
+// forumPostFound registers the post as a thread whose root is the bridged starter message.
+func (portal *Portal) forumPostFound(ctx context.Context, root *database.Message, postID string) {
+	thread := portal.bridge.GetThreadByID(postID, root)
+	// Posts are already visible in the forum, so there's no need for a thread creation notice
+	thread.initialBackfillAttempted = true
+	zerolog.Ctx(ctx).Debug().Str("thread_id", thread.ID).Msg("Marked message as forum post starter")
+}
+
+// ensureForumPost bridges the starter message of a forum post that hasn't been bridged yet,
+// so that other messages in the post can be sent into the Matrix thread.
+func (portal *Portal) ensureForumPost(ctx context.Context, user *User, postID string) *Thread {
+	log := zerolog.Ctx(ctx)
+	starter, err := user.Session.ChannelMessage(postID, postID, portal.RefererOpt(postID))
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to fetch forum post starter message, bridging title only")
+		post, err := user.getDiscordChannel(postID)
+		if err != nil {
+			log.Err(err).Msg("Failed to get forum post info")
+			return nil
+		}
+		starter = &discordgo.Message{
+			ID:        postID,
+			ChannelID: postID,
+			GuildID:   portal.GuildID,
+			Type:      discordgo.MessageTypeDefault,
+			Author:    &discordgo.User{ID: post.OwnerID},
+		}
+	}
+	portal.handleDiscordMessageCreate(user, starter, nil)
+	return portal.bridge.GetThreadByID(postID, nil)
+}
+
+// parseForumPostTitle uses the first line of the message as the post title.
+// Tags can be applied by prefixing the title with the tag names in square brackets, e.g. "[question] Title".
+func parseForumPostTitle(body string, availableTags []discordgo.ForumTag) (title string, tags []string) {
+	title, _, _ = strings.Cut(strings.TrimSpace(body), "\n")
+	for {
+		match := forumPostTagRegex.FindStringSubmatch(title)
+		if match == nil {
+			break
+		}
+		var tagID string
+		for _, tag := range availableTags {
+			if strings.EqualFold(tag.Name, strings.TrimSpace(match[1])) {
+				tagID = tag.ID
+				break
+			}
+		}
+		if tagID == "" {
+			break
+		}
+		tags = append(tags, tagID)
+		title = title[len(match[0]):]
+	}
+	title = strings.TrimSpace(title)
+	if title == "" {
+		title = "Untitled post"
+	} else if len([]rune(title)) > maxForumPostTitleLength {
+		title = string([]rune(title)[:maxForumPostTitleLength])
+	}
+	return
+}
+
+// createForumPost creates a new post in the forum with the given message as the starter message.
+func (portal *Portal) createForumPost(sender *User, content *event.MessageEventContent, sendReq *discordgo.MessageSend) (*discordgo.Message, error) {
+	forum, err := sender.getDiscordChannel(portal.Key.ChannelID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get forum channel info: %w", err)
+	}
+	title, tags := parseForumPostTitle(content.Body, forum.AvailableTags)
+	post, err := sender.Session.ForumThreadStartComplex(portal.Key.ChannelID, &discordgo.ThreadStart{
+		Name:        title,
+		AppliedTags: tags,
+	}, sendReq, portal.RefererOpt(""))
+	if err != nil {
+		return nil, err
+	}
+	portal.log.Debug().
+		Str("thread_id", post.ID).
+		Str("title", title).
+		Strs("tags", tags).
+		Msg("Created forum post from Matrix")
+	// The starter message of a forum post has the same ID as the post itself
+	return &discordgo.Message{
+		ID:        post.ID,
+		ChannelID: post.ID,
+		GuildID:   portal.GuildID,
+		Author:    &discordgo.User{ID: sender.DiscordID},
+	}, nil
+}
@@ -0,0 +1,63 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseForumPostTitle(t *testing.T) {
+	type titleTest struct {
+		name          string
+		body          string
+		expectedTitle string
+		expectedTags  []string
+	}
+
+	availableTags := []discordgo.ForumTag{
+		{ID: "1", Name: "question"},
+		{ID: "2", Name: "Bug Report"},
+	}
+	tests := []titleTest{
+		{"Plain title", "Hello world", "Hello world", nil},
+		{"First line only", "Title\nBody text\nMore body", "Title", nil},
+		{"Surrounding whitespace", "  \n Title  \nBody", "Title", nil},
+		{"Single tag", "[question] How do I do this?", "How do I do this?", []string{"1"}},
+		{"Multiple tags", "[question][bug report] Crash on start", "Crash on start", []string{"1", "2"}},
+		{"Tag with spaces", "[ Bug Report ] Crash", "Crash", []string{"2"}},
+		{"Case insensitive tag", "[QUESTION] Title", "Title", []string{"1"}},
+		{"Unknown tag", "[idea] New feature", "[idea] New feature", nil},
+		{"Unknown tag stops parsing", "[question][idea][bug report] Title", "[idea][bug report] Title", []string{"1"}},
+		{"Brackets later in title", "Title with [brackets]", "Title with [brackets]", nil},
+		{"Only tags", "[question]", "Untitled post", []string{"1"}},
+		{"Empty body", "", "Untitled post", nil},
+		{"Truncated", strings.Repeat("a", 150), strings.Repeat("a", maxForumPostTitleLength), nil},
+		{"Truncated by characters", strings.Repeat("ä", 150), strings.Repeat("ä", maxForumPostTitleLength), nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			title, tags := parseForumPostTitle(test.body, availableTags)
+			assert.Equal(t, test.expectedTitle, title)
+			assert.Equal(t, test.expectedTags, tags)
+		})
+	}
+}
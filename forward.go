@@ -0,0 +1,298 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/bridge/commands"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-discord/database"
+)
+
+const messageReferenceTypeForward = 1
+
+// discordgo doesn't know about message reference types or snapshots yet, so forwards are parsed from the raw payloads.
+type forwardMessageReference struct {
+	Type      int    `json:"type"`
+	MessageID string `json:"message_id"`
+	ChannelID string `json:"channel_id,omitempty"`
+	GuildID   string `json:"guild_id,omitempty"`
+}
+
+type messageSnapshot struct {
+	Message *discordgo.Message `json:"message"`
+}
+
+type messageWithSnapshots struct {
+	ID               string                   `json:"id"`
+	MessageReference *forwardMessageReference `json:"message_reference"`
+	MessageSnapshots []messageSnapshot        `json:"message_snapshots"`
+}
+
+const forwardHeaderTemplateHTML = `<p>Forwarded from %s</p>`
+
+// isPossibleForward checks if the message could be a forward. Forwards are normal messages that
+// have a message reference but no content of their own.
+func isPossibleForward(msg *discordgo.Message) bool {
+	return msg.Type == discordgo.MessageTypeDefault &&
+		msg.MessageReference != nil &&
+		msg.Content == "" &&
+		len(msg.Attachments) == 0 &&
+		len(msg.StickerItems) == 0 &&
+		len(msg.Embeds) == 0 &&
+		msg.Poll == nil
+}
+
+// forwardSnapshotCacheSize is the number of forwarded message snapshots to remember. Snapshots are only
+// needed until the message is converted, which happens right after the payload containing them is received.
+const forwardSnapshotCacheSize = 1024
+
+// forwardSnapshotCache stores the snapshots of forwarded messages parsed from raw Discord payloads,
+// because discordgo's Message struct doesn't have the message_snapshots field.
+type forwardSnapshotCache struct {
+	lock      sync.Mutex
+	snapshots map[string]*discordgo.Message
+	order     []string
+}
+
+func (fsc *forwardSnapshotCache) add(messageID string, snapshot *discordgo.Message) {
+	fsc.lock.Lock()
+	defer fsc.lock.Unlock()
+	if fsc.snapshots == nil {
+		fsc.snapshots = make(map[string]*discordgo.Message)
+	}
+	if _, alreadyCached := fsc.snapshots[messageID]; !alreadyCached {
+		fsc.order = append(fsc.order, messageID)
+		if len(fsc.order) > forwardSnapshotCacheSize {
+			delete(fsc.snapshots, fsc.order[0])
+			fsc.order = fsc.order[1:]
+		}
+	}
+	fsc.snapshots[messageID] = snapshot
+}
+
+func (fsc *forwardSnapshotCache) get(messageID string) *discordgo.Message {
+	fsc.lock.Lock()
+	defer fsc.lock.Unlock()
+	return fsc.snapshots[messageID]
+}
+
+// cacheForwardSnapshots parses the forwarded message snapshots from a raw message payload (or a JSON array of them).
+func (br *DiscordBridge) cacheForwardSnapshots(log zerolog.Logger, rawData []byte, isArray bool) {
+	var messages []*messageWithSnapshots
+	var err error
+	if isArray {
+		err = json.Unmarshal(rawData, &messages)
+	} else {
+		var msg messageWithSnapshots
+		err = json.Unmarshal(rawData, &msg)
+		messages = []*messageWithSnapshots{&msg}
+	}
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to parse forwarded message snapshots")
+		return
+	}
+	for _, msg := range messages {
+		if msg.MessageReference != nil && msg.MessageReference.Type == messageReferenceTypeForward && len(msg.MessageSnapshots) > 0 && msg.MessageSnapshots[0].Message != nil {
+			br.forwardSnapshots.add(msg.ID, msg.MessageSnapshots[0].Message)
+		}
+	}
+}
+
+// getForwardSnapshot returns the snapshot of the forwarded message, or nil if the message isn't a forward.
+func (portal *Portal) getForwardSnapshot(msg *discordgo.Message) *discordgo.Message {
+	if !isPossibleForward(msg) {
+		return nil
+	}
+	return portal.bridge.forwardSnapshots.get(msg.ID)
+}
+
+func (portal *Portal) renderForwardHeader(source *User, ref *discordgo.MessageReference) string {
+	guildID := ref.GuildID
+	receiver := ""
+	if guildID == "" {
+		guildID = "@me"
+		if source != nil {
+			receiver = source.DiscordID
+		}
+	}
+	link := fmt.Sprintf("https://discord.com/channels/%s/%s/%s", guildID, ref.ChannelID, ref.MessageID)
+	origin := fmt.Sprintf(`<a href="%s">a message</a>`, link)
+	originPortal := portal.bridge.GetExistingPortalByID(database.NewPortalKey(ref.ChannelID, receiver))
+	if originPortal != nil && originPortal.Name != "" {
+		origin = fmt.Sprintf(`<a href="%s">%s</a>`, link, html.EscapeString(originPortal.Name))
+	}
+	if originPortal != nil {
+		originalMsg := portal.bridge.DB.Message.GetFirstByDiscordID(originPortal.Key, ref.MessageID)
+		if originalMsg != nil && originalMsg.SenderID != "" {
+			author := portal.bridge.GetPuppetByID(originalMsg.SenderID)
+			if author.Name != "" {
+				origin = fmt.Sprintf(`%s by <a href="https://matrix.to/#/%s">%s</a>`, origin, author.MXID, html.EscapeString(author.Name))
+			}
+		}
+	}
+	return fmt.Sprintf(forwardHeaderTemplateHTML, origin)
+}
+
+// convertDiscordForward converts a forwarded message into a quote of the original message,
+// followed by the attachments and stickers of the original message.
+func (portal *Portal) convertDiscordForward(ctx context.Context, source *User, puppet *Puppet, intent *appservice.IntentAPI, msg, snapshot *discordgo.Message) []*ConvertedMessage {
+	inner := *snapshot
+	inner.ID = msg.ID
+	inner.ChannelID = msg.ChannelID
+	inner.GuildID = msg.GuildID
+	inner.Author = msg.Author
+	inner.Member = msg.Member
+	inner.Type = discordgo.MessageTypeDefault
+	inner.MessageReference = nil
+	inner.Interaction = nil
+
+	parts := make([]*ConvertedMessage, 0, 1+len(inner.Attachments)+len(inner.StickerItems))
+	var quotedHTML string
+	textPart := portal.convertDiscordTextMessage(ctx, intent, &inner)
+	if textPart != nil {
+		textPart.Content.EnsureHasHTML()
+		quotedHTML = textPart.Content.FormattedBody
+	} else {
+		textPart = &ConvertedMessage{Type: event.EventMessage, Content: &event.MessageEventContent{MsgType: event.MsgText}}
+	}
+	converted := format.HTMLToContent(fmt.Sprintf("<blockquote>%s%s</blockquote>", portal.renderForwardHeader(source, msg.MessageReference), quotedHTML))
+	textPart.Content.Body = converted.Body
+	textPart.Content.Format = converted.Format
+	textPart.Content.FormattedBody = converted.FormattedBody
+	if textPart.Content.MsgType == "" {
+		textPart.Content.MsgType = event.MsgText
+	}
+	parts = append(parts, textPart)
+
+	log := zerolog.Ctx(ctx)
+	for _, att := range inner.Attachments {
+		log := log.With().Str("attachment_id", att.ID).Logger()
+		// The attachment URL can't be refreshed through the forward, so don't use direct media
+		if part := portal.convertDiscordAttachment(log.WithContext(ctx), intent, "", att); part != nil {
+			parts = append(parts, part)
+		}
+	}
+	for _, sticker := range inner.StickerItems {
+		log := log.With().Str("sticker_id", sticker.ID).Logger()
+		if part := portal.convertDiscordSticker(log.WithContext(ctx), intent, sticker); part != nil {
+			parts = append(parts, part)
+		}
+	}
+	for _, part := range parts {
+		puppet.addWebhookMeta(part, msg)
+		puppet.addMemberMeta(part, msg)
+	}
+	return parts
+}
+
+type reqForwardMessage struct {
+	MessageReference forwardMessageReference `json:"message_reference"`
+	Nonce            string                  `json:"nonce,omitempty"`
+}
+
+// ForwardMessage forwards a bridged Discord message into another portal as a Discord forward.
+func (user *User) ForwardMessage(sourcePortal *Portal, msg *database.Message, targetPortal *Portal) error {
+	if user.Session == nil {
+		return ErrNotLoggedIn
+	}
+	req := &reqForwardMessage{
+		MessageReference: forwardMessageReference{
+			Type:      messageReferenceTypeForward,
+			MessageID: msg.DiscordID,
+			ChannelID: msg.DiscordProtoChannelID(),
+			GuildID:   sourcePortal.GuildID,
+		},
+		Nonce: generateNonce(),
+	}
+	endpoint := discordgo.EndpointChannelMessages(targetPortal.Key.ChannelID)
+	_, err := user.Session.RequestWithBucketID(http.MethodPost, endpoint, req, endpoint, targetPortal.RefererOpt(""))
+	return err
+}
+
+var cmdForward = &commands.FullHandler{
+	Func: wrapCommand(fnForward),
+	Name: "forward",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionGeneral,
+		Description: "Forward the replied-to message into another Discord portal",
+		Args:        "<_room ID or alias_>",
+	},
+	RequiresLogin:  true,
+	RequiresPortal: true,
+}
+
+func fnForward(ce *WrappedCommandEvent) {
+	if len(ce.Args) != 1 || ce.ReplyTo == "" {
+		ce.Reply("**Usage**: reply to a message with `$cmdprefix forward <room ID or alias>`")
+		return
+	}
+	msg := ce.Bridge.DB.Message.GetByMXID(ce.Portal.Key, ce.ReplyTo)
+	if msg == nil {
+		ce.Reply("That message is not bridged to Discord")
+		return
+	}
+	roomID, err := resolveRoomArg(ce, ce.Args[0])
+	if err != nil {
+		ce.Reply("Failed to resolve room: %v", err)
+		return
+	}
+	targetPortal := ce.Bridge.GetPortalByMXID(roomID)
+	if targetPortal == nil {
+		ce.Reply("That room is not a Discord portal")
+		return
+	} else if targetPortal.IsPrivateChat() && targetPortal.Key.Receiver != ce.User.DiscordID {
+		ce.Reply("That room is not your Discord DM")
+		return
+	}
+	err = ce.User.ForwardMessage(ce.Portal, msg, targetPortal)
+	if err != nil {
+		ce.Reply("Failed to forward message: %v", err)
+	} else {
+		ce.React("✅")
+	}
+}
+
+func resolveRoomArg(ce *WrappedCommandEvent, arg string) (roomID id.RoomID, err error) {
+	if strings.HasPrefix(arg, "#") {
+		var resp *mautrix.RespAliasResolve
+		resp, err = ce.Bot.ResolveAlias(id.RoomAlias(arg))
+		if err != nil {
+			return
+		}
+		roomID = resp.RoomID
+	} else if strings.HasPrefix(arg, "!") {
+		roomID = id.RoomID(arg)
+	} else {
+		err = fmt.Errorf("%q is not a room ID or alias", arg)
+	}
+	return
+}
@@ -40,7 +40,17 @@ type Guild struct {
 	bridge *DiscordBridge
 	log    log.Logger
 
-	roomCreateLock sync.Mutex
+	roomCreateLock     sync.Mutex
+	scheduledEventLock sync.Mutex
+
+	emotePackLock        sync.Mutex
+	emotePackEmojiHash   string
+	emotePackStickerHash string
+
+	emotePackQueueLock sync.Mutex
+	emotePackUpdating  bool
+	pendingEmojis      []*discordgo.Emoji
+	pendingStickers    []*discordgo.Sticker
 }
 
 func (br *DiscordBridge) loadGuild(dbGuild *database.Guild, id string, createIfNotExist bool) *Guild {
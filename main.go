@@ -26,6 +26,7 @@ import (
 	"golang.org/x/sync/semaphore"
 	"maunium.net/go/mautrix/bridge"
 	"maunium.net/go/mautrix/bridge/commands"
+	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 
 	"go.mau.fi/mautrix-discord/config"
@@ -52,6 +53,8 @@ type DiscordBridge struct {
 	DMA          *DirectMediaAPI
 	provisioning *ProvisioningAPI
 
+	stopBackwardBackfill chan struct{}
+
 	usersByMXID map[id.UserID]*User
 	usersByID   map[string]*User
 	usersLock   sync.Mutex
@@ -78,6 +81,8 @@ type DiscordBridge struct {
 
 	attachmentTransfers         *exsync.Map[attachmentKey, *exsync.ReturnableOnce[*database.File]]
 	parallelAttachmentSemaphore *semaphore.Weighted
+	emojiUploadLock             sync.Mutex
+	forwardSnapshots            forwardSnapshotCache
 }
 
 func (br *DiscordBridge) GetExampleConfig() string {
@@ -97,6 +102,9 @@ func (br *DiscordBridge) Init() {
 	br.RegisterCommands()
 
 	matrixHTMLParser.PillConverter = br.pillConverter
+	br.EventProcessor.On(event.EphemeralEventPresence, br.HandlePresence)
+	br.registerPollHandlers()
+	br.EventProcessor.On(event.StatePinnedEvents, br.HandleMatrixPins)
 
 	br.DB = database.New(br.Bridge.DB, br.Log.Sub("Database"))
 	discordLog = br.ZLog.With().Str("component", "discordgo").Logger()
@@ -112,9 +120,16 @@ func (br *DiscordBridge) Start() {
 	br.DMA = newDirectMediaAPI(br)
 	br.WaitWebsocketConnected()
 	go br.startUsers()
+	if br.Config.Bridge.Backfill.Backward.Enabled {
+		br.stopBackwardBackfill = make(chan struct{})
+		go br.runBackwardBackfillQueue(br.stopBackwardBackfill)
+	}
 }
 
 func (br *DiscordBridge) Stop() {
+	if br.stopBackwardBackfill != nil {
+		close(br.stopBackwardBackfill)
+	}
 	for _, user := range br.usersByMXID {
 		if user.Session == nil {
 			continue
@@ -154,10 +169,6 @@ func (br *DiscordBridge) GetIGhost(mxid id.UserID) bridge.Ghost {
 	return p
 }
 
-func (br *DiscordBridge) CreatePrivatePortal(id id.RoomID, user bridge.User, ghost bridge.Ghost) {
-	//TODO implement
-}
-
 func main() {
 	br := &DiscordBridge{
 		usersByMXID: make(map[id.UserID]*User),
@@ -0,0 +1,406 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+	"maunium.net/go/mautrix/bridge/commands"
+)
+
+// Password login is a multi-step flow: the initial login request may be answered with a CAPTCHA challenge,
+// which the user has to solve and submit, and then an MFA challenge, which is answered with a TOTP, SMS or backup code.
+// The flow is stored in the user's command state, so it can be continued with plain messages in the management room
+// or with further requests to the provisioning API.
+
+var (
+	ErrPasswordLoginCaptcha     = errors.New("captcha required")
+	ErrPasswordLoginMFA         = errors.New("multi-factor authentication required")
+	ErrPasswordLoginNoMFAMethod = errors.New("unsupported multi-factor authentication method")
+	ErrPasswordLoginInvalidCode = errors.New("invalid multi-factor authentication code")
+)
+
+// discordErrInvalidMFACode is the JSON error code Discord uses when a submitted MFA code is wrong.
+// Other MFA errors, like an expired ticket, mean that the login has to be restarted.
+const discordErrInvalidMFACode = 60008
+
+const passwordLoginAction = "Password login"
+
+type PasswordLoginCaptcha struct {
+	Service   string `json:"captcha_service"`
+	SiteKey   string `json:"captcha_sitekey"`
+	SessionID string `json:"captcha_session_id,omitempty"`
+	RQData    string `json:"captcha_rqdata,omitempty"`
+	RQToken   string `json:"captcha_rqtoken,omitempty"`
+}
+
+type PasswordLoginMFA struct {
+	Ticket string `json:"-"`
+	TOTP   bool   `json:"totp"`
+	SMS    bool   `json:"sms"`
+	Backup bool   `json:"backup"`
+}
+
+// PasswordLogin is the state of a password login in progress. It must be locked while running a step,
+// as the same login can be continued through both commands and the provisioning API.
+type PasswordLogin struct {
+	sync.Mutex
+
+	sess     *discordgo.Session
+	login    string
+	password string
+
+	Captcha *PasswordLoginCaptcha
+	MFA     *PasswordLoginMFA
+}
+
+type passwordLoginPayload struct {
+	Login         string  `json:"login"`
+	Password      string  `json:"password"`
+	Undelete      bool    `json:"undelete"`
+	LoginSource   *string `json:"login_source"`
+	GiftCodeSKUID *string `json:"gift_code_sku_id"`
+}
+
+type passwordLoginMFAPayload struct {
+	Code          string  `json:"code"`
+	Ticket        string  `json:"ticket"`
+	LoginSource   *string `json:"login_source"`
+	GiftCodeSKUID *string `json:"gift_code_sku_id"`
+}
+
+type passwordLoginResponse struct {
+	UserID string `json:"user_id"`
+	Token  string `json:"token"`
+	MFA    bool   `json:"mfa"`
+	Ticket string `json:"ticket"`
+	TOTP   bool   `json:"totp"`
+	SMS    bool   `json:"sms"`
+	Backup bool   `json:"backup"`
+}
+
+type passwordLoginErrorResponse struct {
+	CaptchaKey []string `json:"captcha_key"`
+	PasswordLoginCaptcha
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Errors  map[string]struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"_errors"`
+	} `json:"errors"`
+}
+
+func NewPasswordLogin(login, password string) (*PasswordLogin, error) {
+	sess, err := discordgo.New("")
+	if err != nil {
+		return nil, err
+	}
+	// Use the same client headers as normal user account connections
+	sess.IsUser = true
+	_ = sess.LoadMainPage(context.TODO())
+	return &PasswordLogin{
+		sess:     sess,
+		login:    login,
+		password: password,
+	}, nil
+}
+
+// Submit sends the login request, optionally with the solution to the current CAPTCHA challenge.
+func (pl *PasswordLogin) Submit(captchaKey string) (string, error) {
+	var opts []discordgo.RequestOption
+	if captchaKey != "" && pl.Captcha != nil {
+		opts = append(opts, discordgo.WithHeader("X-Captcha-Key", captchaKey))
+		if pl.Captcha.RQToken != "" {
+			opts = append(opts, discordgo.WithHeader("X-Captcha-Rqtoken", pl.Captcha.RQToken))
+		}
+		if pl.Captcha.SessionID != "" {
+			opts = append(opts, discordgo.WithHeader("X-Captcha-Session-Id", pl.Captcha.SessionID))
+		}
+	}
+	return pl.request(discordgo.EndpointLogin, &passwordLoginPayload{
+		Login:    pl.login,
+		Password: pl.password,
+	}, opts...)
+}
+
+// SendSMS asks Discord to send an MFA code by SMS and returns the redacted phone number it was sent to.
+func (pl *PasswordLogin) SendSMS() (string, error) {
+	if pl.MFA == nil || !pl.MFA.SMS {
+		return "", ErrPasswordLoginNoMFAMethod
+	}
+	resp, err := pl.sess.RequestWithBucketID(http.MethodPost, discordgo.EndpointAuth+"mfa/sms/send", map[string]string{
+		"ticket": pl.MFA.Ticket,
+	}, discordgo.EndpointAuth+"mfa/sms/send")
+	if err != nil {
+		return "", err
+	}
+	var data struct {
+		Phone string `json:"phone"`
+	}
+	err = json.Unmarshal(resp, &data)
+	return data.Phone, err
+}
+
+// SubmitMFA answers the current MFA challenge. The method must be totp, sms or backup.
+func (pl *PasswordLogin) SubmitMFA(method, code string) (string, error) {
+	if pl.MFA == nil {
+		return "", ErrPasswordLoginNoMFAMethod
+	}
+	switch method {
+	case "totp":
+		if !pl.MFA.TOTP {
+			return "", ErrPasswordLoginNoMFAMethod
+		}
+	case "sms":
+		if !pl.MFA.SMS {
+			return "", ErrPasswordLoginNoMFAMethod
+		}
+	case "backup":
+		if !pl.MFA.Backup {
+			return "", ErrPasswordLoginNoMFAMethod
+		}
+	default:
+		return "", ErrPasswordLoginNoMFAMethod
+	}
+	return pl.request(discordgo.EndpointAuth+"mfa/"+method, &passwordLoginMFAPayload{
+		Code:   strings.ReplaceAll(code, " ", ""),
+		Ticket: pl.MFA.Ticket,
+	})
+}
+
+// DefaultMFAMethod returns the method that codes are assumed to be for when the user doesn't specify one.
+func (pl *PasswordLogin) DefaultMFAMethod() string {
+	switch {
+	case pl.MFA == nil:
+		return ""
+	case pl.MFA.TOTP:
+		return "totp"
+	case pl.MFA.SMS:
+		return "sms"
+	case pl.MFA.Backup:
+		return "backup"
+	default:
+		return ""
+	}
+}
+
+func (pl *PasswordLogin) request(endpoint string, data interface{}, opts ...discordgo.RequestOption) (string, error) {
+	resp, err := pl.sess.RequestWithBucketID(http.MethodPost, endpoint, data, endpoint, opts...)
+	if err != nil {
+		var restErr *discordgo.RESTError
+		if !errors.As(err, &restErr) || restErr.Response.StatusCode != http.StatusBadRequest {
+			return "", err
+		}
+		var errData passwordLoginErrorResponse
+		if json.Unmarshal(restErr.ResponseBody, &errData) != nil {
+			return "", err
+		} else if len(errData.CaptchaKey) > 0 && errData.SiteKey != "" {
+			pl.Captcha = &errData.PasswordLoginCaptcha
+			return "", ErrPasswordLoginCaptcha
+		} else if pl.MFA != nil && (errData.Code == discordErrInvalidMFACode || len(errData.Errors["code"].Errors) > 0) {
+			msg := errData.Message
+			if codeErrors := errData.Errors["code"].Errors; len(codeErrors) > 0 {
+				msg = codeErrors[0].Message
+			}
+			if msg == "" {
+				return "", ErrPasswordLoginInvalidCode
+			}
+			return "", fmt.Errorf("%w: %s", ErrPasswordLoginInvalidCode, msg)
+		}
+		for _, field := range errData.Errors {
+			if len(field.Errors) > 0 {
+				return "", errors.New(field.Errors[0].Message)
+			}
+		}
+		if errData.Message != "" {
+			return "", errors.New(errData.Message)
+		}
+		return "", err
+	}
+	pl.Captcha = nil
+	var step passwordLoginResponse
+	err = json.Unmarshal(resp, &step)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse login response: %w", err)
+	} else if step.Token != "" {
+		pl.MFA = nil
+		return step.Token, nil
+	} else if step.MFA {
+		pl.MFA = &PasswordLoginMFA{
+			Ticket: step.Ticket,
+			TOTP:   step.TOTP,
+			SMS:    step.SMS,
+			Backup: step.Backup,
+		}
+		return "", ErrPasswordLoginMFA
+	}
+	return "", errors.New("login response didn't contain a token")
+}
+
+// GetPasswordLogin returns the password login in progress for the user, if any.
+func (user *User) GetPasswordLogin() *PasswordLogin {
+	state := user.GetCommandState()
+	if state == nil || state.Action != passwordLoginAction {
+		return nil
+	}
+	pl, _ := state.Meta.(*PasswordLogin)
+	return pl
+}
+
+// lockPasswordLogin locks and returns the password login in progress for the user, if any.
+func (user *User) lockPasswordLogin() *PasswordLogin {
+	pl := user.GetPasswordLogin()
+	if pl == nil {
+		return nil
+	}
+	pl.Lock()
+	if user.GetPasswordLogin() != pl {
+		// The login was finished or cancelled while waiting for the lock
+		pl.Unlock()
+		return nil
+	}
+	return pl
+}
+
+func (user *User) setPasswordLogin(pl *PasswordLogin) {
+	if pl == nil {
+		user.SetCommandState(nil)
+		return
+	}
+	user.SetCommandState(&commands.CommandState{
+		Next:   commands.MinimalHandlerFunc(wrapCommand(fnPasswordLoginContinue)),
+		Action: passwordLoginAction,
+		Meta:   pl,
+	})
+}
+
+var cmdLoginPassword = &commands.FullHandler{
+	Func: wrapCommand(fnLoginPassword),
+	Name: "login-password",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionAuth,
+		Description: "Link the bridge to your Discord account by logging in with your email or phone number and password.",
+		Args:        "<_email or phone_> <_password_>",
+	},
+}
+
+func fnLoginPassword(ce *WrappedCommandEvent) {
+	if len(ce.Args) < 2 {
+		ce.Reply("**Usage**: `$cmdprefix login-password <email or phone> <password>`")
+		return
+	}
+	ce.MarkRead()
+	defer ce.Redact()
+	if ce.User.IsLoggedIn() {
+		ce.Reply("You're already logged in")
+		return
+	}
+	password := strings.TrimSpace(strings.TrimPrefix(ce.RawArgs, ce.Args[0]))
+	pl, err := NewPasswordLogin(ce.Args[0], password)
+	if err != nil {
+		ce.Reply("Failed to prepare login: %v", err)
+		return
+	}
+	token, err := pl.Submit("")
+	handlePasswordLoginStep(ce, pl, token, err)
+}
+
+func fnPasswordLoginContinue(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 {
+		ce.Reply("Please send the requested code, or use `$cmdprefix cancel` to cancel the login.")
+		return
+	}
+	pl := ce.User.lockPasswordLogin()
+	if pl == nil {
+		ce.Reply("No password login in progress")
+		return
+	}
+	defer pl.Unlock()
+	ce.MarkRead()
+	var token string
+	var err error
+	if pl.Captcha != nil {
+		defer ce.Redact()
+		token, err = pl.Submit(ce.Args[0])
+	} else if pl.MFA != nil {
+		method := pl.DefaultMFAMethod()
+		code := ce.Args[0]
+		if len(ce.Args) == 1 && strings.ToLower(ce.Args[0]) == "sms" {
+			var phone string
+			phone, err = pl.SendSMS()
+			if err != nil {
+				ce.Reply("Failed to send SMS code: %v", err)
+			} else {
+				ce.Reply("Sent a code to %s. Send it here with `sms <code>`", phone)
+			}
+			return
+		} else if len(ce.Args) > 1 {
+			method = strings.ToLower(ce.Args[0])
+			code = strings.Join(ce.Args[1:], "")
+		}
+		defer ce.Redact()
+		token, err = pl.SubmitMFA(method, code)
+	}
+	handlePasswordLoginStep(ce, pl, token, err)
+}
+
+func handlePasswordLoginStep(ce *WrappedCommandEvent, pl *PasswordLogin, token string, err error) {
+	switch {
+	case errors.Is(err, ErrPasswordLoginCaptcha):
+		ce.User.setPasswordLogin(pl)
+		ce.User.sendProvisioningEvent(ProvisioningEventLoginCaptcha, pl.Captcha)
+		ce.Reply("Discord requires a CAPTCHA to log in. Solve the %s challenge with site key `%s` and send the response token here, "+
+			"or use `$cmdprefix cancel` to cancel the login.", pl.Captcha.Service, pl.Captcha.SiteKey)
+	case errors.Is(err, ErrPasswordLoginMFA):
+		ce.User.setPasswordLogin(pl)
+		ce.User.sendProvisioningEvent(ProvisioningEventLoginMFA, pl.MFA)
+		var methods []string
+		if pl.MFA.TOTP {
+			methods = append(methods, "`totp <code>` for authenticator app codes")
+		}
+		if pl.MFA.SMS {
+			methods = append(methods, "`sms` to receive a code by SMS, then `sms <code>`")
+		}
+		if pl.MFA.Backup {
+			methods = append(methods, "`backup <code>` for backup codes")
+		}
+		ce.Reply("Your account has multi-factor authentication enabled. Send %s, or use `$cmdprefix cancel` to cancel the login.", strings.Join(methods, ", "))
+	case errors.Is(err, ErrPasswordLoginNoMFAMethod):
+		ce.Reply("That authentication method isn't available for your account")
+	case errors.Is(err, ErrPasswordLoginInvalidCode):
+		ce.Reply("Error logging in: %v. Send another code, or use `$cmdprefix cancel` to cancel the login.", err)
+	case err != nil:
+		ce.User.setPasswordLogin(nil)
+		ce.Reply("Error logging in: %v", err)
+	default:
+		ce.User.setPasswordLogin(nil)
+		if err = ce.User.Login(token); err != nil {
+			ce.Reply("Error connecting after login: %v", err)
+			return
+		}
+		ce.Reply("Successfully logged in as @%s", ce.User.Session.State.User.Username)
+	}
+}
@@ -0,0 +1,194 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/bwmarrin/discordgo"
+	"golang.org/x/exp/slices"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-discord/database"
+)
+
+// handleDiscordPinsUpdate refetches the pinned messages of the channel (or thread) and rewrites the
+// pinned events of the room. Pins of other threads and pins of events that aren't Discord messages are kept.
+func (portal *Portal) handleDiscordPinsUpdate(user *User, channelID string, thread *Thread) {
+	log := portal.log.With().
+		Str("action", "discord pins update").
+		Str("channel_id", channelID).
+		Logger()
+	if user.Session == nil {
+		return
+	}
+	var threadID string
+	if thread != nil {
+		threadID = thread.ID
+	}
+	pinned, err := user.Session.ChannelMessagesPinned(channelID, portal.RefererOpt(threadID))
+	if err != nil {
+		log.Err(err).Msg("Failed to fetch pinned messages")
+		return
+	}
+	var existing event.PinnedEventsEventContent
+	err = portal.MainIntent().StateEvent(portal.MXID, event.StatePinnedEvents, "", &existing)
+	if err != nil && !errors.Is(err, mautrix.MNotFound) {
+		log.Warn().Err(err).Msg("Failed to get existing pinned events")
+	}
+
+	newPinned := make([]id.EventID, 0, len(existing.Pinned)+len(pinned))
+	for _, evtID := range existing.Pinned {
+		msg := portal.bridge.DB.Message.GetByMXID(portal.Key, evtID)
+		if msg == nil || msg.ThreadID != threadID {
+			newPinned = append(newPinned, evtID)
+		}
+	}
+	// Discord returns the most recently pinned message first, while Matrix clients append new pins to the end.
+	for i := len(pinned) - 1; i >= 0; i-- {
+		msg := portal.bridge.DB.Message.GetFirstByDiscordID(portal.Key, pinned[i].ID)
+		if msg == nil {
+			log.Debug().Str("message_id", pinned[i].ID).Msg("Ignoring pin of unknown message")
+		} else if !slices.Contains(newPinned, msg.MXID) {
+			newPinned = append(newPinned, msg.MXID)
+		}
+	}
+	if samePinnedEvents(existing.Pinned, newPinned) {
+		return
+	}
+	_, err = portal.MainIntent().SendStateEvent(portal.MXID, event.StatePinnedEvents, "", &event.PinnedEventsEventContent{Pinned: newPinned})
+	if err != nil {
+		log.Err(err).Msg("Failed to update pinned events")
+	} else {
+		log.Debug().Int("pin_count", len(newPinned)).Msg("Updated pinned events")
+	}
+}
+
+func samePinnedEvents(a, b []id.EventID) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, evtID := range a {
+		if !slices.Contains(b, evtID) {
+			return false
+		}
+	}
+	return true
+}
+
+// HandleMatrixPins is the same as MatrixHandler.HandleRoomMetadata, except that it doesn't skip private chats,
+// as messages can be pinned in DMs and group DMs too.
+func (br *DiscordBridge) HandleMatrixPins(evt *event.Event) {
+	defer br.MatrixHandler.TrackEventDuration(evt.Type)()
+	if evt.Sender == br.Bot.UserID || br.IsGhost(evt.Sender) {
+		return
+	}
+	user := br.GetUserByMXID(evt.Sender)
+	if user == nil || user.GetPermissionLevel() <= 0 {
+		return
+	} else if val, ok := evt.Content.Raw[appservice.DoublePuppetKey]; ok && val == br.Name && user.GetIDoublePuppet() != nil {
+		return
+	}
+	portal := br.GetPortalByMXID(evt.RoomID)
+	if portal == nil {
+		return
+	}
+	portal.HandleMatrixMeta(user, evt)
+}
+
+// handleMatrixPins pins and unpins messages on Discord based on the changes to the pinned events of the room.
+// If Discord rejects a change, the pinned events are resynced from Discord, so that the room doesn't show pins that didn't happen.
+func (portal *Portal) handleMatrixPins(sender *User, evt *event.Event) {
+	if sender.Session == nil {
+		go portal.sendMessageMetrics(evt, errCantPinAsRelay, "Ignoring")
+		return
+	}
+	content, ok := evt.Content.Parsed.(*event.PinnedEventsEventContent)
+	if !ok {
+		go portal.sendMessageMetrics(evt, fmt.Errorf("%w %T", errUnexpectedParsedContentType, evt.Content.Parsed), "Ignoring")
+		return
+	}
+	var prevPinned []id.EventID
+	if evt.Unsigned.PrevContent != nil {
+		_ = evt.Unsigned.PrevContent.ParseRaw(evt.Type)
+		prevPinned = evt.Unsigned.PrevContent.AsPinnedEvents().Pinned
+	}
+
+	var err error
+	var failedMsg *database.Message
+	for _, evtID := range content.Pinned {
+		if slices.Contains(prevPinned, evtID) {
+			continue
+		} else if msg := portal.bridge.DB.Message.GetByMXID(portal.Key, evtID); msg != nil {
+			err = portal.setDiscordPinned(sender, msg, true)
+			if err != nil {
+				failedMsg = msg
+				break
+			}
+		}
+	}
+	for _, evtID := range prevPinned {
+		if err != nil {
+			break
+		} else if slices.Contains(content.Pinned, evtID) {
+			continue
+		} else if msg := portal.bridge.DB.Message.GetByMXID(portal.Key, evtID); msg != nil {
+			err = portal.setDiscordPinned(sender, msg, false)
+			if err != nil {
+				failedMsg = msg
+			}
+		}
+	}
+	if failedMsg != nil {
+		var thread *Thread
+		if failedMsg.ThreadID != "" {
+			thread = portal.bridge.GetThreadByID(failedMsg.ThreadID, nil)
+		}
+		portal.handleDiscordPinsUpdate(sender, failedMsg.DiscordProtoChannelID(), thread)
+	}
+	go portal.sendMessageMetrics(evt, err, "Error sending")
+}
+
+func (portal *Portal) setDiscordPinned(sender *User, msg *database.Message, pinned bool) error {
+	log := portal.log.With().
+		Str("message_id", msg.DiscordID).
+		Str("event_id", msg.MXID.String()).
+		Bool("pinned", pinned).
+		Logger()
+	refererOpt := portal.RefererOpt(msg.ThreadID)
+	var err error
+	if pinned {
+		err = sender.Session.ChannelMessagePin(msg.DiscordProtoChannelID(), msg.DiscordID, refererOpt)
+	} else {
+		err = sender.Session.ChannelMessageUnpin(msg.DiscordProtoChannelID(), msg.DiscordID, refererOpt)
+	}
+	var restErr *discordgo.RESTError
+	if !pinned && errors.As(err, &restErr) && restErr.Response.StatusCode == 404 {
+		// The message was already unpinned or deleted on Discord
+		err = nil
+	}
+	if err != nil {
+		log.Err(err).Msg("Failed to change pin status on Discord")
+		return err
+	}
+	log.Debug().Msg("Changed pin status on Discord")
+	return nil
+}
@@ -0,0 +1,406 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+
+	"go.mau.fi/mautrix-discord/database"
+)
+
+// Unstable poll event types from MSC3381.
+var (
+	EventUnstablePollStart    = event.Type{Type: "org.matrix.msc3381.poll.start", Class: event.MessageEventType}
+	EventUnstablePollResponse = event.Type{Type: "org.matrix.msc3381.poll.response", Class: event.MessageEventType}
+	EventUnstablePollEnd      = event.Type{Type: "org.matrix.msc3381.poll.end", Class: event.MessageEventType}
+)
+
+const (
+	pollAttachmentID = "poll"
+	// messageTypePollResult is the system message Discord sends when a poll ends.
+	messageTypePollResult discordgo.MessageType = 46
+
+	maxDiscordPollAnswers = 10
+	// How long polls created from Matrix stay open on Discord, in hours.
+	discordPollDuration = 24
+)
+
+type PollText struct {
+	Text string `json:"org.matrix.msc1767.text,omitempty"`
+	Body string `json:"body,omitempty"`
+}
+
+func (pt *PollText) String() string {
+	if pt.Text != "" {
+		return pt.Text
+	}
+	return pt.Body
+}
+
+type PollAnswer struct {
+	ID string `json:"id"`
+	PollText
+
+	// DiscordID is the ID of the answer on Discord, set for polls that were bridged from Discord.
+	DiscordID int `json:"fi.mau.discord.answer_id,omitempty"`
+}
+
+type PollStart struct {
+	Question      PollText     `json:"question"`
+	Kind          string       `json:"kind"`
+	MaxSelections int          `json:"max_selections"`
+	Answers       []PollAnswer `json:"answers"`
+}
+
+type PollStartEventContent struct {
+	RelatesTo *event.RelatesTo `json:"m.relates_to,omitempty"`
+	PollStart PollStart        `json:"org.matrix.msc3381.poll.start"`
+}
+
+// PollRelationEventContent is used for poll responses and poll ends, which reference the poll start event.
+type PollRelationEventContent struct {
+	RelatesTo event.RelatesTo `json:"m.relates_to"`
+	Response  struct {
+		Answers []string `json:"answers"`
+	} `json:"org.matrix.msc3381.poll.response"`
+}
+
+func (br *DiscordBridge) registerPollHandlers() {
+	br.EventProcessor.On(EventUnstablePollStart, br.MatrixHandler.HandleMessage)
+	br.EventProcessor.On(EventUnstablePollResponse, br.MatrixHandler.HandleMessage)
+	br.EventProcessor.On(EventUnstablePollEnd, br.MatrixHandler.HandleMessage)
+}
+
+func (portal *Portal) convertDiscordPoll(poll *discordgo.Poll) *ConvertedMessage {
+	start := PollStart{
+		Question:      PollText{Text: poll.Question.Text},
+		Kind:          "org.matrix.msc3381.poll.disclosed",
+		MaxSelections: 1,
+		Answers:       make([]PollAnswer, len(poll.Answers)),
+	}
+	if poll.AllowMultiselect {
+		start.MaxSelections = len(poll.Answers)
+	}
+	fallback := []string{poll.Question.Text}
+	for i, answer := range poll.Answers {
+		var text string
+		if answer.Media != nil {
+			text = answer.Media.Text
+			if answer.Media.Emoji != nil && answer.Media.Emoji.ID == "" && answer.Media.Emoji.Name != "" {
+				text = fmt.Sprintf("%s %s", answer.Media.Emoji.Name, text)
+			}
+		}
+		start.Answers[i] = PollAnswer{
+			ID:        strconv.Itoa(answer.AnswerID),
+			PollText:  PollText{Text: text},
+			DiscordID: answer.AnswerID,
+		}
+		fallback = append(fallback, fmt.Sprintf("%d. %s", i+1, text))
+	}
+	fallbackText := strings.Join(fallback, "\n")
+	return &ConvertedMessage{
+		AttachmentID: pollAttachmentID,
+		Type:         EventUnstablePollStart,
+		Content:      &event.MessageEventContent{Body: fallbackText},
+		Extra: map[string]any{
+			"org.matrix.msc3381.poll.start": start,
+			"org.matrix.msc1767.text":       fallbackText,
+		},
+	}
+}
+
+func getEmbedField(embed *discordgo.MessageEmbed, name string) string {
+	for _, field := range embed.Fields {
+		if field.Name == name {
+			return field.Value
+		}
+	}
+	return ""
+}
+
+func (portal *Portal) convertDiscordPollResult(ctx context.Context, msg *discordgo.Message) *ConvertedMessage {
+	var text string
+	if len(msg.Embeds) > 0 {
+		embed := msg.Embeds[0]
+		question := getEmbedField(embed, "poll_question_text")
+		if winner := getEmbedField(embed, "victor_answer_text"); winner != "" {
+			text = fmt.Sprintf("The poll %q has ended. Winning answer: %s (%s of %s votes)",
+				question, winner, getEmbedField(embed, "victor_answer_votes"), getEmbedField(embed, "total_votes"))
+		} else {
+			text = fmt.Sprintf("The poll %q has ended.", question)
+		}
+	} else {
+		text = "The poll has ended."
+	}
+	content := &event.MessageEventContent{MsgType: event.MsgNotice, Body: text}
+	if msg.MessageReference == nil {
+		return &ConvertedMessage{Type: event.EventMessage, Content: content}
+	}
+	pollMsg := portal.getPollMessage(msg.MessageReference.MessageID)
+	if pollMsg == nil {
+		zerolog.Ctx(ctx).Debug().
+			Str("poll_message_id", msg.MessageReference.MessageID).
+			Msg("Poll result references unknown poll, sending notice instead of poll end")
+		return &ConvertedMessage{Type: event.EventMessage, Content: content}
+	}
+	content.MsgType = ""
+	content.RelatesTo = &event.RelatesTo{Type: event.RelReference, EventID: pollMsg.MXID}
+	return &ConvertedMessage{
+		Type:    EventUnstablePollEnd,
+		Content: content,
+		Extra: map[string]any{
+			"org.matrix.msc3381.poll.end": map[string]any{},
+			"org.matrix.msc1767.text":     text,
+		},
+	}
+}
+
+func (portal *Portal) getPollMessage(discordID string) *database.Message {
+	for _, part := range portal.bridge.DB.Message.GetByDiscordID(portal.Key, discordID) {
+		if part.AttachmentID == pollAttachmentID {
+			return part
+		}
+	}
+	return nil
+}
+
+// getPollAnswerMap returns a map from Discord answer IDs to Matrix answer IDs for the given poll.
+func (portal *Portal) getPollAnswerMap(pollMsg *database.Message) (map[int]string, error) {
+	evt, err := portal.getEvent(pollMsg.MXID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get poll start event: %w", err)
+	}
+	var content PollStartEventContent
+	err = json.Unmarshal(evt.Content.VeryRaw, &content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse poll start event: %w", err)
+	}
+	answerMap := make(map[int]string, len(content.PollStart.Answers))
+	for i, answer := range content.PollStart.Answers {
+		if answer.DiscordID != 0 {
+			answerMap[answer.DiscordID] = answer.ID
+		} else {
+			// Discord numbers the answers of polls created from Matrix in order starting from 1
+			answerMap[i+1] = answer.ID
+		}
+	}
+	return answerMap, nil
+}
+
+func (portal *Portal) sendMatrixRawEvent(intent *appservice.IntentAPI, eventType event.Type, content map[string]any, timestamp int64) (*mautrix.RespSendEvent, error) {
+	wrappedContent := event.Content{Raw: content}
+	var err error
+	eventType, err = portal.encrypt(intent, &wrappedContent, eventType)
+	if err != nil {
+		return nil, err
+	}
+	if timestamp == 0 {
+		return intent.SendMessageEvent(portal.MXID, eventType, &wrappedContent)
+	}
+	return intent.SendMassagedMessageEvent(portal.MXID, eventType, &wrappedContent, timestamp)
+}
+
+func (portal *Portal) handleDiscordPollVote(user *User, messageID, userID string, answerID int, add bool) {
+	log := portal.log.With().
+		Str("action", "discord poll vote").
+		Str("message_id", messageID).
+		Str("voter_id", userID).
+		Int("answer_id", answerID).
+		Bool("add", add).
+		Logger()
+	pollMsg := portal.getPollMessage(messageID)
+	if pollMsg == nil {
+		log.Debug().Msg("Dropping vote in unknown poll")
+		return
+	}
+	var changed bool
+	if add {
+		changed = portal.bridge.DB.PollVote.Add(portal.Key, messageID, userID, answerID)
+	} else {
+		changed = portal.bridge.DB.PollVote.Remove(portal.Key, messageID, userID, answerID)
+	}
+	if !changed {
+		log.Debug().Msg("Dropping duplicate poll vote")
+		return
+	}
+	answerMap, err := portal.getPollAnswerMap(pollMsg)
+	if err != nil {
+		log.Err(err).Msg("Failed to get poll answers")
+		return
+	}
+	votes := portal.bridge.DB.PollVote.GetAnswers(portal.Key, messageID, userID)
+	answers := make([]string, 0, len(votes))
+	for _, vote := range votes {
+		if matrixID, ok := answerMap[vote]; ok {
+			answers = append(answers, matrixID)
+		}
+	}
+	puppet := portal.bridge.GetPuppetByID(userID)
+	puppet.UpdateInfo(user, nil, nil)
+	intent := puppet.IntentFor(portal)
+	resp, err := portal.sendMatrixRawEvent(intent, EventUnstablePollResponse, map[string]any{
+		"m.relates_to": &event.RelatesTo{Type: event.RelReference, EventID: pollMsg.MXID},
+		"org.matrix.msc3381.poll.response": map[string]any{
+			"answers": answers,
+		},
+	}, 0)
+	if err != nil {
+		log.Err(err).Msg("Failed to send poll response to Matrix")
+		return
+	}
+	log.Debug().Str("event_id", resp.EventID.String()).Strs("answers", answers).Msg("Bridged poll vote")
+}
+
+func (portal *Portal) handleMatrixPollStart(sender *User, evt *event.Event) {
+	if portal.IsPrivateChat() && sender.DiscordID != portal.Key.Receiver {
+		go portal.sendMessageMetrics(evt, errUserNotReceiver, "Ignoring")
+		return
+	} else if sender.Session == nil {
+		go portal.sendMessageMetrics(evt, errCantSendPollAsRelay, "Ignoring")
+		return
+	}
+	var content PollStartEventContent
+	err := json.Unmarshal(evt.Content.VeryRaw, &content)
+	if err != nil {
+		go portal.sendMessageMetrics(evt, fmt.Errorf("%w: %w", errInvalidPoll, err), "Ignoring")
+		return
+	} else if len(content.PollStart.Answers) == 0 || len(content.PollStart.Answers) > maxDiscordPollAnswers {
+		go portal.sendMessageMetrics(evt, fmt.Errorf("%w: Discord polls must have 1-%d answers", errInvalidPoll, maxDiscordPollAnswers), "Ignoring")
+		return
+	}
+	poll := &discordgo.Poll{
+		Question:         discordgo.PollMedia{Text: content.PollStart.Question.String()},
+		Answers:          make([]discordgo.PollAnswer, len(content.PollStart.Answers)),
+		AllowMultiselect: content.PollStart.MaxSelections > 1,
+		LayoutType:       discordgo.PollLayoutTypeDefault,
+		Duration:         discordPollDuration,
+	}
+	for i, answer := range content.PollStart.Answers {
+		poll.Answers[i] = discordgo.PollAnswer{Media: &discordgo.PollMedia{Text: answer.String()}}
+	}
+
+	var threadID string
+	if threadRoot := content.RelatesTo.GetThreadParent(); threadRoot != "" {
+		if thread := portal.bridge.GetThreadByRootMXID(threadRoot); thread != nil {
+			threadID = thread.ID
+		}
+	}
+	channelID := portal.Key.ChannelID
+	if threadID != "" {
+		channelID = threadID
+	}
+	msg, err := sender.Session.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{
+		Poll:  poll,
+		Nonce: generateNonce(),
+	}, portal.RefererOptIfUser(sender.Session, threadID)...)
+	sender.handlePossible40002(err)
+	go portal.sendMessageMetrics(evt, err, "Error sending")
+	if msg != nil {
+		dbMsg := portal.bridge.DB.Message.New()
+		dbMsg.Channel = portal.Key
+		dbMsg.DiscordID = msg.ID
+		dbMsg.AttachmentID = pollAttachmentID
+		dbMsg.MXID = evt.ID
+		dbMsg.SenderID = sender.DiscordID
+		dbMsg.SenderMXID = sender.MXID
+		dbMsg.Timestamp, _ = discordgo.SnowflakeTimestamp(msg.ID)
+		dbMsg.ThreadID = threadID
+		dbMsg.Insert()
+	}
+}
+
+type reqPollVote struct {
+	AnswerIDs []string `json:"answer_ids"`
+}
+
+func (portal *Portal) handleMatrixPollResponse(sender *User, evt *event.Event) {
+	if sender.Session == nil {
+		go portal.sendMessageMetrics(evt, errCantSendPollAsRelay, "Ignoring")
+		return
+	}
+	var content PollRelationEventContent
+	err := json.Unmarshal(evt.Content.VeryRaw, &content)
+	if err != nil {
+		go portal.sendMessageMetrics(evt, fmt.Errorf("%w: %w", errInvalidPoll, err), "Ignoring")
+		return
+	}
+	pollMsg := portal.bridge.DB.Message.GetByMXID(portal.Key, content.RelatesTo.EventID)
+	if pollMsg == nil || pollMsg.AttachmentID != pollAttachmentID {
+		go portal.sendMessageMetrics(evt, fmt.Errorf("%w %s", errTargetNotFound, content.RelatesTo.EventID), "Ignoring")
+		return
+	}
+	answerMap, err := portal.getPollAnswerMap(pollMsg)
+	if err != nil {
+		go portal.sendMessageMetrics(evt, err, "Error sending")
+		return
+	}
+	reverseMap := make(map[string]int, len(answerMap))
+	for discordID, matrixID := range answerMap {
+		reverseMap[matrixID] = discordID
+	}
+	req := reqPollVote{AnswerIDs: make([]string, 0, len(content.Response.Answers))}
+	votes := make([]int, 0, len(content.Response.Answers))
+	for _, answer := range content.Response.Answers {
+		if discordID, ok := reverseMap[answer]; ok {
+			req.AnswerIDs = append(req.AnswerIDs, strconv.Itoa(discordID))
+			votes = append(votes, discordID)
+		}
+	}
+	// Store the votes before sending them so that the echoes from Discord are ignored
+	portal.bridge.DB.PollVote.Replace(portal.Key, pollMsg.DiscordID, sender.DiscordID, votes)
+	channelID := pollMsg.DiscordProtoChannelID()
+	_, err = sender.Session.RequestWithBucketID(
+		http.MethodPut,
+		discordgo.EndpointPoll(channelID, pollMsg.DiscordID)+"/answers/@me",
+		&req,
+		discordgo.EndpointPoll(channelID, ""),
+		portal.RefererOpt(pollMsg.ThreadID),
+	)
+	go portal.sendMessageMetrics(evt, err, "Error sending")
+}
+
+func (portal *Portal) handleMatrixPollEnd(sender *User, evt *event.Event) {
+	if sender.Session == nil {
+		go portal.sendMessageMetrics(evt, errCantSendPollAsRelay, "Ignoring")
+		return
+	}
+	var content PollRelationEventContent
+	err := json.Unmarshal(evt.Content.VeryRaw, &content)
+	if err != nil {
+		go portal.sendMessageMetrics(evt, fmt.Errorf("%w: %w", errInvalidPoll, err), "Ignoring")
+		return
+	}
+	pollMsg := portal.bridge.DB.Message.GetByMXID(portal.Key, content.RelatesTo.EventID)
+	if pollMsg == nil || pollMsg.AttachmentID != pollAttachmentID {
+		go portal.sendMessageMetrics(evt, fmt.Errorf("%w %s", errTargetNotFound, content.RelatesTo.EventID), "Ignoring")
+		return
+	}
+	// The poll result message that Discord sends afterwards is bridged back as the poll end event
+	_, err = sender.Session.PollExpire(pollMsg.DiscordProtoChannelID(), pollMsg.DiscordID)
+	go portal.sendMessageMetrics(evt, err, "Error sending")
+}
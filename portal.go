@@ -32,6 +32,7 @@ import (
 	"maunium.net/go/mautrix/bridge/status"
 	"maunium.net/go/mautrix/crypto/attachment"
 	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
 	"maunium.net/go/mautrix/id"
 
 	"go.mau.fi/mautrix-discord/config"
@@ -76,6 +77,14 @@ type Portal struct {
 
 	currentlyTyping     []id.UserID
 	currentlyTypingLock sync.Mutex
+
+	voiceParticipants map[id.UserID]struct{}
+	voiceLock         sync.Mutex
+
+	powerLevelLock    sync.Mutex
+	powerLevelTimer   *time.Timer
+	powerLevelSource  *User
+	powerLevelChannel *discordgo.Channel
 }
 
 const recentMessageBufferSize = 32
@@ -84,8 +93,8 @@ var _ bridge.Portal = (*Portal)(nil)
 var _ bridge.ReadReceiptHandlingPortal = (*Portal)(nil)
 var _ bridge.MembershipHandlingPortal = (*Portal)(nil)
 var _ bridge.TypingPortal = (*Portal)(nil)
+var _ bridge.MetaHandlingPortal = (*Portal)(nil)
 
-//var _ bridge.MetaHandlingPortal = (*Portal)(nil)
 //var _ bridge.DisappearingPortal = (*Portal)(nil)
 
 func (portal *Portal) IsEncrypted() bool {
@@ -513,6 +522,12 @@ func (portal *Portal) CreateMatrixRoom(user *User, channel *discordgo.Channel) e
 	portal.bridge.portalsLock.Unlock()
 	portal.Update()
 	portal.log.Info().Msg("Matrix room created")
+	user.sendProvisioningEvent(ProvisioningEventPortalCreated, provisioningEventPortal{
+		ChannelID: portal.Key.ChannelID,
+		GuildID:   portal.GuildID,
+		Name:      portal.PlainName,
+		MXID:      portal.MXID,
+	})
 
 	if portal.Encrypted && portal.IsPrivateChat() {
 		err = portal.bridge.Bot.EnsureJoined(portal.MXID, appservice.EnsureJoinedParams{BotOverride: portal.MainIntent().Client})
@@ -530,6 +545,10 @@ func (portal *Portal) CreateMatrixRoom(user *User, channel *discordgo.Channel) e
 	user.syncChatDoublePuppetDetails(portal, true)
 
 	portal.syncParticipants(user, channel.Recipients)
+	portal.updatePowerLevels(user, channel)
+	if portal.IsThread() {
+		portal.linkThreadRoom()
+	}
 
 	if portal.IsPrivateChat() {
 		puppet := user.bridge.GetPuppetByID(portal.Key.Receiver)
@@ -552,6 +571,146 @@ func (portal *Portal) CreateMatrixRoom(user *User, channel *discordgo.Channel) e
 	return nil
 }
 
+func (br *DiscordBridge) CreatePrivatePortal(roomID id.RoomID, brInviter bridge.User, brGhost bridge.Ghost) {
+	inviter := brInviter.(*User)
+	puppet := brGhost.(*Puppet)
+	log := br.ZLog.With().
+		Str("action", "create private portal").
+		Str("target_room_id", roomID.String()).
+		Str("inviter_mxid", inviter.MXID.String()).
+		Str("invitee_id", puppet.ID).
+		Logger()
+
+	if inviter.Session == nil {
+		log.Debug().Msg("Rejecting private chat invite: inviter isn't connected to Discord")
+		br.rejectPrivatePortalInvite(roomID, puppet, "You're not connected to Discord. Use the `reconnect` command and try again.")
+		return
+	}
+
+	var channel *discordgo.Channel
+	portal := inviter.FindPrivateChatWith(puppet.ID)
+	if portal == nil {
+		var err error
+		channel, err = inviter.Session.UserChannelCreate(puppet.ID)
+		if err != nil {
+			log.Err(err).Msg("Failed to open DM channel")
+			br.rejectPrivatePortalInvite(roomID, puppet, fmt.Sprintf("Failed to open a DM with %s: %v", puppet.Name, err))
+			return
+		}
+		portal = inviter.GetPortalByMeta(channel)
+	} else if portal.MXID == roomID {
+		return
+	} else if portal.MXID != "" && portal.ensureUserInvited(inviter, false) {
+		log.Debug().
+			Str("existing_room_id", portal.MXID.String()).
+			Msg("Private chat portal already exists, leaving new room")
+		br.rejectPrivatePortalInvite(roomID, puppet, fmt.Sprintf("You already have a private chat portal with me at [%[1]s](https://matrix.to/#/%[1]s)", portal.MXID))
+		return
+	}
+	err := portal.createMatrixRoomFromInvite(inviter, roomID, channel)
+	if err != nil {
+		log.Err(err).Msg("Failed to bind room to DM portal")
+		br.rejectPrivatePortalInvite(roomID, puppet, fmt.Sprintf("Failed to create private chat portal: %v", err))
+	}
+}
+
+func (br *DiscordBridge) rejectPrivatePortalInvite(roomID id.RoomID, puppet *Puppet, message string) {
+	intent := puppet.DefaultIntent()
+	content := format.RenderMarkdown(message, true, false)
+	content.MsgType = event.MsgNotice
+	_, err := intent.SendMessageEvent(roomID, event.EventMessage, &content)
+	if err != nil {
+		br.ZLog.Warn().Err(err).Str("room_id", roomID.String()).Msg("Failed to send private chat portal error notice")
+	}
+	_, err = intent.LeaveRoom(roomID)
+	if err != nil {
+		br.ZLog.Warn().Err(err).Str("room_id", roomID.String()).Msg("Failed to leave room after private chat portal error")
+	}
+}
+
+// createMatrixRoomFromInvite binds an existing Matrix room created by the user to this DM portal.
+func (portal *Portal) createMatrixRoomFromInvite(user *User, roomID id.RoomID, channel *discordgo.Channel) error {
+	portal.roomCreateLock.Lock()
+	defer portal.roomCreateLock.Unlock()
+
+	oldMXID := portal.MXID
+	portal.MXID = ""
+	channel = portal.UpdateInfo(user, channel)
+	if channel == nil {
+		portal.MXID = oldMXID
+		return fmt.Errorf("didn't find channel metadata")
+	}
+	intent := portal.MainIntent()
+
+	var existingEncryption event.EncryptionEventContent
+	err := intent.StateEvent(roomID, event.StateEncryption, "", &existingEncryption)
+	if err != nil && !errors.Is(err, mautrix.MNotFound) {
+		portal.log.Warn().Err(err).Str("room_id", roomID.String()).Msg("Failed to check if encryption is enabled in private chat room")
+	}
+	encryptionEnabled := existingEncryption.Algorithm == id.AlgorithmMegolmV1
+
+	portal.bridge.portalsLock.Lock()
+	if oldMXID != "" {
+		delete(portal.bridge.portalsByMXID, oldMXID)
+	}
+	portal.MXID = roomID
+	portal.bridge.portalsByMXID[portal.MXID] = portal
+	portal.bridge.portalsLock.Unlock()
+	portal.log = portal.bridge.ZLog.With().
+		Str("channel_id", portal.Key.ChannelID).
+		Str("channel_receiver", portal.Key.Receiver).
+		Str("room_id", portal.MXID.String()).
+		Logger()
+	portal.log.Info().
+		Str("inviter_mxid", user.MXID.String()).
+		Str("old_room_id", oldMXID.String()).
+		Msg("Using room created by user as private chat portal")
+
+	if portal.bridge.Config.Bridge.Encryption.Default || encryptionEnabled {
+		_, err = intent.InviteUser(roomID, &mautrix.ReqInviteUser{UserID: portal.bridge.Bot.UserID})
+		if err != nil {
+			portal.log.Warn().Err(err).Msg("Failed to invite bridge bot to enable encryption")
+		}
+		err = portal.bridge.Bot.EnsureJoined(roomID)
+		if err != nil {
+			portal.log.Warn().Err(err).Msg("Failed to join as bridge bot to enable encryption")
+		}
+		if !encryptionEnabled {
+			_, err = intent.SendStateEvent(roomID, event.StateEncryption, "", portal.GetEncryptionEventContent())
+			if err != nil {
+				portal.log.Warn().Err(err).Msg("Failed to enable encryption")
+			}
+		}
+		portal.Encrypted = true
+	}
+
+	portal.NameSet = false
+	portal.AvatarSet = false
+	portal.TopicSet = false
+	portal.FirstEventID = ""
+	portal.updateRoomName()
+	portal.updateRoomAvatar()
+	portal.UpdateBridgeInfo()
+	portal.Update()
+
+	user.MarkInPortal(database.UserPortal{
+		DiscordID: portal.Key.ChannelID,
+		Type:      database.UserPortalTypeDM,
+		Timestamp: time.Now(),
+		InSpace:   user.addPrivateChannelToSpace(portal),
+	})
+	user.syncChatDoublePuppetDetails(portal, true)
+	user.updateDirectChats(map[id.UserID][]id.RoomID{
+		portal.bridge.GetPuppetByID(portal.OtherUserID).MXID: {portal.MXID},
+	})
+
+	_, err = intent.SendNotice(roomID, "Private chat portal created")
+	if err != nil {
+		portal.log.Warn().Err(err).Msg("Failed to send private chat portal creation notice")
+	}
+	return nil
+}
+
 func (portal *Portal) handleDiscordMessages(msg portalDiscordMessage) {
 	if portal.MXID == "" {
 		msgCreate, ok := msg.msg.(*discordgo.MessageCreate)
@@ -584,6 +743,14 @@ func (portal *Portal) handleDiscordMessages(msg portalDiscordMessage) {
 		portal.handleDiscordReaction(msg.user, convertedMsg.MessageReaction, true, msg.thread, convertedMsg.Member)
 	case *discordgo.MessageReactionRemove:
 		portal.handleDiscordReaction(msg.user, convertedMsg.MessageReaction, false, msg.thread, nil)
+	case *discordgo.MessagePollVoteAdd:
+		portal.handleDiscordPollVote(msg.user, convertedMsg.MessageID, convertedMsg.UserID, convertedMsg.AnswerID, true)
+	case *discordgo.MessagePollVoteRemove:
+		portal.handleDiscordPollVote(msg.user, convertedMsg.MessageID, convertedMsg.UserID, convertedMsg.AnswerID, false)
+	case *discordgo.ChannelPinsUpdate:
+		portal.handleDiscordPinsUpdate(msg.user, convertedMsg.ChannelID, msg.thread)
+	case *discordgo.ThreadUpdate:
+		portal.handleDiscordForumPostUpdate(msg.user, convertedMsg.Channel)
 	default:
 		portal.log.Warn().Type("message_type", msg.msg).Msg("Unknown message type in handleDiscordMessages")
 	}
@@ -610,7 +777,7 @@ func (portal *Portal) markMessageHandled(discordID string, authorID string, time
 func (portal *Portal) handleDiscordMessageCreate(user *User, msg *discordgo.Message, thread *Thread) {
 	switch msg.Type {
 	case discordgo.MessageTypeChannelNameChange, discordgo.MessageTypeChannelIconChange, discordgo.MessageTypeChannelPinnedMessage:
-		// These are handled via channel updates
+		// These are handled via channel and pin updates
 		return
 	}
 
@@ -622,6 +789,14 @@ func (portal *Portal) handleDiscordMessageCreate(user *User, msg *discordgo.Mess
 		Logger()
 	ctx := log.WithContext(context.Background())
 
+	if thread == nil && portal.IsForum() && msg.ChannelID != portal.Key.ChannelID && msg.ID != msg.ChannelID {
+		thread = portal.ensureForumPost(ctx, user, msg.ChannelID)
+		if thread == nil {
+			log.Warn().Str("thread_id", msg.ChannelID).Msg("Dropping message in forum post that couldn't be bridged")
+			return
+		}
+	}
+
 	portal.recentMessages.Push(msg.ID, msg)
 
 	existing := portal.bridge.DB.Message.GetByDiscordID(portal.Key, msg.ID)
@@ -634,6 +809,12 @@ func (portal *Portal) handleDiscordMessageCreate(user *User, msg *discordgo.Mess
 	puppet := portal.bridge.GetPuppetByID(msg.Author.ID)
 	puppet.UpdateInfo(user, msg.Author, msg)
 	intent := puppet.IntentFor(portal)
+	if msg.Member != nil && !intent.IsCustomPuppet {
+		if err := intent.EnsureJoined(portal.MXID); err != nil {
+			log.Warn().Err(err).Msg("Failed to ensure ghost is joined to room")
+		}
+		puppet.UpdateGuildMemberMeta(portal, msg.Member)
+	}
 
 	var discordThreadID string
 	var threadRootEvent, lastThreadEvent id.EventID
@@ -646,15 +827,26 @@ func (portal *Portal) handleDiscordMessageCreate(user *User, msg *discordgo.Mess
 			lastThreadEvent = lastInThread.MXID
 		}
 	}
-	replyTo := portal.getReplyTarget(user, discordThreadID, msg.MessageReference, msg.Embeds, false)
+	var replyTo *event.InReplyTo
+	var parts []*ConvertedMessage
 	mentions := portal.convertDiscordMentions(msg, true)
+	if snapshot := portal.getForwardSnapshot(msg); snapshot != nil {
+		parts = portal.convertDiscordForward(ctx, user, puppet, intent, msg, snapshot)
+	} else {
+		replyTo = portal.getReplyTarget(user, discordThreadID, msg.MessageReference, msg.Embeds, false)
+		parts = portal.convertDiscordMessage(ctx, puppet, intent, msg)
+	}
+	if portal.isForumPostStarter(msg) {
+		parts = portal.addForumPostHeader(ctx, user, msg.ChannelID, parts)
+	}
 
 	ts, _ := discordgo.SnowflakeTimestamp(msg.ID)
-	parts := portal.convertDiscordMessage(ctx, puppet, intent, msg)
 	dbParts := make([]database.MessagePart, 0, len(parts))
 	eventIDs := zerolog.Dict()
 	for i, part := range parts {
-		if (replyTo != nil || threadRootEvent != "") && part.Content.RelatesTo == nil {
+		if part.Type == EventUnstablePollEnd {
+			// Poll ends already reference the poll start event
+		} else if (replyTo != nil || threadRootEvent != "") && part.Content.RelatesTo == nil {
 			part.Content.RelatesTo = &event.RelatesTo{}
 		}
 		if threadRootEvent != "" {
@@ -696,6 +888,8 @@ func (portal *Portal) handleDiscordMessageCreate(user *User, msg *discordgo.Mess
 		firstDBMessage := portal.markMessageHandled(msg.ID, msg.Author.ID, ts, discordThreadID, intent.UserID, dbParts)
 		if msg.Flags == discordgo.MessageFlagsHasThread {
 			portal.bridge.threadFound(ctx, user, firstDBMessage, msg.ID, msg.Thread)
+		} else if portal.isForumPostStarter(msg) {
+			portal.forumPostFound(ctx, firstDBMessage, msg.ChannelID)
 		}
 	}
 }
@@ -871,6 +1065,9 @@ func (portal *Portal) handleDiscordMessageUpdate(user *User, msg *discordgo.Mess
 			delete(attachmentMap, remainingAttachment.ID)
 		}
 	}
+	if msg.Poll != nil {
+		delete(attachmentMap, pollAttachmentID)
+	}
 	for _, remainingSticker := range msg.StickerItems {
 		if _, found := attachmentMap[remainingSticker.ID]; found {
 			delete(attachmentMap, remainingSticker.ID)
@@ -913,6 +1110,9 @@ func (portal *Portal) handleDiscordMessageUpdate(user *User, msg *discordgo.Mess
 			Msg("Dropping non-text edit")
 		return
 	}
+	if portal.isForumPostStarter(msg) {
+		converted = portal.addForumPostHeader(ctx, user, msg.ChannelID, []*ConvertedMessage{converted})[0]
+	}
 	puppet.addWebhookMeta(converted, msg)
 	puppet.addMemberMeta(converted, msg)
 	converted.Content.Mentions = portal.convertDiscordMentions(msg, false)
@@ -1097,6 +1297,16 @@ func (portal *Portal) handleMatrixMessages(msg portalMatrixMessage) {
 		portal.handleMatrixRedaction(msg.user, msg.evt)
 	case event.EventReaction:
 		portal.handleMatrixReaction(msg.user, msg.evt)
+	case event.StateRoomName, event.StateTopic, event.StateRoomAvatar:
+		portal.handleMatrixMeta(msg.user, msg.evt)
+	case event.StatePinnedEvents:
+		portal.handleMatrixPins(msg.user, msg.evt)
+	case EventUnstablePollStart:
+		portal.handleMatrixPollStart(msg.user, msg.evt)
+	case EventUnstablePollResponse:
+		portal.handleMatrixPollResponse(msg.user, msg.evt)
+	case EventUnstablePollEnd:
+		portal.handleMatrixPollEnd(msg.user, msg.evt)
 	default:
 		portal.log.Warn().Str("event_type", msg.evt.Type.Type).Msg("Unknown event type in handleMatrixMessages")
 	}
@@ -1216,7 +1426,17 @@ var (
 	errUnknownRelationType         = errors.New("unknown relation type")
 	errTargetNotFound              = errors.New("target event not found")
 	errUnknownEmoji                = errors.New("unknown emoji")
+	errEmojiNotUsable              = errors.New("you can't use this emoji here")
 	errCantStartThread             = errors.New("can't create thread without being logged into Discord")
+	errCantEditMeta                = errors.New("can't change room metadata without being logged into Discord")
+	errUnsupportedMeta             = errors.New("this room metadata can't be changed on Discord")
+	errCantInviteToGuild           = errors.New("can't invite users to guild channels")
+	errNoKickPermission            = errors.New("you don't have permission to kick members")
+	errCantChangeMembers           = errors.New("can't change room members without being connected to Discord")
+	errCantSendPollAsRelay         = errors.New("can't send polls without being logged into Discord")
+	errInvalidPoll                 = errors.New("invalid poll")
+	errCantPinAsRelay              = errors.New("can't change pinned messages without being logged into Discord")
+	errCantCreateForumPost         = errors.New("can't create forum posts without being logged into Discord")
 )
 
 func errorToStatusReason(err error) (reason event.MessageStatusReason, status event.MessageStatus, isCertain, sendNotice bool, humanMessage string, checkpointError error) {
@@ -1226,10 +1446,19 @@ func errorToStatusReason(err error) (reason event.MessageStatusReason, status ev
 		errors.Is(err, errUnknownRelationType),
 		errors.Is(err, errUnexpectedParsedContentType),
 		errors.Is(err, errUnknownEmoji),
+		errors.Is(err, errEmojiNotUsable),
 		errors.Is(err, id.InvalidContentURI),
 		errors.Is(err, attachment.UnsupportedVersion),
 		errors.Is(err, attachment.UnsupportedAlgorithm),
-		errors.Is(err, errCantStartThread):
+		errors.Is(err, errCantStartThread),
+		errors.Is(err, errCantEditMeta),
+		errors.Is(err, errUnsupportedMeta),
+		errors.Is(err, errCantInviteToGuild),
+		errors.Is(err, errCantChangeMembers),
+		errors.Is(err, errCantSendPollAsRelay),
+		errors.Is(err, errInvalidPoll),
+		errors.Is(err, errCantPinAsRelay),
+		errors.Is(err, errCantCreateForumPost):
 		return event.MessageStatusUnsupported, event.MessageStatusFail, true, true, "", nil
 	case errors.Is(err, attachment.HashMismatch),
 		errors.Is(err, attachment.InvalidKey),
@@ -1237,6 +1466,8 @@ func errorToStatusReason(err error) (reason event.MessageStatusReason, status ev
 		return event.MessageStatusUndecryptable, event.MessageStatusFail, true, true, "", nil
 	case errors.Is(err, errUserNotReceiver), errors.Is(err, errUserNotLoggedIn):
 		return event.MessageStatusNoPermission, event.MessageStatusFail, true, false, "", nil
+	case errors.Is(err, errNoKickPermission):
+		return event.MessageStatusNoPermission, event.MessageStatusFail, true, true, "", nil
 	case errors.Is(err, errUnknownEditTarget):
 		return event.MessageStatusGenericError, event.MessageStatusFail, true, false, "", nil
 	case errors.Is(err, errTargetNotFound):
@@ -1335,6 +1566,18 @@ func (portal *Portal) sendMessageMetrics(evt *event.Event, err error, part strin
 		msgType = "reaction"
 	case event.EventRedaction:
 		msgType = "redaction"
+	case EventUnstablePollStart:
+		msgType = "poll"
+	case EventUnstablePollResponse:
+		msgType = "poll response"
+	case EventUnstablePollEnd:
+		msgType = "poll end"
+	case event.StateRoomName, event.StateTopic, event.StateRoomAvatar:
+		msgType = "room metadata change"
+	case event.StatePinnedEvents:
+		msgType = "pin change"
+	case event.StateMember:
+		msgType = "membership change"
 	default:
 		msgType = "unknown event"
 	}
@@ -1498,7 +1741,9 @@ func (portal *Portal) convertReplyMessageToEmbed(eventID id.EventID, url string)
 }
 
 func (portal *Portal) RefererOpt(threadID string) discordgo.RequestOption {
-	if threadID != "" && threadID != portal.Key.ChannelID {
+	if portal.IsThread() {
+		return discordgo.WithThreadReferer(portal.GuildID, portal.ParentID, portal.Key.ChannelID)
+	} else if threadID != "" && threadID != portal.Key.ChannelID {
 		return discordgo.WithThreadReferer(portal.GuildID, portal.Key.ChannelID, threadID)
 	}
 	return discordgo.WithChannelReferer(portal.GuildID, portal.Key.ChannelID)
@@ -1511,6 +1756,9 @@ func (portal *Portal) RefererOptIfUser(sess *discordgo.Session, threadID string)
 	return []discordgo.RequestOption{portal.RefererOpt(threadID)}
 }
 
+// msgTypeDiscordSticker is used internally for Matrix stickers that can be sent to Discord by ID.
+const msgTypeDiscordSticker event.MessageType = "fi.mau.discord.sticker"
+
 func (portal *Portal) handleMatrixMessage(sender *User, evt *event.Event) {
 	if portal.IsPrivateChat() && sender.DiscordID != portal.Key.Receiver {
 		go portal.sendMessageMetrics(evt, errUserNotReceiver, "Ignoring")
@@ -1535,7 +1783,7 @@ func (portal *Portal) handleMatrixMessage(sender *User, evt *event.Event) {
 	if editMXID := content.GetRelatesTo().GetReplaceID(); editMXID != "" && content.NewContent != nil {
 		edits := portal.bridge.DB.Message.GetByMXID(portal.Key, editMXID)
 		if edits != nil {
-			discordContent, allowedMentions := portal.parseMatrixHTML(content.NewContent)
+			discordContent, allowedMentions := portal.parseMatrixHTML(sender, content.NewContent)
 			var err error
 			var msg *discordgo.Message
 			if !isWebhookSend {
@@ -1578,12 +1826,23 @@ func (portal *Portal) handleMatrixMessage(sender *User, evt *event.Event) {
 	if threadID != "" {
 		channelID = threadID
 	}
+	createForumPost := threadID == "" && portal.IsForum()
+	if createForumPost && isWebhookSend {
+		go portal.sendMessageMetrics(evt, errCantCreateForumPost, "Dropping")
+		return
+	}
 
 	var sendReq discordgo.MessageSend
 
 	var description string
 	if evt.Type == event.EventSticker {
 		content.MsgType = event.MsgImage
+		if stickerMXC, err := content.URL.Parse(); err == nil && !isWebhookSend {
+			if stickerID := portal.getDiscordStickerByMXC(stickerMXC); stickerID != "" {
+				sendReq.StickerIDs = &[]string{stickerID}
+				content.MsgType = msgTypeDiscordSticker
+			}
+		}
 		if mimeData := mimetype.Lookup(content.Info.MimeType); mimeData != nil {
 			description = content.Body
 			content.Body = "sticker" + mimeData.Extension()
@@ -1611,7 +1870,7 @@ func (portal *Portal) handleMatrixMessage(sender *User, evt *event.Event) {
 	}
 	switch content.MsgType {
 	case event.MsgText, event.MsgEmote, event.MsgNotice:
-		sendReq.Content, sendReq.AllowedMentions = portal.parseMatrixHTML(content)
+		sendReq.Content, sendReq.AllowedMentions = portal.parseMatrixHTML(sender, content)
 		if content.MsgType == event.MsgEmote {
 			sendReq.Content = fmt.Sprintf("_%s_", sendReq.Content)
 		}
@@ -1624,7 +1883,25 @@ func (portal *Portal) handleMatrixMessage(sender *User, evt *event.Event) {
 		filename := content.Body
 		if content.FileName != "" && content.FileName != content.Body {
 			filename = content.FileName
-			sendReq.Content, sendReq.AllowedMentions = portal.parseMatrixHTML(content)
+			sendReq.Content, sendReq.AllowedMentions = portal.parseMatrixHTML(sender, content)
+		}
+		var voice *VoiceMessage
+		if content.MsgType == event.MsgAudio && isMatrixVoiceMessage(evt) && !isWebhookSend {
+			voice, err = convertMatrixVoiceMessage(portal.log.WithContext(context.Background()), evt, content, data)
+			if err != nil {
+				portal.log.Warn().Err(err).Msg("Failed to convert voice message, sending as normal file")
+			} else {
+				data = voice.Data
+				filename = voiceMessageFilename
+				if content.Info == nil {
+					content.Info = &event.FileInfo{}
+				}
+				content.Info.MimeType = voiceMessageMimeType
+				// Discord doesn't allow captions on voice messages
+				sendReq.Content = ""
+				flags := int(discordgo.MessageFlagsIsVoiceMessage)
+				sendReq.Flags = &flags
+			}
 		}
 
 		if portal.bridge.Config.Bridge.UseDiscordCDNUpload && !isWebhookSend && sess.IsUser {
@@ -1633,6 +1910,10 @@ func (portal *Portal) handleMatrixMessage(sender *User, evt *event.Event) {
 				Filename:    filename,
 				Description: description,
 			}
+			if voice != nil {
+				att.Waveform = voice.Waveform
+				att.DurationSeconds = voice.Duration
+			}
 			sendReq.Attachments = []*discordgo.MessageAttachment{att}
 			prep, err := sender.Session.ChannelAttachmentCreate(channelID, &discordgo.ReqPrepareAttachments{
 				Files: []*discordgo.FilePrepare{{
@@ -1658,7 +1939,17 @@ func (portal *Portal) handleMatrixMessage(sender *User, evt *event.Event) {
 				ContentType: content.Info.MimeType,
 				Reader:      bytes.NewReader(data),
 			}}
+			if voice != nil {
+				sendReq.Attachments = []*discordgo.MessageAttachment{{
+					ID:              "0",
+					Filename:        filename,
+					Waveform:        voice.Waveform,
+					DurationSeconds: voice.Duration,
+				}}
+			}
 		}
+	case msgTypeDiscordSticker:
+		// Stickers that came from Discord are sent by ID instead of reuploading the image
 	default:
 		go portal.sendMessageMetrics(evt, fmt.Errorf("%w %q", errUnknownMsgType, content.MsgType), "Ignoring")
 		return
@@ -1676,7 +1967,9 @@ func (portal *Portal) handleMatrixMessage(sender *User, evt *event.Event) {
 	sendReq.Nonce = generateNonce()
 	var msg *discordgo.Message
 	var err error
-	if !isWebhookSend {
+	if createForumPost {
+		msg, err = portal.createForumPost(sender, content, &sendReq)
+	} else if !isWebhookSend {
 		msg, err = sess.ChannelMessageSendComplex(channelID, &sendReq, portal.RefererOptIfUser(sess, threadID)...)
 	} else {
 		username, avatarURL := portal.getRelayUserMeta(sender)
@@ -1709,6 +2002,9 @@ func (portal *Portal) handleMatrixMessage(sender *User, evt *event.Event) {
 		dbMsg.Timestamp, _ = discordgo.SnowflakeTimestamp(msg.ID)
 		dbMsg.ThreadID = threadID
 		dbMsg.Insert()
+		if createForumPost {
+			portal.forumPostFound(portal.log.WithContext(context.Background()), dbMsg, msg.ID)
+		}
 	}
 }
 
@@ -1729,13 +2025,115 @@ func (portal *Portal) HandleMatrixLeave(brSender bridge.User) {
 		portal.log.Debug().Msg("User left private chat portal, cleaning up and deleting...")
 		portal.cleanup(false)
 		portal.RemoveMXID()
-	} else {
-		portal.cleanupIfEmpty()
+		return
+	} else if portal.Type == discordgo.ChannelTypeGroupDM && sender.Session != nil {
+		portal.log.Debug().Str("user_id", sender.MXID.String()).Msg("User left group DM portal, leaving group DM on Discord")
+		_, err := sender.Session.ChannelDelete(portal.Key.ChannelID, portal.RefererOptIfUser(sender.Session, "")...)
+		if err != nil {
+			go portal.sendMembershipMetrics(sender.MXID, err, "Error sending")
+		}
+	}
+	portal.cleanupIfEmpty()
+}
+
+func (portal *Portal) HandleMatrixKick(brSender bridge.User, brTarget bridge.Ghost) {
+	sender := brSender.(*User)
+	target := brTarget.(*Puppet)
+	log := portal.log.With().
+		Str("action", "matrix kick").
+		Str("sender", sender.MXID.String()).
+		Str("target_id", target.ID).
+		Logger()
+	if portal.Type == discordgo.ChannelTypeDM {
+		return
+	} else if sender.Session == nil {
+		go portal.sendMembershipMetrics(target.MXID, errCantChangeMembers, "Ignoring")
+		return
 	}
+	var err error
+	switch portal.Type {
+	case discordgo.ChannelTypeGroupDM:
+		log.Debug().Msg("Removing recipient from group DM")
+		err = portal.editGroupDMRecipient(sender.Session, http.MethodDelete, target.ID)
+	default:
+		var perms int64
+		perms, err = sender.Session.State.UserChannelPermissions(sender.DiscordID, portal.Key.ChannelID)
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to get permissions to check if user can kick")
+			err = errNoKickPermission
+		} else if perms&discordgo.PermissionKickMembers == 0 {
+			err = errNoKickPermission
+		} else {
+			log.Debug().Msg("Kicking member from guild")
+			err = sender.Session.GuildMemberDelete(portal.GuildID, target.ID, portal.RefererOptIfUser(sender.Session, "")...)
+		}
+	}
+	go portal.sendMembershipMetrics(target.MXID, err, "Error sending")
 }
 
-func (portal *Portal) HandleMatrixKick(brSender bridge.User, brTarget bridge.Ghost)   {}
-func (portal *Portal) HandleMatrixInvite(brSender bridge.User, brTarget bridge.Ghost) {}
+func (portal *Portal) HandleMatrixInvite(brSender bridge.User, brTarget bridge.Ghost) {
+	sender := brSender.(*User)
+	target := brTarget.(*Puppet)
+	log := portal.log.With().
+		Str("action", "matrix invite").
+		Str("sender", sender.MXID.String()).
+		Str("target_id", target.ID).
+		Logger()
+	var err error
+	switch {
+	case portal.Type == discordgo.ChannelTypeDM:
+		return
+	case sender.Session == nil:
+		err = errCantChangeMembers
+	case portal.Type == discordgo.ChannelTypeGroupDM:
+		log.Debug().Msg("Adding recipient to group DM")
+		err = portal.editGroupDMRecipient(sender.Session, http.MethodPut, target.ID)
+	default:
+		err = errCantInviteToGuild
+	}
+	if err == nil {
+		err = target.IntentFor(portal).EnsureJoined(portal.MXID)
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to add ghost to room after adding recipient")
+			err = nil
+		}
+	} else if _, leaveErr := target.DefaultIntent().LeaveRoom(portal.MXID); leaveErr != nil {
+		log.Warn().Err(leaveErr).Msg("Failed to reject invite after failing to add recipient")
+	}
+	go portal.sendMembershipMetrics(target.MXID, err, "Error sending")
+}
+
+func (portal *Portal) editGroupDMRecipient(sess *discordgo.Session, method, userID string) error {
+	endpoint := discordgo.EndpointChannel(portal.Key.ChannelID) + "/recipients/" + userID
+	_, err := sess.RequestWithBucketID(method, endpoint, nil, discordgo.EndpointChannel(portal.Key.ChannelID)+"/recipients", portal.RefererOptIfUser(sess, "")...)
+	return err
+}
+
+// sendMembershipMetrics is sendMessageMetrics for membership actions.
+// The bridge module doesn't pass the member event to the portal, so the current member event of the target is fetched.
+// The standard state endpoint only returns the content, format=event asks for the whole event to get the event ID.
+func (portal *Portal) sendMembershipMetrics(userID id.UserID, err error, part string) {
+	intent := portal.MainIntent()
+	url := intent.BuildURLWithQuery(mautrix.ClientURLPath{"v3", "rooms", portal.MXID, "state", event.StateMember.String(), userID.String()}, map[string]string{
+		"format": "event",
+	})
+	var evt event.Event
+	_, fetchErr := intent.MakeRequest(http.MethodGet, url, nil, &evt)
+	if fetchErr != nil {
+		portal.log.Warn().Err(fetchErr).
+			AnErr("action_error", err).
+			Str("user_id", userID.String()).
+			Msg("Failed to get member event for membership action")
+		return
+	} else if evt.ID == "" {
+		portal.log.Warn().
+			AnErr("action_error", err).
+			Str("user_id", userID.String()).
+			Msg("Homeserver didn't return the full member event for membership action")
+		return
+	}
+	portal.sendMessageMetrics(&evt, err, part)
+}
 
 func (portal *Portal) Delete() {
 	portal.Portal.Delete()
@@ -1765,6 +2163,15 @@ func (portal *Portal) cleanupIfEmpty() {
 	}
 }
 
+// Unbridge unlinks the Matrix room from the channel. If deleteRoom is set, Matrix users are also kicked from the room.
+func (portal *Portal) Unbridge(deleteRoom bool) {
+	portal.roomCreateLock.Lock()
+	defer portal.roomCreateLock.Unlock()
+	portal.removeFromSpace()
+	portal.cleanup(!deleteRoom)
+	portal.RemoveMXID()
+}
+
 func (portal *Portal) RemoveMXID() {
 	portal.bridge.portalsLock.Lock()
 	defer portal.bridge.portalsLock.Unlock()
@@ -1902,13 +2309,14 @@ func (portal *Portal) handleMatrixReaction(sender *User, evt *event.Event) {
 	emojiID := reaction.RelatesTo.Key
 	if strings.HasPrefix(emojiID, "mxc://") {
 		uri, _ := id.ParseContentURI(emojiID)
-		emojiInfo := portal.bridge.DMA.GetEmojiInfo(uri)
-		if emojiInfo != nil {
-			emojiID = fmt.Sprintf("%s:%d", emojiInfo.Name, emojiInfo.EmojiID)
-		} else if emojiFile := portal.bridge.DB.File.GetEmojiByMXC(uri); emojiFile != nil && emojiFile.ID != "" && emojiFile.EmojiName != "" {
-			emojiID = fmt.Sprintf("%s:%s", emojiFile.EmojiName, emojiFile.ID)
-		} else {
-			go portal.sendMessageMetrics(evt, fmt.Errorf("%w %s", errUnknownEmoji, emojiID), "Ignoring")
+		shortcode, _ := evt.Content.Raw["shortcode"].(string)
+		if shortcode == "" {
+			shortcode, _ = evt.Content.Raw["com.beeper.reaction.shortcode"].(string)
+		}
+		var err error
+		emojiID, _, err = portal.getDiscordEmojiByMXC(sender, uri, shortcode)
+		if err != nil {
+			go portal.sendMessageMetrics(evt, err, "Ignoring")
 			return
 		}
 	} else {
@@ -2115,6 +2523,8 @@ func (portal *Portal) HandleMatrixReadReceipt(brUser bridge.User, eventID id.Eve
 			log.Debug().Msg("Dropping read receipt for thread creation notice")
 			return
 		}
+	} else if portal.IsThread() && portal.bridge.Config.Bridge.AutojoinThreadOnOpen {
+		portal.JoinThread(sender)
 	}
 	if !sender.Session.IsUser {
 		// Drop read receipts from bot users (after checking for the thread auto-join stuff)
@@ -2317,6 +2727,133 @@ func (portal *Portal) updateRoomTopic() {
 	}
 }
 
+func (portal *Portal) HandleMatrixMeta(brSender bridge.User, evt *event.Event) {
+	if brSender.GetPermissionLevel() >= bridgeconfig.PermissionLevelUser {
+		portal.matrixMessages <- portalMatrixMessage{user: brSender.(*User), evt: evt}
+	}
+}
+
+func (portal *Portal) handleMatrixMeta(sender *User, evt *event.Event) {
+	if sender.Session == nil {
+		go portal.sendMessageMetrics(evt, errCantEditMeta, "Ignoring")
+		return
+	}
+	var err error
+	switch content := evt.Content.Parsed.(type) {
+	case *event.RoomNameEventContent:
+		err = portal.setDiscordName(sender, content.Name)
+	case *event.TopicEventContent:
+		err = portal.setDiscordTopic(sender, content.Topic)
+	case *event.RoomAvatarEventContent:
+		err = portal.setDiscordAvatar(sender, content.URL)
+	default:
+		err = fmt.Errorf("%w %T", errUnexpectedParsedContentType, evt.Content.Parsed)
+	}
+	if err == nil {
+		portal.UpdateBridgeInfo()
+		portal.Update()
+	}
+	go portal.sendMessageMetrics(evt, err, "Error sending")
+}
+
+// editDiscordChannel sends a raw channel edit request. discordgo.ChannelEdit can't be used,
+// because it omits empty values (which are needed to clear the topic) and doesn't have the group DM icon field.
+func (portal *Portal) editDiscordChannel(sess *discordgo.Session, data map[string]any) (*discordgo.Channel, error) {
+	endpoint := discordgo.EndpointChannel(portal.Key.ChannelID)
+	resp, err := sess.RequestWithBucketID(http.MethodPatch, endpoint, data, endpoint, portal.RefererOptIfUser(sess, "")...)
+	if err != nil {
+		return nil, err
+	}
+	var channel discordgo.Channel
+	err = json.Unmarshal(resp, &channel)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse edited channel: %w", err)
+	}
+	return &channel, nil
+}
+
+func (portal *Portal) setDiscordName(sender *User, name string) error {
+	if portal.IsPrivateChat() {
+		return errUnsupportedMeta
+	} else if portal.Name == name {
+		return nil
+	}
+	var parentName, guildName string
+	if portal.Parent != nil {
+		parentName = portal.Parent.PlainName
+	}
+	if portal.Guild != nil {
+		guildName = portal.Guild.PlainName
+	}
+	// The room name is generated with channel_name_template, so strip the template (e.g. the # prefix) before sending it to Discord
+	plainName := portal.bridge.Config.Bridge.ParseChannelName(name, config.ChannelNameParams{
+		ParentName: parentName,
+		GuildName:  guildName,
+		Type:       portal.Type,
+	})
+	if plainName == "" {
+		return errUnsupportedMeta
+	} else if plainName == portal.PlainName {
+		portal.Name = name
+		portal.NameSet = true
+		return nil
+	}
+	ch, err := portal.editDiscordChannel(sender.Session, map[string]any{"name": plainName})
+	if err != nil {
+		return err
+	}
+	// Mark the Matrix name as already set, so that the echo from Discord is only bridged
+	// back if Discord normalized the name (e.g. lowercased it) or the name template changes it.
+	portal.Name = name
+	portal.NameSet = true
+	portal.UpdateName(ch)
+	return nil
+}
+
+func (portal *Portal) setDiscordTopic(sender *User, topic string) error {
+	if portal.Topic == topic {
+		return nil
+	} else if portal.Type == discordgo.ChannelTypeGroupDM {
+		return errUnsupportedMeta
+	}
+	ch, err := portal.editDiscordChannel(sender.Session, map[string]any{"topic": topic})
+	if err != nil {
+		return err
+	}
+	portal.Topic = topic
+	portal.TopicSet = true
+	portal.UpdateTopic(ch.Topic)
+	return nil
+}
+
+func (portal *Portal) setDiscordAvatar(sender *User, mxc id.ContentURI) error {
+	if portal.Type != discordgo.ChannelTypeGroupDM {
+		return errUnsupportedMeta
+	} else if mxc == portal.AvatarURL {
+		return nil
+	}
+	var icon any
+	if !mxc.IsEmpty() {
+		data, err := portal.MainIntent().DownloadBytes(mxc)
+		if err != nil {
+			return fmt.Errorf("failed to download avatar: %w", err)
+		}
+		icon = fmt.Sprintf("data:%s;base64,%s", mimetype.Detect(data).String(), base64.StdEncoding.EncodeToString(data))
+	}
+	ch, err := portal.editDiscordChannel(sender.Session, map[string]any{"icon": icon})
+	if err != nil {
+		return err
+	}
+	portal.log.Debug().
+		Str("old_avatar_id", portal.Avatar).
+		Str("new_avatar_id", ch.Icon).
+		Msg("Changed group DM avatar from Matrix")
+	portal.Avatar = ch.Icon
+	portal.AvatarURL = mxc
+	portal.AvatarSet = true
+	return nil
+}
+
 func (portal *Portal) removeFromSpace() {
 	if portal.InSpace == "" {
 		return
@@ -2365,7 +2902,7 @@ func (portal *Portal) addToSpace(mxid id.RoomID) bool {
 	return true
 }
 
-func (portal *Portal) UpdateParent(parentID string) bool {
+func (portal *Portal) UpdateParent(source *User, parentID string) bool {
 	if portal.ParentID == parentID {
 		return false
 	}
@@ -2375,7 +2912,17 @@ func (portal *Portal) UpdateParent(parentID string) bool {
 		Msg("Updating parent ID")
 	portal.ParentID = parentID
 	if portal.ParentID != "" {
-		portal.Parent = portal.bridge.GetPortalByID(database.NewPortalKey(parentID, ""), discordgo.ChannelTypeGuildCategory)
+		parentType := discordgo.ChannelTypeGuildCategory
+		if portal.IsThread() {
+			// Threads can be in text, announcement and forum channels, so the real type is only known from the state cache
+			parentType = discordgo.ChannelTypeGuildText
+			if source != nil && source.Session != nil {
+				if parent, err := source.Session.State.Channel(parentID); err == nil {
+					parentType = parent.Type
+				}
+			}
+		}
+		portal.Parent = portal.bridge.GetPortalByID(database.NewPortalKey(parentID, ""), parentType)
 	} else {
 		portal.Parent = nil
 	}
@@ -2383,7 +2930,10 @@ func (portal *Portal) UpdateParent(parentID string) bool {
 }
 
 func (portal *Portal) ExpectedSpaceID() id.RoomID {
-	if portal.Parent != nil {
+	if portal.IsThread() && portal.Parent != nil {
+		// Thread rooms are placed next to their parent channel rather than inside it
+		return portal.Parent.ExpectedSpaceID()
+	} else if portal.Parent != nil {
 		return portal.Parent.MXID
 	} else if portal.Guild != nil {
 		return portal.Guild.MXID
@@ -2395,7 +2945,12 @@ func (portal *Portal) updateSpace(source *User) bool {
 	if portal.MXID == "" {
 		return false
 	}
-	if portal.Parent != nil {
+	if portal.IsThread() {
+		if spaceID := portal.ExpectedSpaceID(); spaceID != "" {
+			return portal.addToSpace(spaceID)
+		}
+		return false
+	} else if portal.Parent != nil {
 		if portal.Parent.MXID != "" {
 			portal.log.Warn().Str("parent_id", portal.ParentID).Msg("Parent portal has no Matrix room, creating...")
 			err := portal.Parent.CreateMatrixRoom(source, nil)
@@ -2467,7 +3022,7 @@ func (portal *Portal) UpdateInfo(source *User, meta *discordgo.Channel) *discord
 		if portal.OtherUserID != "" {
 			puppet := portal.bridge.GetPuppetByID(portal.OtherUserID)
 			changed = portal.UpdateAvatarFromPuppet(puppet) || changed
-			if rel, ok := source.relationships[portal.OtherUserID]; ok && rel.Nickname != "" {
+			if rel := source.getRelationship(portal.OtherUserID); rel != nil && rel.Nickname != "" {
 				portal.FriendNick = true
 				changed = portal.UpdateNameDirect(rel.Nickname, true) || changed
 			} else {
@@ -2491,11 +3046,12 @@ func (portal *Portal) UpdateInfo(source *User, meta *discordgo.Channel) *discord
 		}
 	}
 	changed = portal.UpdateTopic(meta.Topic) || changed
-	changed = portal.UpdateParent(meta.ParentID) || changed
+	changed = portal.UpdateParent(source, meta.ParentID) || changed
 	// Private channels are added to the space in User.handlePrivateChannel
 	if portal.GuildID != "" && portal.MXID != "" && portal.ExpectedSpaceID() != portal.InSpace {
 		changed = portal.updateSpace(source) || changed
 	}
+	portal.schedulePowerLevelUpdate(source, meta)
 	if changed {
 		portal.UpdateBridgeInfo()
 		portal.Update()
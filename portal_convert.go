@@ -102,17 +102,8 @@ func (portal *Portal) cleanupConvertedStickerInfo(content *event.MessageEventCon
 }
 
 func (portal *Portal) convertDiscordSticker(ctx context.Context, intent *appservice.IntentAPI, sticker *discordgo.StickerItem) *ConvertedMessage {
-	var mime string
-	switch sticker.FormatType {
-	case discordgo.StickerFormatTypePNG:
-		mime = "image/png"
-	case discordgo.StickerFormatTypeAPNG:
-		mime = "image/apng"
-	case discordgo.StickerFormatTypeLottie:
-		mime = "application/json"
-	case discordgo.StickerFormatTypeGIF:
-		mime = "image/gif"
-	default:
+	mime := stickerMimeType(sticker.FormatType)
+	if mime == "" {
 		zerolog.Ctx(ctx).Warn().
 			Int("sticker_format", int(sticker.FormatType)).
 			Str("sticker_id", sticker.ID).
@@ -163,13 +154,8 @@ func (portal *Portal) convertDiscordAttachment(ctx context.Context, intent *apps
 	case "audio":
 		content.MsgType = event.MsgAudio
 		if att.Waveform != nil {
-			// TODO convert waveform
-			extra = map[string]any{
-				"org.matrix.1767.audio": map[string]any{
-					"duration": int(att.DurationSeconds * 1000),
-				},
-				"org.matrix.msc3245.voice": map[string]any{},
-			}
+			content.Info.Duration = int(att.DurationSeconds * 1000)
+			extra = convertDiscordVoiceMeta(att)
 		}
 	case "image":
 		content.MsgType = event.MsgImage
@@ -178,7 +164,11 @@ func (portal *Portal) convertDiscordAttachment(ctx context.Context, intent *apps
 	default:
 		content.MsgType = event.MsgFile
 	}
-	mxc := portal.bridge.DMA.AttachmentMXC(portal.Key.ChannelID, messageID, att)
+	var mxc id.ContentURI
+	// Attachments without a message ID (e.g. in forward snapshots) can't be refreshed via direct media
+	if messageID != "" {
+		mxc = portal.bridge.DMA.AttachmentMXC(portal.Key.ChannelID, messageID, att)
+	}
 	if mxc.IsEmpty() {
 		content = portal.convertDiscordFile(ctx, "attachment", intent, att.ID, att.URL, content)
 	} else {
@@ -268,6 +258,12 @@ func (portal *Portal) convertDiscordVideoEmbed(ctx context.Context, intent *apps
 }
 
 func (portal *Portal) convertDiscordMessage(ctx context.Context, puppet *Puppet, intent *appservice.IntentAPI, msg *discordgo.Message) []*ConvertedMessage {
+	if msg.Type == messageTypePollResult {
+		part := portal.convertDiscordPollResult(ctx, msg)
+		puppet.addWebhookMeta(part, msg)
+		puppet.addMemberMeta(part, msg)
+		return []*ConvertedMessage{part}
+	}
 	predictedLength := len(msg.Attachments) + len(msg.StickerItems)
 	if msg.Content != "" {
 		predictedLength++
@@ -318,6 +314,9 @@ func (portal *Portal) convertDiscordMessage(ctx context.Context, puppet *Puppet,
 			parts = append(parts, part)
 		}
 	}
+	if msg.Poll != nil {
+		parts = append(parts, portal.convertDiscordPoll(msg.Poll))
+	}
 	if len(parts) == 0 && msg.Thread != nil {
 		parts = append(parts, &ConvertedMessage{Type: event.EventMessage, Content: &event.MessageEventContent{
 			MsgType: event.MsgText,
@@ -342,10 +341,10 @@ func (puppet *Puppet) addMemberMeta(part *ConvertedMessage, msg *discordgo.Messa
 	var discordAvatarURL string
 	if msg.Member.Avatar != "" {
 		var err error
-		avatarURL, discordAvatarURL, err = puppet.bridge.reuploadUserAvatar(puppet.DefaultIntent(), msg.GuildID, msg.Author.ID, msg.Author.Avatar)
+		avatarURL, discordAvatarURL, err = puppet.bridge.reuploadUserAvatar(puppet.DefaultIntent(), msg.GuildID, msg.Author.ID, msg.Member.Avatar)
 		if err != nil {
 			puppet.log.Warn().Err(err).
-				Str("avatar_id", msg.Author.Avatar).
+				Str("avatar_id", msg.Member.Avatar).
 				Msg("Failed to reupload guild user avatar")
 		}
 	}
@@ -585,7 +584,122 @@ const msgInteractionTemplateHTML = `<blockquote>
 <a href="https://matrix.to/#/%s">%s</a> used <font color="#3771bb">/%s</font>
 </blockquote>`
 
-const msgComponentTemplateHTML = `<p>This message contains interactive elements. Use the Discord app to interact with the message.</p>`
+const msgComponentTemplateHTML = `<p>This message contains interactive elements. Reply with <code>%s click &lt;number&gt;</code> to use them.</p>`
+
+// DiscordComponentOption is a single button or select menu option in a Discord message.
+// Options that can be clicked from Matrix have a non-zero Index.
+type DiscordComponentOption struct {
+	Index         int                     `json:"index,omitempty"`
+	ComponentType discordgo.ComponentType `json:"component_type"`
+	CustomID      string                  `json:"custom_id,omitempty"`
+	Label         string                  `json:"label"`
+	Value         string                  `json:"value,omitempty"`
+	URL           string                  `json:"url,omitempty"`
+	Disabled      bool                    `json:"disabled,omitempty"`
+
+	// Menu is the placeholder of the select menu the option belongs to.
+	Menu string `json:"menu,omitempty"`
+}
+
+func componentLabel(label string, emoji *discordgo.ComponentEmoji) string {
+	if emoji != nil && emoji.ID == "" && emoji.Name != "" {
+		if label == "" {
+			return emoji.Name
+		}
+		return emoji.Name + " " + label
+	}
+	return label
+}
+
+// flattenDiscordComponents lists all buttons and select menu options in the given components.
+// The numbering is stable for a given message, so it can be used to refer to options from Matrix.
+func flattenDiscordComponents(components []discordgo.MessageComponent) []*DiscordComponentOption {
+	var options []*DiscordComponentOption
+	nextIndex := 1
+	add := func(opt *DiscordComponentOption) {
+		if !opt.Disabled && opt.URL == "" && opt.CustomID != "" {
+			opt.Index = nextIndex
+			nextIndex++
+		}
+		options = append(options, opt)
+	}
+	var walk func(components []discordgo.MessageComponent)
+	walk = func(components []discordgo.MessageComponent) {
+		for _, component := range components {
+			switch typed := component.(type) {
+			case *discordgo.ActionsRow:
+				walk(typed.Components)
+			case *discordgo.Button:
+				add(&DiscordComponentOption{
+					ComponentType: discordgo.ButtonComponent,
+					CustomID:      typed.CustomID,
+					Label:         componentLabel(typed.Label, typed.Emoji),
+					URL:           typed.URL,
+					Disabled:      typed.Disabled,
+				})
+			case *discordgo.SelectMenu:
+				if typed.Type() != discordgo.SelectMenuComponent {
+					// User, role, channel and mentionable menus don't have static options.
+					options = append(options, &DiscordComponentOption{
+						ComponentType: typed.Type(),
+						Label:         "(not supported)",
+						Disabled:      true,
+						Menu:          typed.Placeholder,
+					})
+					continue
+				}
+				for _, selectOpt := range typed.Options {
+					add(&DiscordComponentOption{
+						ComponentType: discordgo.SelectMenuComponent,
+						CustomID:      typed.CustomID,
+						Label:         componentLabel(selectOpt.Label, selectOpt.Emoji),
+						Value:         selectOpt.Value,
+						Disabled:      typed.Disabled,
+						Menu:          typed.Placeholder,
+					})
+				}
+			}
+		}
+	}
+	walk(components)
+	return options
+}
+
+func (portal *Portal) renderDiscordComponents(options []*DiscordComponentOption) string {
+	var htmlParts []string
+	var currentMenu string
+	inMenu := false
+	for _, opt := range options {
+		isMenuOption := opt.ComponentType != discordgo.ButtonComponent
+		if inMenu && (!isMenuOption || opt.Menu != currentMenu) {
+			htmlParts = append(htmlParts, "</ul></li>")
+			inMenu = false
+		}
+		if isMenuOption && !inMenu {
+			menuName := opt.Menu
+			if menuName == "" {
+				menuName = "Select menu"
+			}
+			htmlParts = append(htmlParts, fmt.Sprintf("<li>%s<ul>", html.EscapeString(menuName)))
+			currentMenu = opt.Menu
+			inMenu = true
+		}
+		label := html.EscapeString(opt.Label)
+		switch {
+		case opt.URL != "":
+			htmlParts = append(htmlParts, fmt.Sprintf(`<li><a href="%s">%s</a></li>`, html.EscapeString(opt.URL), label))
+		case opt.Index == 0:
+			htmlParts = append(htmlParts, fmt.Sprintf("<li><del>%s</del></li>", label))
+		default:
+			htmlParts = append(htmlParts, fmt.Sprintf("<li><strong>%d.</strong> %s</li>", opt.Index, label))
+		}
+	}
+	if inMenu {
+		htmlParts = append(htmlParts, "</ul></li>")
+	}
+	return fmt.Sprintf(msgComponentTemplateHTML, html.EscapeString(portal.bridge.Config.Bridge.CommandPrefix)) +
+		"<ul>" + strings.Join(htmlParts, "") + "</ul>"
+}
 
 type BridgeEmbedType int
 
@@ -705,8 +819,10 @@ func (portal *Portal) convertDiscordTextMessage(ctx context.Context, intent *app
 		}
 	}
 
+	var components []*DiscordComponentOption
 	if len(msg.Components) > 0 {
-		htmlParts = append(htmlParts, msgComponentTemplateHTML)
+		components = flattenDiscordComponents(msg.Components)
+		htmlParts = append(htmlParts, portal.renderDiscordComponents(components))
 	}
 
 	if len(htmlParts) == 0 {
@@ -722,6 +838,9 @@ func (portal *Portal) convertDiscordTextMessage(ctx context.Context, intent *app
 	extraContent := map[string]any{
 		"com.beeper.linkpreviews": previews,
 	}
+	if len(components) > 0 {
+		extraContent["fi.mau.discord.components"] = components
+	}
 
 	if msg.WebhookID != "" && msg.ApplicationID == "" && portal.bridge.Config.Bridge.PrefixWebhookMessages {
 		content.EnsureHasHTML()
@@ -0,0 +1,232 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-discord/database"
+)
+
+const (
+	// Admins are kept below the bridge bot's level, so that the bridge can still demote them.
+	powerLevelAdmin     = 95
+	powerLevelModerator = 50
+	// powerLevelCanSend is used as events_default in channels where @everyone can't send messages.
+	powerLevelCanSend = 10
+)
+
+// Power level updates are delayed, so that bursts of channel, role and member updates only cause one recompute per portal.
+const powerLevelUpdateDelay = 5 * time.Second
+
+// channelPermissions computes the permissions of a guild member in a channel.
+// It's the same as discordgo's internal memberPermissions, except that roles are read from the database.
+func channelPermissions(ownerID string, roles []*database.Role, channel *discordgo.Channel, userID string, memberRoles []string) (perms int64) {
+	if userID != "" && userID == ownerID {
+		return discordgo.PermissionAll
+	}
+	for _, role := range roles {
+		if role.ID == channel.GuildID {
+			perms |= role.Permissions
+			break
+		}
+	}
+	for _, role := range roles {
+		for _, roleID := range memberRoles {
+			if role.ID == roleID {
+				perms |= role.Permissions
+				break
+			}
+		}
+	}
+	if perms&discordgo.PermissionAdministrator != 0 {
+		return discordgo.PermissionAll
+	}
+
+	for _, overwrite := range channel.PermissionOverwrites {
+		if overwrite.ID == channel.GuildID {
+			perms &^= overwrite.Deny
+			perms |= overwrite.Allow
+			break
+		}
+	}
+	var denies, allows int64
+	for _, overwrite := range channel.PermissionOverwrites {
+		if overwrite.Type != discordgo.PermissionOverwriteTypeRole {
+			continue
+		}
+		for _, roleID := range memberRoles {
+			if overwrite.ID == roleID {
+				denies |= overwrite.Deny
+				allows |= overwrite.Allow
+				break
+			}
+		}
+	}
+	perms &^= denies
+	perms |= allows
+	for _, overwrite := range channel.PermissionOverwrites {
+		if overwrite.Type == discordgo.PermissionOverwriteTypeMember && overwrite.ID == userID {
+			perms &^= overwrite.Deny
+			perms |= overwrite.Allow
+			break
+		}
+	}
+	return
+}
+
+// permissionsToPowerLevel maps the channel permissions of a member to a power level.
+// It must only be used for members who can view the channel, others aren't in the room at all.
+func permissionsToPowerLevel(perms int64, eventsDefault int) int {
+	switch {
+	case perms&discordgo.PermissionAdministrator != 0:
+		return powerLevelAdmin
+	case perms&discordgo.PermissionManageMessages != 0:
+		return powerLevelModerator
+	case perms&discordgo.PermissionSendMessages != 0:
+		return eventsDefault
+	case eventsDefault > 0:
+		return 0
+	default:
+		return -1
+	}
+}
+
+// schedulePowerLevelUpdate recomputes the power levels of the portal after a short delay.
+// The most recent source user and channel info are used if multiple updates are scheduled before the delay runs out.
+func (portal *Portal) schedulePowerLevelUpdate(source *User, channel *discordgo.Channel) {
+	if portal.MXID == "" || portal.GuildID == "" || portal.Type == discordgo.ChannelTypeGuildCategory || source.Session == nil {
+		return
+	}
+	portal.powerLevelLock.Lock()
+	defer portal.powerLevelLock.Unlock()
+	portal.powerLevelSource = source
+	if channel != nil {
+		portal.powerLevelChannel = channel
+	}
+	if portal.powerLevelTimer != nil {
+		return
+	}
+	portal.powerLevelTimer = time.AfterFunc(powerLevelUpdateDelay, func() {
+		portal.powerLevelLock.Lock()
+		source, channel := portal.powerLevelSource, portal.powerLevelChannel
+		portal.powerLevelTimer = nil
+		portal.powerLevelSource = nil
+		portal.powerLevelChannel = nil
+		portal.powerLevelLock.Unlock()
+		portal.updatePowerLevels(source, channel)
+	})
+}
+
+func (portal *Portal) updatePowerLevels(source *User, channel *discordgo.Channel) {
+	if portal.MXID == "" || portal.GuildID == "" || portal.Type == discordgo.ChannelTypeGuildCategory || source.Session == nil {
+		return
+	}
+	log := portal.log.With().
+		Str("action", "update power levels").
+		Str("through_user_mxid", source.MXID.String()).
+		Logger()
+	guild, err := source.Session.State.Guild(portal.GuildID)
+	if err != nil {
+		log.Debug().Err(err).Msg("Guild not in state cache, not updating power levels")
+		return
+	}
+	if channel == nil {
+		channel, err = source.Session.State.Channel(portal.Key.ChannelID)
+		if err != nil {
+			log.Debug().Err(err).Msg("Channel not in state cache, not updating power levels")
+			return
+		}
+	}
+	if channel.IsThread() {
+		// Threads don't have permission overwrites of their own, they inherit them from the parent channel
+		parent, err := source.Session.State.Channel(channel.ParentID)
+		if err != nil {
+			log.Debug().Err(err).Msg("Thread parent channel not in state cache, not updating power levels")
+			return
+		}
+		channel = parent
+	}
+	roles := portal.bridge.DB.Role.GetAll(portal.GuildID)
+
+	eventsDefault := 0
+	if channelPermissions(guild.OwnerID, roles, channel, "", nil)&discordgo.PermissionSendMessages == 0 {
+		eventsDefault = powerLevelCanSend
+	}
+	levels := make(map[id.UserID]int)
+	// Members who can't view the channel only get their old entries removed, so that the power level event
+	// doesn't grow with every cached member of large guilds.
+	hidden := make(map[id.UserID]struct{})
+	for _, member := range guild.Members {
+		if member.User == nil {
+			continue
+		}
+		userIDs := []id.UserID{portal.bridge.FormatPuppetMXID(member.User.ID)}
+		if user := portal.bridge.GetCachedUserByID(member.User.ID); user != nil {
+			userIDs = append(userIDs, user.MXID)
+		}
+		perms := channelPermissions(guild.OwnerID, roles, channel, member.User.ID, member.Roles)
+		if perms&discordgo.PermissionViewChannel == 0 {
+			for _, userID := range userIDs {
+				hidden[userID] = struct{}{}
+			}
+			continue
+		}
+		level := permissionsToPowerLevel(perms, eventsDefault)
+		for _, userID := range userIDs {
+			levels[userID] = level
+		}
+	}
+
+	pl, err := portal.MainIntent().PowerLevels(portal.MXID)
+	if err != nil {
+		log.Err(err).Msg("Failed to get current power levels")
+		return
+	}
+	pl = pl.Clone()
+	if pl.Users == nil {
+		pl.Users = make(map[id.UserID]int)
+	}
+	ownLevel := pl.GetUserLevel(portal.MainIntent().UserID)
+	changed := pl.EventsDefault != eventsDefault
+	pl.EventsDefault = eventsDefault
+	// The member list of user accounts is a partial cache that's filled lazily, so users who aren't in it are left alone.
+	for userID, level := range levels {
+		if currentLevel := pl.GetUserLevel(userID); currentLevel != level && currentLevel < ownLevel && level < ownLevel {
+			pl.SetUserLevel(userID, level)
+			changed = true
+		}
+	}
+	for userID := range hidden {
+		if _, ok := pl.Users[userID]; ok && pl.GetUserLevel(userID) < ownLevel {
+			pl.SetUserLevel(userID, pl.UsersDefault)
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	_, err = portal.MainIntent().SetPowerLevels(portal.MXID, pl)
+	if err != nil {
+		log.Err(err).Msg("Failed to update power levels")
+	} else {
+		log.Debug().Int("events_default", eventsDefault).Msg("Updated power levels")
+	}
+}
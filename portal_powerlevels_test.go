@@ -0,0 +1,109 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+
+	"go.mau.fi/mautrix-discord/database"
+)
+
+func TestChannelPermissions(t *testing.T) {
+	type permissionTest struct {
+		name        string
+		overwrites  []*discordgo.PermissionOverwrite
+		userID      string
+		memberRoles []string
+		expected    int64
+	}
+
+	const (
+		guildID = "1"
+		ownerID = "100"
+		view    = discordgo.PermissionViewChannel
+		send    = discordgo.PermissionSendMessages
+		manage  = discordgo.PermissionManageMessages
+	)
+	roles := []*database.Role{
+		{GuildID: guildID, Role: discordgo.Role{ID: guildID, Permissions: view | send}},
+		{GuildID: guildID, Role: discordgo.Role{ID: "10", Permissions: manage}},
+		{GuildID: guildID, Role: discordgo.Role{ID: "11", Permissions: discordgo.PermissionAdministrator}},
+		{GuildID: guildID, Role: discordgo.Role{ID: "12"}},
+	}
+	everyoneOverwrite := func(allow, deny int64) *discordgo.PermissionOverwrite {
+		return &discordgo.PermissionOverwrite{ID: guildID, Type: discordgo.PermissionOverwriteTypeRole, Allow: allow, Deny: deny}
+	}
+	roleOverwrite := func(roleID string, allow, deny int64) *discordgo.PermissionOverwrite {
+		return &discordgo.PermissionOverwrite{ID: roleID, Type: discordgo.PermissionOverwriteTypeRole, Allow: allow, Deny: deny}
+	}
+	memberOverwrite := func(userID string, allow, deny int64) *discordgo.PermissionOverwrite {
+		return &discordgo.PermissionOverwrite{ID: userID, Type: discordgo.PermissionOverwriteTypeMember, Allow: allow, Deny: deny}
+	}
+
+	tests := []permissionTest{
+		{"Everyone role", nil, "200", nil, view | send},
+		{"Channel default", nil, "", nil, view | send},
+		{"Member role", nil, "200", []string{"10"}, view | send | manage},
+		{"Owner", []*discordgo.PermissionOverwrite{everyoneOverwrite(0, view)}, ownerID, nil, discordgo.PermissionAll},
+		{"Administrator ignores overwrites", []*discordgo.PermissionOverwrite{everyoneOverwrite(0, view)}, "200", []string{"11"}, discordgo.PermissionAll},
+		{"Private channel", []*discordgo.PermissionOverwrite{everyoneOverwrite(0, view)}, "200", nil, send},
+		{"Role allow beats everyone deny", []*discordgo.PermissionOverwrite{everyoneOverwrite(0, view), roleOverwrite("12", view, 0)}, "200", []string{"12"}, view | send},
+		{"Role allow beats role deny", []*discordgo.PermissionOverwrite{roleOverwrite("10", 0, send), roleOverwrite("12", send, 0)}, "200", []string{"10", "12"}, view | send | manage},
+		{"Overwrite for other role", []*discordgo.PermissionOverwrite{roleOverwrite("12", 0, send)}, "200", []string{"10"}, view | send | manage},
+		{"Member deny beats role allow", []*discordgo.PermissionOverwrite{roleOverwrite("12", send, 0), memberOverwrite("200", 0, send)}, "200", []string{"12"}, view},
+		{"Member allow beats everyone deny", []*discordgo.PermissionOverwrite{everyoneOverwrite(0, view|send), memberOverwrite("200", view, 0)}, "200", nil, view},
+		{"Overwrite for other member", []*discordgo.PermissionOverwrite{memberOverwrite("300", 0, send)}, "200", nil, view | send},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			channel := &discordgo.Channel{ID: "2", GuildID: guildID, PermissionOverwrites: test.overwrites}
+			assert.Equal(t, test.expected, channelPermissions(ownerID, roles, channel, test.userID, test.memberRoles))
+		})
+	}
+}
+
+func TestPermissionsToPowerLevel(t *testing.T) {
+	type levelTest struct {
+		name          string
+		perms         int64
+		eventsDefault int
+		expected      int
+	}
+
+	const (
+		view = discordgo.PermissionViewChannel
+		send = discordgo.PermissionSendMessages
+	)
+	tests := []levelTest{
+		{"Administrator", discordgo.PermissionAll, 0, powerLevelAdmin},
+		{"Manage messages", view | discordgo.PermissionManageMessages, 0, powerLevelModerator},
+		{"Can send", view | send, 0, 0},
+		{"Can send in read-only channel", view | send, powerLevelCanSend, powerLevelCanSend},
+		{"Read-only member in read-only channel", view, powerLevelCanSend, 0},
+		{"Read-only member", view, 0, -1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, permissionsToPowerLevel(test.perms, test.eventsDefault))
+		})
+	}
+}
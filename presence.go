@@ -0,0 +1,140 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"maunium.net/go/mautrix/event"
+)
+
+type reqPresenceWithStatus struct {
+	Presence      event.Presence `json:"presence"`
+	StatusMessage string         `json:"status_msg,omitempty"`
+}
+
+func discordStatusToMatrix(status discordgo.Status) event.Presence {
+	switch status {
+	case discordgo.StatusOnline:
+		return event.PresenceOnline
+	case discordgo.StatusIdle, discordgo.StatusDoNotDisturb:
+		return event.PresenceUnavailable
+	default:
+		return event.PresenceOffline
+	}
+}
+
+func matrixPresenceToDiscord(presence event.Presence) discordgo.Status {
+	switch presence {
+	case event.PresenceOnline:
+		return discordgo.StatusOnline
+	case event.PresenceUnavailable:
+		return discordgo.StatusIdle
+	default:
+		return discordgo.StatusInvisible
+	}
+}
+
+func getCustomStatus(activities []*discordgo.Activity) string {
+	for _, activity := range activities {
+		if activity.Type != discordgo.ActivityTypeCustom {
+			continue
+		}
+		parts := make([]string, 0, 2)
+		if activity.Emoji.ID == "" && activity.Emoji.Name != "" {
+			parts = append(parts, activity.Emoji.Name)
+		}
+		if activity.State != "" {
+			parts = append(parts, activity.State)
+		}
+		return strings.Join(parts, " ")
+	}
+	return ""
+}
+
+func (puppet *Puppet) UpdatePresence(presence *discordgo.Presence) {
+	if !puppet.bridge.Config.Bridge.PresenceFromDiscord {
+		return
+	}
+	newPresence := discordStatusToMatrix(presence.Status)
+	newStatusMsg := getCustomStatus(presence.Activities)
+
+	puppet.syncLock.Lock()
+	defer puppet.syncLock.Unlock()
+	if puppet.lastPresence == newPresence && puppet.lastStatusMsg == newStatusMsg {
+		return
+	}
+	intent := puppet.DefaultIntent()
+	req := reqPresenceWithStatus{Presence: newPresence, StatusMessage: newStatusMsg}
+	_, err := intent.MakeRequest(http.MethodPut, intent.BuildClientURL("v3", "presence", intent.UserID, "status"), &req, nil)
+	if err != nil {
+		puppet.log.Warn().Err(err).Str("presence", string(newPresence)).Msg("Failed to update presence")
+		return
+	}
+	puppet.lastPresence = newPresence
+	puppet.lastStatusMsg = newStatusMsg
+}
+
+func (user *User) presenceUpdateHandler(presence *discordgo.Presence) {
+	if presence.User == nil || presence.User.ID == "" || presence.User.ID == user.DiscordID {
+		return
+	}
+	user.bridge.GetPuppetByID(presence.User.ID).UpdatePresence(presence)
+}
+
+func (br *DiscordBridge) HandlePresence(evt *event.Event) {
+	if !br.Config.Bridge.PresenceToDiscord {
+		return
+	}
+	user := br.GetCachedUserByMXID(evt.Sender)
+	if user == nil || user.Session == nil {
+		return
+	}
+	content, ok := evt.Content.Parsed.(*event.PresenceEventContent)
+	if !ok {
+		return
+	}
+	user.SetDiscordPresence(content.Presence, content.StatusMessage)
+}
+
+// SetDiscordPresence sends the user's Matrix presence and status message to Discord as their status.
+func (user *User) SetDiscordPresence(presence event.Presence, statusMsg string) {
+	status := matrixPresenceToDiscord(presence)
+	user.presenceLock.Lock()
+	defer user.presenceLock.Unlock()
+	if user.lastPresenceStatus == status && user.lastPresenceStatusMsg == statusMsg {
+		return
+	}
+	data := discordgo.UpdateStatusData{Status: string(status)}
+	if statusMsg != "" {
+		data.Activities = []*discordgo.Activity{{
+			Name:  "Custom Status",
+			Type:  discordgo.ActivityTypeCustom,
+			State: statusMsg,
+		}}
+	}
+	err := user.Session.UpdateStatusComplex(data)
+	if err != nil {
+		user.log.Warn().Err(err).Str("status", string(status)).Msg("Failed to update Discord status")
+		return
+	}
+	user.log.Debug().Str("status", string(status)).Msg("Updated Discord status from Matrix presence")
+	user.lastPresenceStatus = status
+	user.lastPresenceStatusMsg = statusMsg
+}
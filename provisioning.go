@@ -5,12 +5,15 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
+	"sort"
 	"strings"
 	"time"
 
+	"github.com/bwmarrin/discordgo"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 	log "maunium.net/go/maulogger/v2"
@@ -40,6 +43,27 @@ const (
 	ErrCodeLoginConnectionFailed = "FI.MAU.DISCORD.LOGIN_CONN_FAILED"
 	ErrCodeLoginFailed           = "FI.MAU.DISCORD.LOGIN_FAILED"
 	ErrCodePostLoginConnFailed   = "FI.MAU.DISCORD.POST_LOGIN_CONNECTION_FAILED"
+	ErrCodeNotLoggedIn           = "FI.MAU.DISCORD.NOT_LOGGED_IN"
+	ErrCodeChannelNotBridged     = "FI.MAU.DISCORD.CHANNEL_NOT_BRIDGED"
+	ErrCodeChannelNotBridgeable  = "FI.MAU.DISCORD.CHANNEL_NOT_BRIDGEABLE"
+	ErrCodeChannelBridged        = "FI.MAU.DISCORD.CHANNEL_ALREADY_BRIDGED"
+	ErrCodeRoomBridged           = "FI.MAU.DISCORD.ROOM_ALREADY_BRIDGED"
+	ErrCodeChannelBridgeFailed   = "FI.MAU.DISCORD.CHANNEL_BRIDGE_FAILED"
+	ErrCodePortalCreateFailed    = "FI.MAU.DISCORD.PORTAL_CREATE_FAILED"
+	ErrCodeRelayAlreadySet       = "FI.MAU.DISCORD.RELAY_ALREADY_SET"
+	ErrCodeRelayNotSet           = "FI.MAU.DISCORD.RELAY_NOT_SET"
+	ErrCodeRelayFailed           = "FI.MAU.DISCORD.RELAY_FAILED"
+	ErrCodePowerLevelCheckFailed = "FI.MAU.DISCORD.POWER_LEVEL_CHECK_FAILED"
+	ErrCodeUserNotFound          = "FI.MAU.DISCORD.USER_NOT_FOUND"
+	ErrCodeCreateDMFailed        = "FI.MAU.DISCORD.CREATE_DM_FAILED"
+	ErrCodeCaptchaRequired       = "FI.MAU.DISCORD.CAPTCHA_REQUIRED"
+	ErrCodeStreamingUnsupported  = "FI.MAU.DISCORD.STREAMING_UNSUPPORTED"
+	ErrCodeNoLoginInProgress     = "FI.MAU.DISCORD.NO_LOGIN_IN_PROGRESS"
+	ErrCodeLoginTimedOut         = "FI.MAU.DISCORD.LOGIN_TIMED_OUT"
+	ErrCodeLoginCancelled        = "FI.MAU.DISCORD.LOGIN_CANCELLED"
+	ErrCodeMFAMethodUnsupported  = "FI.MAU.DISCORD.MFA_METHOD_UNSUPPORTED"
+	ErrCodeInvalidMFACode        = "FI.MAU.DISCORD.INVALID_MFA_CODE"
+	ErrCodeSMSSendFailed         = "FI.MAU.DISCORD.SMS_SEND_FAILED"
 )
 
 type ProvisioningAPI struct {
@@ -65,12 +89,26 @@ func newProvisioningAPI(br *DiscordBridge) *ProvisioningAPI {
 	r.HandleFunc("/v1/ping", p.ping).Methods(http.MethodGet)
 	r.HandleFunc("/v1/login/qr", p.qrLogin).Methods(http.MethodGet)
 	r.HandleFunc("/v1/login/token", p.tokenLogin).Methods(http.MethodPost)
+	r.HandleFunc("/v1/login/password", p.passwordLogin).Methods(http.MethodPost)
 	r.HandleFunc("/v1/logout", p.logout).Methods(http.MethodPost)
 	r.HandleFunc("/v1/reconnect", p.reconnect).Methods(http.MethodPost)
+	r.HandleFunc("/v1/events", p.events).Methods(http.MethodGet)
 
 	r.HandleFunc("/v1/guilds", p.guildsList).Methods(http.MethodGet)
 	r.HandleFunc("/v1/guilds/{guildID}", p.guildsBridge).Methods(http.MethodPost)
 	r.HandleFunc("/v1/guilds/{guildID}", p.guildsUnbridge).Methods(http.MethodDelete)
+	r.HandleFunc("/v1/guilds/{guildID}/channels", p.channelsList).Methods(http.MethodGet)
+
+	r.HandleFunc("/v1/channels/{channelID}/bridge", p.channelsBridge).Methods(http.MethodPost)
+	r.HandleFunc("/v1/channels/{channelID}/bridge", p.channelsUnbridge).Methods(http.MethodDelete)
+	r.HandleFunc("/v1/channels/{channelID}/portal", p.channelsCreatePortal).Methods(http.MethodPost)
+	r.HandleFunc("/v1/channels/{channelID}/portal", p.channelsDeletePortal).Methods(http.MethodDelete)
+	r.HandleFunc("/v1/channels/{channelID}/relay", p.channelsSetRelay).Methods(http.MethodPut)
+	r.HandleFunc("/v1/channels/{channelID}/relay", p.channelsUnsetRelay).Methods(http.MethodDelete)
+
+	r.HandleFunc("/v1/contacts", p.contacts).Methods(http.MethodGet)
+	r.HandleFunc("/v1/resolve_identifier/{identifier}", p.resolveIdentifier).Methods(http.MethodGet)
+	r.HandleFunc("/v1/create_dm/{userID}", p.createDM).Methods(http.MethodPost)
 
 	if p.bridge.Config.Bridge.Provisioning.DebugEndpoints {
 		p.log.Debugln("Enabling debug API at /debug")
@@ -107,6 +145,7 @@ type responseWrap struct {
 }
 
 var _ http.Hijacker = (*responseWrap)(nil)
+var _ http.Flusher = (*responseWrap)(nil)
 
 func (rw *responseWrap) WriteHeader(statusCode int) {
 	rw.ResponseWriter.WriteHeader(statusCode)
@@ -121,6 +160,12 @@ func (rw *responseWrap) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	return hijacker.Hijack()
 }
 
+func (rw *responseWrap) Flush() {
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
 // Middleware
 func (p *ProvisioningAPI) authMiddleware(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -314,6 +359,8 @@ func (p *ProvisioningAPI) qrLogin(w http.ResponseWriter, r *http.Request) {
 		select {
 		case qrCode, ok := <-qrChan:
 			if !ok {
+				// The channel is closed when the login finishes, doneChan will tell the result
+				qrChan = nil
 				continue
 			}
 			err = c.WriteJSON(map[string]interface{}{
@@ -328,10 +375,38 @@ func (p *ProvisioningAPI) qrLogin(w http.ResponseWriter, r *http.Request) {
 			discordUser, err = client.Result()
 			if err != nil {
 				log.Errorln("Discord login websocket returned error:", err)
-				_ = c.WriteJSON(Error{
+				resp := Error{
 					Error:   "Failed to log in",
 					ErrCode: ErrCodeLoginFailed,
-				})
+				}
+				evtType := ProvisioningEventLoginFailed
+				var evtData interface{}
+				captchaErr := &remoteauth.CaptchaError{}
+				switch {
+				case errors.Is(err, context.Canceled):
+					// The websocket was closed, so there's nobody to report to
+					return
+				case errors.Is(err, remoteauth.ErrTimedOut):
+					resp.Error = "The QR code wasn't scanned in time"
+					resp.ErrCode = ErrCodeLoginTimedOut
+				case errors.Is(err, remoteauth.ErrCancelled):
+					resp.Error = "Login was cancelled on the mobile app"
+					resp.ErrCode = ErrCodeLoginCancelled
+				case errors.As(err, &captchaErr):
+					resp.Error = "Discord requires a CAPTCHA to finish QR login, use password or token login instead"
+					resp.ErrCode = ErrCodeCaptchaRequired
+					evtType = ProvisioningEventLoginCaptcha
+					evtData = captchaErr
+				case isCaptchaError(err):
+					resp.Error = "Discord requires a CAPTCHA to log in, use token login instead"
+					resp.ErrCode = ErrCodeCaptchaRequired
+					evtType = ProvisioningEventLoginCaptcha
+				}
+				if evtData == nil {
+					evtData = provisioningEventLoginError{Error: resp.Error, ErrCode: resp.ErrCode}
+				}
+				user.sendProvisioningEvent(evtType, evtData)
+				_ = c.WriteJSON(resp)
 				return
 			}
 
@@ -410,6 +485,155 @@ func (p *ProvisioningAPI) tokenLogin(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+type reqPasswordLogin struct {
+	Login    string `json:"login"`
+	Password string `json:"password"`
+
+	CaptchaKey string `json:"captcha_key"`
+
+	MFAMethod string `json:"mfa_method"`
+	Code      string `json:"code"`
+	SendSMS   bool   `json:"send_sms"`
+}
+
+type respPasswordLogin struct {
+	Success  bool                  `json:"success"`
+	NextStep string                `json:"next_step"`
+	Captcha  *PasswordLoginCaptcha `json:"captcha,omitempty"`
+	MFA      *PasswordLoginMFA     `json:"mfa,omitempty"`
+	Phone    string                `json:"phone,omitempty"`
+}
+
+// passwordLogin runs one step of the password login flow. The first request must contain the login and password,
+// the following ones either the solved CAPTCHA or the MFA code, depending on the next_step of the previous response.
+func (p *ProvisioningAPI) passwordLogin(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+	log := p.log.Sub("PasswordLogin").Sub(user.MXID.String())
+	if user.IsLoggedIn() {
+		jsonResponse(w, http.StatusConflict, Error{
+			Error:   "You're already logged into Discord",
+			ErrCode: ErrCodeAlreadyLoggedIn,
+		})
+		return
+	}
+	var body reqPasswordLogin
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		log.Errorln("Failed to parse login request:", err)
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   "Failed to parse request body",
+			ErrCode: mautrix.MBadJSON.ErrCode,
+		})
+		return
+	}
+
+	var pl *PasswordLogin
+	var token string
+	var err error
+	isNewLogin := body.Login != "" && body.Password != ""
+	if isNewLogin {
+		pl, err = NewPasswordLogin(body.Login, body.Password)
+		if err != nil {
+			log.Errorln("Failed to prepare login:", err)
+			jsonResponse(w, http.StatusInternalServerError, Error{
+				Error:   "Failed to prepare login",
+				ErrCode: ErrCodeLoginPrepareFailed,
+			})
+			return
+		}
+		pl.Lock()
+	} else if pl = user.lockPasswordLogin(); pl == nil {
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   "No password login in progress",
+			ErrCode: ErrCodeNoLoginInProgress,
+		})
+		return
+	}
+	defer pl.Unlock()
+
+	switch {
+	case isNewLogin:
+		token, err = pl.Submit("")
+	case pl.Captcha != nil && body.CaptchaKey != "":
+		token, err = pl.Submit(body.CaptchaKey)
+	case pl.MFA != nil && body.SendSMS:
+		var phone string
+		phone, err = pl.SendSMS()
+		if errors.Is(err, ErrPasswordLoginNoMFAMethod) {
+			jsonResponse(w, http.StatusBadRequest, Error{
+				Error:   "SMS codes aren't available for your account",
+				ErrCode: ErrCodeMFAMethodUnsupported,
+			})
+			return
+		} else if err != nil {
+			log.Warnln("Failed to send SMS code:", err)
+			jsonResponse(w, http.StatusInternalServerError, Error{
+				Error:   fmt.Sprintf("Failed to send SMS code: %v", err),
+				ErrCode: ErrCodeSMSSendFailed,
+			})
+			return
+		}
+		jsonResponse(w, http.StatusOK, respPasswordLogin{NextStep: "mfa", MFA: pl.MFA, Phone: phone})
+		return
+	case pl.MFA != nil && body.Code != "":
+		method := body.MFAMethod
+		if method == "" {
+			method = pl.DefaultMFAMethod()
+		}
+		token, err = pl.SubmitMFA(method, body.Code)
+	default:
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   "Missing CAPTCHA response or MFA code",
+			ErrCode: mautrix.MBadJSON.ErrCode,
+		})
+		return
+	}
+
+	switch {
+	case errors.Is(err, ErrPasswordLoginCaptcha):
+		user.setPasswordLogin(pl)
+		user.sendProvisioningEvent(ProvisioningEventLoginCaptcha, pl.Captcha)
+		jsonResponse(w, http.StatusOK, respPasswordLogin{NextStep: "captcha", Captcha: pl.Captcha})
+	case errors.Is(err, ErrPasswordLoginMFA):
+		user.setPasswordLogin(pl)
+		user.sendProvisioningEvent(ProvisioningEventLoginMFA, pl.MFA)
+		jsonResponse(w, http.StatusOK, respPasswordLogin{NextStep: "mfa", MFA: pl.MFA})
+	case errors.Is(err, ErrPasswordLoginNoMFAMethod):
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   "That authentication method isn't available for your account",
+			ErrCode: ErrCodeMFAMethodUnsupported,
+		})
+	case errors.Is(err, ErrPasswordLoginInvalidCode):
+		jsonResponse(w, http.StatusUnauthorized, Error{
+			Error:   err.Error(),
+			ErrCode: ErrCodeInvalidMFACode,
+		})
+	case err != nil:
+		log.Warnln("Failed to log in:", err)
+		user.setPasswordLogin(nil)
+		jsonResponse(w, http.StatusUnauthorized, Error{
+			Error:   fmt.Sprintf("Failed to log in: %v", err),
+			ErrCode: ErrCodeLoginFailed,
+		})
+	default:
+		user.setPasswordLogin(nil)
+		if err = user.Login(token); err != nil {
+			log.Errorln("Failed to connect after logging in:", err)
+			jsonResponse(w, http.StatusInternalServerError, Error{
+				Error:   "Failed to connect to Discord after logging in",
+				ErrCode: ErrCodePostLoginConnFailed,
+			})
+			return
+		}
+		log.Infoln("Successfully logged in")
+		jsonResponse(w, http.StatusOK, respLogin{
+			Success:       true,
+			ID:            user.DiscordID,
+			Username:      user.Session.State.User.Username,
+			Discriminator: user.Session.State.User.Discriminator,
+		})
+	}
+}
+
 func (p *ProvisioningAPI) reconnect(w http.ResponseWriter, r *http.Request) {
 	user := r.Context().Value("user").(*User)
 
@@ -550,3 +774,577 @@ func (p *ProvisioningAPI) guildsUnbridge(w http.ResponseWriter, r *http.Request)
 		w.WriteHeader(http.StatusNoContent)
 	}
 }
+
+type channelEntry struct {
+	ID         string                `json:"id"`
+	Name       string                `json:"name"`
+	Type       discordgo.ChannelType `json:"type"`
+	ParentID   string                `json:"parent_id,omitempty"`
+	Position   int                   `json:"position"`
+	Bridgeable bool                  `json:"bridgeable"`
+	MXID       id.RoomID             `json:"mxid,omitempty"`
+	HasRelay   bool                  `json:"has_relay"`
+}
+
+type respChannelsList struct {
+	Channels []channelEntry `json:"channels"`
+}
+
+func (p *ProvisioningAPI) requireLogin(w http.ResponseWriter, user *User) bool {
+	if !user.IsLoggedIn() {
+		jsonResponse(w, http.StatusForbidden, Error{
+			Error:   "You're not logged into Discord",
+			ErrCode: ErrCodeNotLoggedIn,
+		})
+		return false
+	} else if user.Session == nil {
+		jsonResponse(w, http.StatusForbidden, Error{
+			Error:   "You're not connected to Discord",
+			ErrCode: ErrCodeNotConnected,
+		})
+		return false
+	}
+	return true
+}
+
+// requireChannelAccess checks that the user can see the given Discord channel. requireLogin must be called first.
+func (p *ProvisioningAPI) requireChannelAccess(w http.ResponseWriter, user *User, channelID string) bool {
+	channel, err := user.Session.State.Channel(channelID)
+	if err != nil {
+		jsonResponse(w, http.StatusNotFound, Error{
+			Error:   "Channel not found",
+			ErrCode: mautrix.MNotFound.ErrCode,
+		})
+		return false
+	} else if channel.GuildID == "" {
+		// Private channels are only in the state if the user is in them
+		return true
+	}
+	perms, err := user.Session.State.UserChannelPermissions(user.DiscordID, channelID)
+	if err != nil || perms&discordgo.PermissionViewChannel == 0 {
+		jsonResponse(w, http.StatusForbidden, Error{
+			Error:   "You don't have access to that channel",
+			ErrCode: mautrix.MForbidden.ErrCode,
+		})
+		return false
+	}
+	return true
+}
+
+// getManagedPortal finds the bridged portal of the channel and checks that the user is allowed to manage it.
+func (p *ProvisioningAPI) getManagedPortal(w http.ResponseWriter, user *User, channelID string) *Portal {
+	portal := user.GetExistingPortalByID(channelID)
+	if portal == nil || portal.MXID == "" {
+		jsonResponse(w, http.StatusNotFound, Error{
+			Error:   "That channel is not bridged",
+			ErrCode: ErrCodeChannelNotBridged,
+		})
+		return nil
+	}
+	if canModerate, err := user.canModerateRoom(portal.MainIntent(), portal.MXID); err != nil {
+		p.log.Warnfln("Failed to check power levels of %s in %s: %v", user.MXID, portal.MXID, err)
+		jsonResponse(w, http.StatusInternalServerError, Error{
+			Error:   "Failed to check your power level in the portal room",
+			ErrCode: ErrCodePowerLevelCheckFailed,
+		})
+		return nil
+	} else if !canModerate {
+		jsonResponse(w, http.StatusForbidden, Error{
+			Error:   "You don't have admin rights in the portal room",
+			ErrCode: mautrix.MForbidden.ErrCode,
+		})
+		return nil
+	}
+	return portal
+}
+
+func (p *ProvisioningAPI) channelsList(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+	guildID := mux.Vars(r)["guildID"]
+	if !p.requireLogin(w, user) {
+		return
+	}
+	guild, err := user.Session.State.Guild(guildID)
+	if err != nil {
+		jsonResponse(w, http.StatusNotFound, Error{
+			Error:   "Guild not found",
+			ErrCode: mautrix.MNotFound.ErrCode,
+		})
+		return
+	}
+
+	resp := respChannelsList{Channels: make([]channelEntry, 0, len(guild.Channels))}
+	for _, ch := range guild.Channels {
+		entry := channelEntry{
+			ID:         ch.ID,
+			Name:       ch.Name,
+			Type:       ch.Type,
+			ParentID:   ch.ParentID,
+			Position:   ch.Position,
+			Bridgeable: user.channelIsBridgeable(ch),
+		}
+		if portal := user.GetExistingPortalByID(ch.ID); portal != nil {
+			entry.MXID = portal.MXID
+			entry.HasRelay = portal.RelayWebhookID != ""
+		}
+		resp.Channels = append(resp.Channels, entry)
+	}
+	sort.SliceStable(resp.Channels, func(i, j int) bool {
+		return resp.Channels[i].Position < resp.Channels[j].Position
+	})
+
+	jsonResponse(w, http.StatusOK, resp)
+}
+
+type reqBridgeChannel struct {
+	RoomID    id.RoomID `json:"room_id"`
+	Replace   bool      `json:"replace"`
+	DeleteOld bool      `json:"delete_old"`
+}
+
+type respBridgeChannel struct {
+	Success bool      `json:"success"`
+	MXID    id.RoomID `json:"mxid"`
+}
+
+func (p *ProvisioningAPI) channelsBridge(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+	channelID := mux.Vars(r)["channelID"]
+	if !p.requireLogin(w, user) {
+		return
+	}
+
+	var body reqBridgeChannel
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.RoomID == "" {
+		p.log.Errorln("Failed to parse bridge request:", err)
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   "Failed to parse request body",
+			ErrCode: mautrix.MBadJSON.ErrCode,
+		})
+		return
+	} else if !p.requireChannelAccess(w, user, channelID) {
+		return
+	}
+	wasJoined := p.bridge.StateStore.IsInRoom(body.RoomID, p.bridge.Bot.UserID)
+	if err := p.bridge.Bot.EnsureJoined(body.RoomID); err != nil {
+		p.log.Warnfln("Failed to join %s to bridge it to %s: %v", body.RoomID, channelID, err)
+		jsonResponse(w, http.StatusForbidden, Error{
+			Error:   "The bridge bot couldn't join the room",
+			ErrCode: mautrix.MForbidden.ErrCode,
+		})
+		return
+	}
+	// The bot only joined to check power levels, so don't leave it behind in rooms that didn't get bridged.
+	leaveIfFailed := func() {
+		if wasJoined {
+			return
+		} else if _, err := p.bridge.Bot.LeaveRoom(body.RoomID); err != nil {
+			p.log.Warnfln("Failed to leave %s after bridging it failed: %v", body.RoomID, err)
+		}
+	}
+	if canModerate, err := user.canModerateRoom(p.bridge.Bot, body.RoomID); err != nil || !canModerate {
+		leaveIfFailed()
+		jsonResponse(w, http.StatusForbidden, Error{
+			Error:   "You don't have admin rights in that room",
+			ErrCode: mautrix.MForbidden.ErrCode,
+		})
+		return
+	}
+
+	portal, err := user.bridgeChannel(channelID, body.RoomID, body.Replace, body.DeleteOld)
+	if err != nil {
+		leaveIfFailed()
+	}
+	switch {
+	case errors.Is(err, errChannelNotFound):
+		jsonResponse(w, http.StatusNotFound, Error{
+			Error:   "Channel not found",
+			ErrCode: mautrix.MNotFound.ErrCode,
+		})
+	case errors.Is(err, errRoomAlreadyBridged):
+		jsonResponse(w, http.StatusConflict, Error{
+			Error:   "That room is already a portal",
+			ErrCode: ErrCodeRoomBridged,
+		})
+	case errors.Is(err, errChannelAlreadyBridged):
+		jsonResponse(w, http.StatusConflict, Error{
+			Error:   "That channel is already bridged to another room",
+			ErrCode: ErrCodeChannelBridged,
+		})
+	case errors.Is(err, errNoUnbridgePermission):
+		jsonResponse(w, http.StatusForbidden, Error{
+			Error:   "That channel is already bridged and you don't have the permissions to unbridge the old room",
+			ErrCode: mautrix.MForbidden.ErrCode,
+		})
+	case err != nil:
+		p.log.Errorfln("Error bridging %s to %s: %v", channelID, body.RoomID, err)
+		jsonResponse(w, http.StatusInternalServerError, Error{
+			Error:   "Internal error while trying to bridge channel",
+			ErrCode: ErrCodeChannelBridgeFailed,
+		})
+	default:
+		jsonResponse(w, http.StatusOK, respBridgeChannel{
+			Success: true,
+			MXID:    portal.MXID,
+		})
+	}
+}
+
+// channelsUnbridge unlinks the portal room from the channel, but leaves the Matrix users in the room.
+func (p *ProvisioningAPI) channelsUnbridge(w http.ResponseWriter, r *http.Request) {
+	p.unbridgeChannel(w, r, false)
+}
+
+// channelsDeletePortal unbridges the channel and kicks the Matrix users from the portal room.
+func (p *ProvisioningAPI) channelsDeletePortal(w http.ResponseWriter, r *http.Request) {
+	p.unbridgeChannel(w, r, true)
+}
+
+func (p *ProvisioningAPI) unbridgeChannel(w http.ResponseWriter, r *http.Request, kickUsers bool) {
+	user := r.Context().Value("user").(*User)
+	portal := p.getManagedPortal(w, user, mux.Vars(r)["channelID"])
+	if portal == nil {
+		return
+	}
+	portal.Unbridge(kickUsers)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (p *ProvisioningAPI) channelsCreatePortal(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+	channelID := mux.Vars(r)["channelID"]
+	if !p.requireLogin(w, user) {
+		return
+	}
+
+	portal, err := user.createPortal(channelID)
+	switch {
+	case errors.Is(err, errChannelNotFound):
+		jsonResponse(w, http.StatusNotFound, Error{
+			Error:   "Channel not found",
+			ErrCode: mautrix.MNotFound.ErrCode,
+		})
+	case errors.Is(err, errChannelNotBridgeable):
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   "That channel can't be bridged",
+			ErrCode: ErrCodeChannelNotBridgeable,
+		})
+	case errors.Is(err, errGuildBridgesNothing):
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   "That guild is set to not bridge any messages",
+			ErrCode: ErrCodeGuildNotBridged,
+		})
+	case errors.Is(err, errChannelAlreadyBridged):
+		jsonResponse(w, http.StatusOK, respBridgeChannel{
+			Success: true,
+			MXID:    portal.MXID,
+		})
+	case err != nil:
+		p.log.Errorfln("Error creating portal for %s: %v", channelID, err)
+		jsonResponse(w, http.StatusInternalServerError, Error{
+			Error:   "Internal error while trying to create portal",
+			ErrCode: ErrCodePortalCreateFailed,
+		})
+	default:
+		jsonResponse(w, http.StatusCreated, respBridgeChannel{
+			Success: true,
+			MXID:    portal.MXID,
+		})
+	}
+}
+
+type reqSetRelay struct {
+	WebhookURL string `json:"url"`
+	Create     bool   `json:"create"`
+	Name       string `json:"name"`
+}
+
+type respSetRelay struct {
+	Success   bool   `json:"success"`
+	WebhookID string `json:"webhook_id"`
+	Name      string `json:"name"`
+}
+
+func (p *ProvisioningAPI) channelsSetRelay(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+	channelID := mux.Vars(r)["channelID"]
+
+	var body reqSetRelay
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || (body.WebhookURL == "" && !body.Create) {
+		p.log.Errorln("Failed to parse set relay request:", err)
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   "Request body must contain either a webhook URL or create: true",
+			ErrCode: mautrix.MBadJSON.ErrCode,
+		})
+		return
+	} else if body.Create && !p.requireLogin(w, user) {
+		return
+	}
+	portal := p.getManagedPortal(w, user, channelID)
+	if portal == nil {
+		return
+	} else if portal.GuildID == "" {
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   "Only guild channels can have relays",
+			ErrCode: mautrix.MInvalidParam.ErrCode,
+		})
+		return
+	} else if portal.RelayWebhookID != "" {
+		jsonResponse(w, http.StatusConflict, Error{
+			Error:   "That channel already has a relay webhook",
+			ErrCode: ErrCodeRelayAlreadySet,
+		})
+		return
+	}
+
+	var webhookMeta *discordgo.Webhook
+	var err error
+	if body.WebhookURL != "" {
+		webhookMeta, err = getRelayWebhookByURL(body.WebhookURL)
+	} else {
+		if body.Name == "" {
+			body.Name = "mautrix"
+		}
+		webhookMeta, err = user.createRelayWebhook(portal, body.Name)
+	}
+	if err == nil {
+		err = portal.setRelayWebhook(webhookMeta)
+	}
+	switch {
+	case errors.Is(err, errInvalidWebhookURL), errors.Is(err, errWebhookWrongChannel):
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   err.Error(),
+			ErrCode: mautrix.MInvalidParam.ErrCode,
+		})
+	case errors.Is(err, errNoWebhookPermission):
+		jsonResponse(w, http.StatusForbidden, Error{
+			Error:   "You don't have permission to manage webhooks in that channel",
+			ErrCode: mautrix.MForbidden.ErrCode,
+		})
+	case err != nil:
+		p.log.Errorfln("Error setting relay webhook for %s: %v", channelID, err)
+		jsonResponse(w, http.StatusInternalServerError, Error{
+			Error:   "Internal error while trying to set relay webhook",
+			ErrCode: ErrCodeRelayFailed,
+		})
+	default:
+		jsonResponse(w, http.StatusOK, respSetRelay{
+			Success:   true,
+			WebhookID: webhookMeta.ID,
+			Name:      webhookMeta.Name,
+		})
+	}
+}
+
+func (p *ProvisioningAPI) channelsUnsetRelay(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+	channelID := mux.Vars(r)["channelID"]
+	portal := p.getManagedPortal(w, user, channelID)
+	if portal == nil {
+		return
+	}
+	err := portal.unsetRelayWebhook(r.URL.Query().Get("delete") == "true")
+	if errors.Is(err, errRelayWebhookNotFound) {
+		jsonResponse(w, http.StatusNotFound, Error{
+			Error:   "That channel doesn't have a relay webhook",
+			ErrCode: ErrCodeRelayNotSet,
+		})
+	} else if err != nil {
+		p.log.Errorfln("Error unsetting relay webhook for %s: %v", channelID, err)
+		jsonResponse(w, http.StatusInternalServerError, Error{
+			Error:   "Internal error while trying to delete relay webhook",
+			ErrCode: ErrCodeRelayFailed,
+		})
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+type contactEntry struct {
+	ID            string        `json:"id"`
+	Name          string        `json:"name"`
+	Username      string        `json:"username"`
+	Discriminator string        `json:"discriminator,omitempty"`
+	Nickname      string        `json:"nickname,omitempty"`
+	AvatarURL     id.ContentURI `json:"avatar_url"`
+	MXID          id.UserID     `json:"mxid"`
+	DMRoomID      id.RoomID     `json:"dm_room_id,omitempty"`
+}
+
+type respContacts struct {
+	Contacts []contactEntry `json:"contacts"`
+}
+
+func (p *ProvisioningAPI) makeContactEntry(user *User, puppet *Puppet) contactEntry {
+	entry := contactEntry{
+		ID:        puppet.ID,
+		Name:      puppet.Name,
+		Username:  puppet.Username,
+		AvatarURL: puppet.AvatarURL,
+		MXID:      puppet.MXID,
+	}
+	if puppet.Discriminator != "0" {
+		entry.Discriminator = puppet.Discriminator
+	}
+	if puppet.Avatar != "" {
+		if mxc := p.bridge.DMA.AvatarMXC("", puppet.ID, puppet.Avatar); !mxc.IsEmpty() {
+			entry.AvatarURL = mxc
+		}
+	}
+	if rel := user.getRelationship(puppet.ID); rel != nil {
+		entry.Nickname = rel.Nickname
+	}
+	if portal := user.FindPrivateChatWith(puppet.ID); portal != nil {
+		entry.DMRoomID = portal.MXID
+	}
+	return entry
+}
+
+func (p *ProvisioningAPI) contacts(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+	if !p.requireLogin(w, user) {
+		return
+	}
+
+	friends := user.getFriends()
+	resp := respContacts{Contacts: make([]contactEntry, 0, len(friends))}
+	var unsynced []*Puppet
+	for _, rel := range friends {
+		puppet := p.bridge.GetPuppetByID(rel.ID)
+		if puppet.Name == "" {
+			unsynced = append(unsynced, puppet)
+		}
+		resp.Contacts = append(resp.Contacts, p.makeContactEntry(user, puppet))
+	}
+	if len(unsynced) > 0 {
+		// Ghosts that haven't been synced yet only have an ID in the response,
+		// the rest of the info will be there the next time contacts are requested.
+		go func() {
+			for _, puppet := range unsynced {
+				puppet.UpdateInfo(user, nil, nil)
+			}
+		}()
+	}
+	sort.Slice(resp.Contacts, func(i, j int) bool {
+		return strings.ToLower(resp.Contacts[i].Name) < strings.ToLower(resp.Contacts[j].Name)
+	})
+
+	jsonResponse(w, http.StatusOK, resp)
+}
+
+// resolveDiscordUser finds a Discord user by ID, or by username among friends and members of guilds in the state cache.
+// Discord doesn't have an API for looking up arbitrary users by username.
+func (user *User) resolveDiscordUser(identifier string) *Puppet {
+	if user.Session == nil {
+		return nil
+	}
+	identifier = strings.TrimPrefix(strings.TrimSpace(identifier), "@")
+	if isNumber(identifier) {
+		info, err := user.Session.User(identifier)
+		if err != nil {
+			user.log.Debug().Err(err).Str("user_id", identifier).Msg("Failed to fetch user to resolve identifier")
+			return nil
+		}
+		puppet := user.bridge.GetPuppetByID(info.ID)
+		puppet.UpdateInfo(user, info, nil)
+		return puppet
+	}
+	username, discriminator, _ := strings.Cut(strings.ToLower(identifier), "#")
+	matches := func(info *discordgo.User) bool {
+		return info != nil && strings.ToLower(info.Username) == username &&
+			(discriminator == "" || info.Discriminator == discriminator)
+	}
+	for _, rel := range user.getFriends() {
+		puppet := user.bridge.GetPuppetByID(rel.ID)
+		if strings.ToLower(puppet.Username) == username && (discriminator == "" || puppet.Discriminator == discriminator) {
+			return puppet
+		}
+	}
+	user.Session.State.RLock()
+	defer user.Session.State.RUnlock()
+	for _, guild := range user.Session.State.Guilds {
+		for _, member := range guild.Members {
+			if matches(member.User) {
+				puppet := user.bridge.GetPuppetByID(member.User.ID)
+				go puppet.UpdateInfo(user, member.User, nil)
+				return puppet
+			}
+		}
+	}
+	return nil
+}
+
+func (p *ProvisioningAPI) resolveIdentifier(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+	if !p.requireLogin(w, user) {
+		return
+	}
+	puppet := user.resolveDiscordUser(mux.Vars(r)["identifier"])
+	if puppet == nil {
+		jsonResponse(w, http.StatusNotFound, Error{
+			Error:   "User not found",
+			ErrCode: ErrCodeUserNotFound,
+		})
+		return
+	}
+	jsonResponse(w, http.StatusOK, p.makeContactEntry(user, puppet))
+}
+
+type respCreateDM struct {
+	contactEntry
+	JustCreated bool `json:"just_created"`
+}
+
+func (p *ProvisioningAPI) createDM(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+	userID := mux.Vars(r)["userID"]
+	if !p.requireLogin(w, user) {
+		return
+	} else if !isNumber(userID) || userID == user.DiscordID {
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   "Invalid user ID",
+			ErrCode: mautrix.MInvalidParam.ErrCode,
+		})
+		return
+	}
+
+	var channel *discordgo.Channel
+	portal := user.FindPrivateChatWith(userID)
+	if portal == nil {
+		var err error
+		channel, err = user.Session.UserChannelCreate(userID)
+		if err != nil {
+			p.log.Warnfln("Failed to open DM channel between %s and %s: %v", user.MXID, userID, err)
+			jsonResponse(w, http.StatusNotFound, Error{
+				Error:   "Failed to open a DM with that user",
+				ErrCode: ErrCodeUserNotFound,
+			})
+			return
+		}
+		portal = user.GetPortalByMeta(channel)
+	}
+	justCreated := portal.MXID == ""
+	if justCreated {
+		user.handlePrivateChannel(portal, channel, time.Now(), true, false)
+		if portal.MXID == "" {
+			jsonResponse(w, http.StatusInternalServerError, Error{
+				Error:   "Failed to create DM portal",
+				ErrCode: ErrCodeCreateDMFailed,
+			})
+			return
+		}
+	} else {
+		portal.ensureUserInvited(user, false)
+	}
+
+	puppet := p.bridge.GetPuppetByID(userID)
+	puppet.UpdateInfo(user, nil, nil)
+	status := http.StatusOK
+	if justCreated {
+		status = http.StatusCreated
+	}
+	jsonResponse(w, status, respCreateDM{
+		contactEntry: p.makeContactEntry(user, puppet),
+		JustCreated:  justCreated,
+	})
+}
@@ -0,0 +1,167 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"maunium.net/go/mautrix/bridge/status"
+	"maunium.net/go/mautrix/id"
+)
+
+// The provisioning event stream pushes changes for a single user to provisioning API clients as server-sent events,
+// so that they don't need to poll /v1/ping. Events are only delivered to clients connected when they happen,
+// except for the latest bridge state, which is sent when a client connects.
+
+type ProvisioningEventType string
+
+const (
+	ProvisioningEventBridgeState   ProvisioningEventType = "bridge_state"
+	ProvisioningEventGuildJoin     ProvisioningEventType = "guild_join"
+	ProvisioningEventGuildLeave    ProvisioningEventType = "guild_leave"
+	ProvisioningEventPortalCreated ProvisioningEventType = "portal_created"
+	ProvisioningEventLoginSuccess  ProvisioningEventType = "login_success"
+	ProvisioningEventLoginFailed   ProvisioningEventType = "login_failed"
+	ProvisioningEventLoginCaptcha  ProvisioningEventType = "login_captcha"
+	ProvisioningEventLoginMFA      ProvisioningEventType = "login_mfa"
+)
+
+const provisioningEventBufferSize = 32
+const provisioningEventKeepaliveInterval = 30 * time.Second
+
+type ProvisioningEvent struct {
+	Type ProvisioningEventType
+	Data interface{}
+}
+
+type provisioningEventGuild struct {
+	ID   string    `json:"id"`
+	Name string    `json:"name,omitempty"`
+	MXID id.RoomID `json:"mxid,omitempty"`
+}
+
+type provisioningEventPortal struct {
+	ChannelID string    `json:"channel_id"`
+	GuildID   string    `json:"guild_id,omitempty"`
+	Name      string    `json:"name"`
+	MXID      id.RoomID `json:"mxid"`
+}
+
+type provisioningEventLoginError struct {
+	Error   string `json:"error"`
+	ErrCode string `json:"errcode"`
+}
+
+// SubscribeProvisioningEvents registers a new event stream listener. The returned function must be called to unsubscribe.
+func (user *User) SubscribeProvisioningEvents() (<-chan *ProvisioningEvent, func()) {
+	ch := make(chan *ProvisioningEvent, provisioningEventBufferSize)
+	user.provisioningListenersLock.Lock()
+	if user.provisioningListeners == nil {
+		user.provisioningListeners = make(map[chan *ProvisioningEvent]struct{})
+	}
+	user.provisioningListeners[ch] = struct{}{}
+	user.provisioningListenersLock.Unlock()
+	return ch, func() {
+		user.provisioningListenersLock.Lock()
+		delete(user.provisioningListeners, ch)
+		user.provisioningListenersLock.Unlock()
+	}
+}
+
+func (user *User) sendProvisioningEvent(evtType ProvisioningEventType, data interface{}) {
+	user.provisioningListenersLock.RLock()
+	defer user.provisioningListenersLock.RUnlock()
+	evt := &ProvisioningEvent{Type: evtType, Data: data}
+	for ch := range user.provisioningListeners {
+		select {
+		case ch <- evt:
+		default:
+			user.log.Warn().Str("event_type", string(evtType)).Msg("Provisioning event stream buffer is full, dropping event")
+		}
+	}
+}
+
+// sendBridgeState sends a bridge state through the bridge state queue and publishes it to the provisioning event stream.
+func (user *User) sendBridgeState(state status.BridgeState) {
+	state = state.Fill(user)
+	user.BridgeState.Send(state)
+	user.sendProvisioningEvent(ProvisioningEventBridgeState, state)
+}
+
+func (p *ProvisioningAPI) events(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		jsonResponse(w, http.StatusInternalServerError, Error{
+			Error:   "Streaming is not supported",
+			ErrCode: ErrCodeStreamingUnsupported,
+		})
+		return
+	}
+	evts, unsubscribe := user.SubscribeProvisioningEvents()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	writeEvent := func(evt *ProvisioningEvent) bool {
+		data, err := json.Marshal(evt.Data)
+		if err != nil {
+			p.log.Warnfln("Failed to marshal %s event for %s: %v", evt.Type, user.MXID, err)
+			return true
+		}
+		_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", evt.Type, data)
+		if err != nil {
+			p.log.Debugfln("Failed to write event to %s's event stream: %v", user.MXID, err)
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+
+	if prevState := user.BridgeState.GetPrev(); prevState.StateEvent != "" {
+		if !writeEvent(&ProvisioningEvent{Type: ProvisioningEventBridgeState, Data: prevState}) {
+			return
+		}
+	} else {
+		flusher.Flush()
+	}
+
+	keepalive := time.NewTicker(provisioningEventKeepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		select {
+		case evt := <-evts:
+			if !writeEvent(evt) {
+				return
+			}
+		case <-keepalive.C:
+			_, err := fmt.Fprint(w, ": keepalive\n\n")
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/appservice"
 	"maunium.net/go/mautrix/bridge"
+	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 
 	"go.mau.fi/mautrix-discord/database"
@@ -29,6 +30,9 @@ type Puppet struct {
 	customUser   *User
 
 	syncLock sync.Mutex
+
+	lastPresence  event.Presence
+	lastStatusMsg string
 }
 
 var _ bridge.Ghost = (*Puppet)(nil)
@@ -281,6 +285,62 @@ func (puppet *Puppet) UpdateAvatar(info *discordgo.User) bool {
 	return true
 }
 
+// UpdateGuildMemberMeta sets the ghost's per-room member event in a guild portal
+// to match the user's nickname and avatar in that guild.
+func (puppet *Puppet) UpdateGuildMemberMeta(portal *Portal, member *discordgo.Member) {
+	if portal.MXID == "" || portal.GuildID == "" || member == nil || puppet.IntentFor(portal).IsCustomPuppet {
+		return
+	}
+	intent := puppet.DefaultIntent()
+	if !puppet.bridge.StateStore.IsInRoom(portal.MXID, intent.UserID) {
+		return
+	}
+	log := puppet.log.With().
+		Str("guild_id", portal.GuildID).
+		Str("room_id", portal.MXID.String()).
+		Logger()
+	displayname := puppet.Name
+	if member.Nick != "" {
+		// Nicknames are rendered with the same template as normal names, with the nick in place of the global name
+		var info discordgo.User
+		if member.User != nil {
+			info = *member.User
+		} else {
+			info = discordgo.User{
+				ID:            puppet.ID,
+				Username:      puppet.Username,
+				Discriminator: puppet.Discriminator,
+				Bot:           puppet.IsBot,
+			}
+		}
+		info.GlobalName = member.Nick
+		displayname = puppet.bridge.Config.Bridge.FormatDisplayname(&info, puppet.IsWebhook, puppet.IsApplication)
+	}
+	avatarURL := puppet.AvatarURL
+	if member.Avatar != "" {
+		var err error
+		avatarURL, _, err = puppet.bridge.reuploadUserAvatar(intent, portal.GuildID, puppet.ID, member.Avatar)
+		if err != nil {
+			log.Warn().Err(err).Str("avatar_id", member.Avatar).Msg("Failed to reupload guild member avatar")
+			avatarURL = puppet.AvatarURL
+		}
+	}
+	current := puppet.bridge.StateStore.GetMember(portal.MXID, intent.UserID)
+	if current != nil && current.Displayname == displayname && current.AvatarURL == avatarURL.CUString() {
+		return
+	}
+	_, err := intent.SendStateEvent(portal.MXID, event.StateMember, intent.UserID.String(), &event.MemberEventContent{
+		Membership:  event.MembershipJoin,
+		Displayname: displayname,
+		AvatarURL:   avatarURL.CUString(),
+	})
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to update guild member profile in room")
+	} else {
+		log.Debug().Str("displayname", displayname).Msg("Updated guild member profile in room")
+	}
+}
+
 func (puppet *Puppet) UpdateInfo(source *User, info *discordgo.User, message *discordgo.Message) {
 	puppet.syncLock.Lock()
 	defer puppet.syncLock.Unlock()
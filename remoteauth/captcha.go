@@ -0,0 +1,48 @@
+package remoteauth
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// CaptchaError is returned when Discord requires a CAPTCHA to be solved
+// before it accepts the login ticket.
+type CaptchaError struct {
+	Service   string `json:"captcha_service"`
+	SiteKey   string `json:"captcha_sitekey"`
+	SessionID string `json:"captcha_session_id,omitempty"`
+	RQData    string `json:"captcha_rqdata,omitempty"`
+	RQToken   string `json:"captcha_rqtoken,omitempty"`
+
+	Err error `json:"-"`
+}
+
+func (e *CaptchaError) Error() string {
+	return "captcha required to finish login"
+}
+
+func (e *CaptchaError) Unwrap() error {
+	return e.Err
+}
+
+func parseCaptchaError(err error) error {
+	restErr := &discordgo.RESTError{}
+	if !errors.As(err, &restErr) || restErr.Response.StatusCode != http.StatusBadRequest {
+		return err
+	}
+
+	var data struct {
+		CaptchaKey []string `json:"captcha_key"`
+		CaptchaError
+	}
+	if json.Unmarshal(restErr.ResponseBody, &data) != nil || len(data.CaptchaKey) == 0 {
+		return err
+	}
+
+	data.CaptchaError.Err = err
+
+	return &data.CaptchaError
+}
@@ -7,6 +7,7 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"sync"
 
@@ -15,12 +16,31 @@ import (
 	"github.com/bwmarrin/discordgo"
 )
 
+var (
+	// ErrTimedOut is returned when none of the QR codes were scanned before they expired.
+	ErrTimedOut = errors.New("timed out waiting for the QR code to be scanned")
+	// ErrCancelled is returned when the login was cancelled on the mobile app.
+	ErrCancelled = errors.New("login was cancelled on the mobile app")
+
+	errHeartbeatTimeout = errors.New("server failed to acknowledge our heartbeats")
+	errSessionExpired   = errors.New("remote auth session expired")
+)
+
 type Client struct {
 	sync.Mutex
 
 	URL string
 
-	conn *websocket.Conn
+	// MaxQRCodes is the number of QR codes that will be generated before giving up.
+	// Discord expires each code after a couple of minutes, after which a new one is sent to qrChan.
+	MaxQRCodes int
+
+	conn      *websocket.Conn
+	writeLock sync.Mutex
+
+	// ctx is cancelled when the current websocket connection should be closed.
+	ctx    context.Context
+	cancel context.CancelCauseFunc
 
 	qrChan   chan string
 	doneChan chan struct{}
@@ -29,13 +49,13 @@ type Client struct {
 	err  error
 
 	heartbeats int
+	scanned    bool
 	closed     bool
 
 	privateKey *rsa.PrivateKey
 }
 
-// New creates a new Discord remote auth client. qrChan is a channel that will
-// receive the qrcode once it is available.
+// New creates a new Discord remote auth client.
 func New() (*Client, error) {
 	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
@@ -44,32 +64,26 @@ func New() (*Client, error) {
 
 	return &Client{
 		URL:        "wss://remote-auth-gateway.discord.gg/?v=2",
+		MaxQRCodes: 5,
 		privateKey: privateKey,
 	}, nil
 }
 
 // Dial will start the QRCode login process. ctx may be used to abandon the
-// process.
+// process. qrChan will receive a new QR code every time the previous one
+// expires, and both channels are closed once the process is finished.
 func (c *Client) Dial(ctx context.Context, qrChan chan string, doneChan chan struct{}) error {
 	c.Lock()
-	defer c.Unlock()
-
-	header := http.Header{}
-	for key, value := range discordgo.DroidWSHeaders {
-		header.Set(key, value)
-	}
-
 	c.qrChan = qrChan
 	c.doneChan = doneChan
+	c.Unlock()
 
-	conn, _, err := websocket.DefaultDialer.DialContext(ctx, c.URL, header)
+	conn, err := c.dial(ctx)
 	if err != nil {
 		return err
 	}
 
-	c.conn = conn
-
-	go c.processMessages()
+	go c.run(ctx, conn)
 
 	return nil
 }
@@ -81,29 +95,88 @@ func (c *Client) Result() (User, error) {
 	return c.user, c.err
 }
 
-func (c *Client) close() error {
+func (c *Client) dial(ctx context.Context) (*websocket.Conn, error) {
+	header := http.Header{}
+	for key, value := range discordgo.DroidWSHeaders {
+		header.Set(key, value)
+	}
+
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, c.URL, header)
+	return conn, err
+}
+
+// run processes connections until the login finishes, reconnecting to get a
+// fresh QR code whenever the previous one expires before being scanned.
+func (c *Client) run(ctx context.Context, conn *websocket.Conn) {
+	defer c.close()
+
+	for attempt := 1; ; attempt++ {
+		err := c.processMessages(ctx, conn)
+		if err == nil {
+			return
+		} else if ctx.Err() != nil {
+			c.setErr(ctx.Err())
+			return
+		}
+
+		c.Lock()
+		scanned := c.scanned
+		c.Unlock()
+
+		if !errors.Is(err, errSessionExpired) || scanned {
+			c.setErr(err)
+			return
+		} else if attempt >= c.MaxQRCodes {
+			c.setErr(ErrTimedOut)
+			return
+		}
+
+		conn, err = c.dial(ctx)
+		if err != nil {
+			c.setErr(err)
+			return
+		}
+	}
+}
+
+func (c *Client) setErr(err error) {
 	c.Lock()
 	defer c.Unlock()
 
-	if c.closed {
-		return nil
+	if c.err == nil {
+		c.err = err
 	}
+}
 
-	c.conn.WriteMessage(
-		websocket.CloseMessage,
-		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
-	)
+func (c *Client) sendQRCode(url string) {
+	select {
+	case c.qrChan <- url:
+	case <-c.ctx.Done():
+	}
+}
 
-	c.closed = true
+// finish ends the current connection successfully.
+func (c *Client) finish() {
+	c.cancel(nil)
+}
+
+func (c *Client) close() {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.closed {
+		return
+	}
 
-	defer close(c.doneChan)
+	c.closed = true
 
-	return c.conn.Close()
+	close(c.qrChan)
+	close(c.doneChan)
 }
 
 func (c *Client) write(p clientPacket) error {
-	c.Lock()
-	defer c.Unlock()
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
 
 	payload, err := json.Marshal(p)
 	if err != nil {
@@ -3,7 +3,6 @@ package remoteauth
 import (
 	"crypto/x509"
 	"encoding/base64"
-	"fmt"
 )
 
 type clientPacket interface {
@@ -21,9 +20,13 @@ func (h *clientHeartbeat) send(client *Client) error {
 	// make sure our op string is set
 	h.OP = "heartbeat"
 
+	client.Lock()
 	client.heartbeats += 1
-	if client.heartbeats > 2 {
-		return fmt.Errorf("server failed to acknowledge our heartbeats")
+	heartbeats := client.heartbeats
+	client.Unlock()
+
+	if heartbeats > 2 {
+		return errHeartbeatTimeout
 	}
 
 	return client.write(h)
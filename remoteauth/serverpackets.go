@@ -1,9 +1,11 @@
 package remoteauth
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
@@ -16,35 +18,55 @@ type serverPacket interface {
 	process(client *Client) error
 }
 
-func (c *Client) processMessages() {
+func (c *Client) processMessages(ctx context.Context, conn *websocket.Conn) error {
 	type rawPacket struct {
 		OP string `json:"op"`
 	}
 
-	defer c.close()
+	connCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
 
-	for {
-		c.Lock()
-		_, packet, err := c.conn.ReadMessage()
-		c.Unlock()
+	c.Lock()
+	c.conn = conn
+	c.ctx = connCtx
+	c.cancel = cancel
+	c.heartbeats = 0
+	c.Unlock()
+
+	go func() {
+		<-connCtx.Done()
+
+		c.writeLock.Lock()
+		_ = conn.WriteMessage(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		)
+		c.writeLock.Unlock()
+
+		_ = conn.Close()
+	}()
 
+	for {
+		_, packet, err := conn.ReadMessage()
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure) {
-				c.Lock()
-				c.err = err
-				c.Unlock()
+			if ctx.Err() != nil {
+				return ctx.Err()
+			} else if connCtx.Err() != nil {
+				// We closed the connection ourselves, either because the
+				// login finished or because the session expired.
+				if cause := context.Cause(connCtx); !errors.Is(cause, context.Canceled) {
+					return cause
+				}
+
+				return nil
 			}
 
-			return
+			return fmt.Errorf("%w: %w", errSessionExpired, err)
 		}
 
 		raw := rawPacket{}
 		if err := json.Unmarshal(packet, &raw); err != nil {
-			c.Lock()
-			c.err = err
-			c.Unlock()
-
-			return
+			return err
 		}
 
 		var dest interface{}
@@ -64,28 +86,16 @@ func (c *Client) processMessages() {
 		case "heartbeat_ack":
 			dest = new(serverHeartbeatAck)
 		default:
-			c.Lock()
-			c.err = fmt.Errorf("unknown op %s", raw.OP)
-			c.Unlock()
-			return
+			return fmt.Errorf("unknown op %s", raw.OP)
 		}
 
 		if err := json.Unmarshal(packet, dest); err != nil {
-			c.Lock()
-			c.err = err
-			c.Unlock()
-
-			return
+			return err
 		}
 
 		op := dest.(serverPacket)
-		err = op.process(c)
-		if err != nil {
-			c.Lock()
-			c.err = err
-			c.Unlock()
-
-			return
+		if err = op.process(c); err != nil {
+			return err
 		}
 	}
 }
@@ -99,20 +109,28 @@ type serverHello struct {
 }
 
 func (h *serverHello) process(client *Client) error {
+	client.Lock()
+	ctx, cancel := client.ctx, client.cancel
+	client.Unlock()
+
 	// Create our heartbeat handler
 	ticker := time.NewTicker(time.Duration(h.HeartbeatInterval) * time.Millisecond)
 	go func() {
 		defer ticker.Stop()
 		for {
 			select {
-			// case <-client.ctx.Done():
-			// 	return
+			case <-ctx.Done():
+				return
 			case <-ticker.C:
+				if ctx.Err() != nil {
+					return
+				}
+
 				h := clientHeartbeat{}
 				if err := h.send(client); err != nil {
-					client.Lock()
-					client.err = err
-					client.Unlock()
+					// Losing the connection isn't fatal, we'll just
+					// reconnect and send a new QR code.
+					cancel(fmt.Errorf("%w: %w", errSessionExpired, err))
 
 					return
 				}
@@ -120,15 +138,16 @@ func (h *serverHello) process(client *Client) error {
 		}
 	}()
 
+	// The server closes the session after the timeout, which means the QR
+	// code expires.
 	go func() {
 		duration := time.Duration(h.Timeout) * time.Millisecond
 
-		<-time.After(duration)
-
-		client.Lock()
-		client.err = fmt.Errorf("Timed out after %s", duration)
-		client.close()
-		client.Unlock()
+		select {
+		case <-ctx.Done():
+		case <-time.After(duration):
+			cancel(fmt.Errorf("%w after %s", errSessionExpired, duration))
+		}
 	}()
 
 	i := clientInit{}
@@ -165,7 +184,9 @@ func (n *serverNonceProof) process(client *Client) error {
 type serverHeartbeatAck struct{}
 
 func (h *serverHeartbeatAck) process(client *Client) error {
-	client.heartbeats -= 1
+	client.Lock()
+	client.heartbeats = 0
+	client.Unlock()
 
 	return nil
 }
@@ -180,8 +201,7 @@ type serverPendingRemoteInit struct {
 func (p *serverPendingRemoteInit) process(client *Client) error {
 	url := "https://discordapp.com/ra/" + p.Fingerprint
 
-	client.qrChan <- url
-	close(client.qrChan)
+	client.sendQRCode(url)
 
 	return nil
 }
@@ -199,6 +219,11 @@ func (p *serverPendingTicket) process(client *Client) error {
 		return err
 	}
 
+	client.Lock()
+	defer client.Unlock()
+
+	client.scanned = true
+
 	return client.user.update(string(plaintext))
 }
 
@@ -216,7 +241,7 @@ func (p *serverPendingLogin) process(client *Client) error {
 	}
 	encryptedToken, err := sess.RemoteAuthLogin(p.Ticket)
 	if err != nil {
-		return err
+		return parseCaptchaError(err)
 	}
 
 	plaintext, err := client.decrypt(encryptedToken)
@@ -224,9 +249,11 @@ func (p *serverPendingLogin) process(client *Client) error {
 		return err
 	}
 
+	client.Lock()
 	client.user.Token = string(plaintext)
+	client.Unlock()
 
-	client.close()
+	client.finish()
 
 	return nil
 }
@@ -237,7 +264,8 @@ func (p *serverPendingLogin) process(client *Client) error {
 type serverCancel struct{}
 
 func (c *serverCancel) process(client *Client) error {
-	client.close()
+	client.setErr(ErrCancelled)
+	client.finish()
 
 	return nil
 }
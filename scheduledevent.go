@@ -0,0 +1,315 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"html"
+	"sort"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/bridge/commands"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-discord/database"
+)
+
+const scheduledEventTimeFormat = "Mon, 2 Jan 2006 15:04 MST"
+
+type ScheduledEventInfo struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Start       int64  `json:"start"`
+	End         int64  `json:"end,omitempty"`
+	Location    string `json:"location,omitempty"`
+	Status      string `json:"status"`
+	Interested  int    `json:"interested,omitempty"`
+	URL         string `json:"url"`
+}
+
+func scheduledEventStatusName(status discordgo.GuildScheduledEventStatus) string {
+	switch status {
+	case discordgo.GuildScheduledEventStatusScheduled:
+		return "scheduled"
+	case discordgo.GuildScheduledEventStatusActive:
+		return "active"
+	case discordgo.GuildScheduledEventStatusCompleted:
+		return "completed"
+	case discordgo.GuildScheduledEventStatusCanceled:
+		return "canceled"
+	default:
+		return "unknown"
+	}
+}
+
+func scheduledEventURL(evt *discordgo.GuildScheduledEvent) string {
+	return fmt.Sprintf("https://discord.com/events/%s/%s", evt.GuildID, evt.ID)
+}
+
+// scheduledEventLocationHTML returns the external location or a link to the portal of the voice/stage channel of the event.
+func (br *DiscordBridge) scheduledEventLocationHTML(evt *discordgo.GuildScheduledEvent) (plain, formatted string) {
+	if evt.EntityType == discordgo.GuildScheduledEventEntityTypeExternal {
+		return evt.EntityMetadata.Location, html.EscapeString(evt.EntityMetadata.Location)
+	} else if evt.ChannelID == "" {
+		return "", ""
+	}
+	portal := br.GetExistingPortalByID(database.NewPortalKey(evt.ChannelID, ""))
+	if portal == nil || portal.Name == "" {
+		return "", ""
+	} else if portal.MXID == "" {
+		return portal.Name, html.EscapeString(portal.Name)
+	}
+	return portal.Name, fmt.Sprintf(`<a href="%s">%s</a>`, portal.MXID.URI(br.AS.HomeserverDomain).MatrixToURL(), html.EscapeString(portal.Name))
+}
+
+func (br *DiscordBridge) renderScheduledEvent(evt *discordgo.GuildScheduledEvent) (*event.MessageEventContent, *ScheduledEventInfo) {
+	info := &ScheduledEventInfo{
+		ID:          evt.ID,
+		Name:        evt.Name,
+		Description: evt.Description,
+		Start:       evt.ScheduledStartTime.UnixMilli(),
+		Status:      scheduledEventStatusName(evt.Status),
+		Interested:  evt.UserCount,
+		URL:         scheduledEventURL(evt),
+	}
+	var formatted strings.Builder
+	_, _ = fmt.Fprintf(&formatted, `<p>📅 <strong><a href="%s">%s</a></strong>`, info.URL, html.EscapeString(evt.Name))
+	switch evt.Status {
+	case discordgo.GuildScheduledEventStatusActive:
+		formatted.WriteString(" (happening now)")
+	case discordgo.GuildScheduledEventStatusCompleted:
+		formatted.WriteString(" (ended)")
+	case discordgo.GuildScheduledEventStatusCanceled:
+		formatted.WriteString(" (canceled)")
+	}
+	formatted.WriteString("</p><ul>")
+	_, _ = fmt.Fprintf(&formatted, "<li>Starts: %s</li>", evt.ScheduledStartTime.UTC().Format(scheduledEventTimeFormat))
+	if evt.ScheduledEndTime != nil {
+		info.End = evt.ScheduledEndTime.UnixMilli()
+		_, _ = fmt.Fprintf(&formatted, "<li>Ends: %s</li>", evt.ScheduledEndTime.UTC().Format(scheduledEventTimeFormat))
+	}
+	var locationHTML string
+	info.Location, locationHTML = br.scheduledEventLocationHTML(evt)
+	if locationHTML != "" {
+		_, _ = fmt.Fprintf(&formatted, "<li>Location: %s</li>", locationHTML)
+	}
+	if evt.UserCount > 0 {
+		_, _ = fmt.Fprintf(&formatted, "<li>Interested: %d</li>", evt.UserCount)
+	}
+	formatted.WriteString("</ul>")
+	if evt.Description != "" {
+		formatted.WriteString(format.RenderMarkdown(evt.Description, true, false).FormattedBody)
+	}
+	content := format.HTMLToContent(formatted.String())
+	content.MsgType = event.MsgNotice
+	return &content, info
+}
+
+// getScheduledEventRoom returns the room where scheduled event notices of the guild are sent,
+// which is the designated events portal if one is set and the guild space otherwise.
+// The returned portal is nil if the notices are sent to the space.
+func (guild *Guild) getScheduledEventRoom() (id.RoomID, *Portal) {
+	if guild.EventsChannel != "" {
+		portal := guild.bridge.GetExistingPortalByID(database.NewPortalKey(guild.EventsChannel, ""))
+		if portal != nil && portal.MXID != "" {
+			return portal.MXID, portal
+		}
+	}
+	return guild.MXID, nil
+}
+
+// HandleScheduledEvent sends a notice about a new scheduled event, or edits the existing notice if the event changed.
+func (guild *Guild) HandleScheduledEvent(evt *discordgo.GuildScheduledEvent) {
+	guild.scheduledEventLock.Lock()
+	defer guild.scheduledEventLock.Unlock()
+
+	content, info := guild.bridge.renderScheduledEvent(evt)
+	rendered := content.FormattedBody
+	existing := guild.bridge.DB.ScheduledEvent.GetByDiscordID(evt.ID)
+	if existing != nil && existing.Content == rendered {
+		return
+	}
+	roomID, portal := guild.getScheduledEventRoom()
+	if roomID == "" {
+		return
+	}
+	extraContent := map[string]any{"fi.mau.discord.scheduled_event": info}
+	if existing != nil && existing.RoomID == roomID {
+		content.SetEdit(existing.MXID)
+		extraContent["m.new_content"] = map[string]any{"fi.mau.discord.scheduled_event": info}
+	} else if existing == nil && evt.Status != discordgo.GuildScheduledEventStatusScheduled && evt.Status != discordgo.GuildScheduledEventStatusActive {
+		// Don't send new notices for events that are already over
+		return
+	}
+	var resp *mautrix.RespSendEvent
+	var err error
+	if portal != nil {
+		// Portals may be encrypted, so send through the portal
+		resp, err = portal.sendMatrixMessage(portal.MainIntent(), event.EventMessage, content, extraContent, 0)
+	} else {
+		resp, err = guild.bridge.Bot.SendMessageEvent(roomID, event.EventMessage, &event.Content{Parsed: content, Raw: extraContent})
+	}
+	if err != nil {
+		guild.log.Warnfln("Failed to send notice about scheduled event %s: %v", evt.ID, err)
+		return
+	}
+	if existing == nil {
+		existing = guild.bridge.DB.ScheduledEvent.New()
+		existing.DiscordID = evt.ID
+		existing.GuildID = guild.ID
+		existing.RoomID = roomID
+		existing.MXID = resp.EventID
+		existing.Content = rendered
+		existing.Insert()
+		guild.log.Debugfln("Sent notice %s about scheduled event %s", resp.EventID, evt.ID)
+	} else {
+		if existing.RoomID != roomID {
+			existing.RoomID = roomID
+			existing.MXID = resp.EventID
+		}
+		existing.Content = rendered
+		existing.Update()
+		guild.log.Debugfln("Updated notice %s about scheduled event %s", existing.MXID, evt.ID)
+	}
+}
+
+// HandleScheduledEventDelete redacts the notice about a deleted scheduled event.
+func (guild *Guild) HandleScheduledEventDelete(evt *discordgo.GuildScheduledEvent) {
+	guild.scheduledEventLock.Lock()
+	defer guild.scheduledEventLock.Unlock()
+
+	existing := guild.bridge.DB.ScheduledEvent.GetByDiscordID(evt.ID)
+	if existing == nil {
+		return
+	}
+	_, err := guild.bridge.Bot.RedactEvent(existing.RoomID, existing.MXID)
+	if err != nil {
+		guild.log.Warnfln("Failed to redact notice about deleted scheduled event %s: %v", evt.ID, err)
+	}
+	existing.Delete()
+}
+
+func (user *User) scheduledEventHandler(evt *discordgo.GuildScheduledEvent, deleted bool) {
+	if user.getGuildBridgingMode(evt.GuildID) <= database.GuildBridgeNothing {
+		return
+	}
+	guild := user.bridge.GetGuildByID(evt.GuildID, false)
+	if guild == nil || guild.MXID == "" {
+		return
+	} else if deleted {
+		guild.HandleScheduledEventDelete(evt)
+	} else {
+		guild.HandleScheduledEvent(evt)
+	}
+}
+
+// scheduledEventInterestHandler refetches the event to get the new interested user count.
+func (user *User) scheduledEventInterestHandler(guildID, eventID string) {
+	if user.getGuildBridgingMode(guildID) <= database.GuildBridgeNothing {
+		return
+	} else if guild := user.bridge.GetGuildByID(guildID, false); guild == nil || guild.MXID == "" {
+		return
+	}
+	evt, err := user.Session.GuildScheduledEvent(guildID, eventID, true)
+	if err != nil {
+		user.log.Warn().Err(err).
+			Str("guild_id", guildID).
+			Str("scheduled_event_id", eventID).
+			Msg("Failed to fetch scheduled event after interest change")
+		return
+	}
+	user.scheduledEventHandler(evt, false)
+}
+
+var cmdEvents = &commands.FullHandler{
+	Func: wrapCommand(fnEvents),
+	Name: "events",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionGeneral,
+		Description: "List upcoming scheduled events in a guild, or choose this room for scheduled event notices",
+		Args:        "[_guild ID_ | here | space]",
+	},
+	RequiresLogin: true,
+}
+
+func fnEvents(ce *WrappedCommandEvent) {
+	var guildID string
+	if len(ce.Args) > 0 && ce.Args[0] != "here" && ce.Args[0] != "space" {
+		guildID = ce.Args[0]
+	} else if ce.Portal != nil {
+		guildID = ce.Portal.GuildID
+	}
+	if guildID == "" {
+		ce.Reply("**Usage**: `$cmdprefix events <guild ID>`, or `$cmdprefix events [here|space]` in a guild channel portal")
+		return
+	}
+	guild := ce.Bridge.GetGuildByID(guildID, false)
+	if guild == nil {
+		ce.Reply("Guild not found")
+		return
+	}
+	if len(ce.Args) > 0 && (ce.Args[0] == "here" || ce.Args[0] == "space") {
+		if !ce.User.canManageGuild(guildID) {
+			ce.Reply("You need the Manage Server permission on Discord to change where scheduled event notices are sent")
+			return
+		}
+		target := "the guild space"
+		guild.EventsChannel = ""
+		if ce.Args[0] == "here" {
+			guild.EventsChannel = ce.Portal.Key.ChannelID
+			target = "this room"
+		}
+		guild.Update()
+		ce.Reply("Scheduled event notices for %s will now be sent to %s", guild.PlainName, target)
+		return
+	}
+	events, err := ce.User.Session.GuildScheduledEvents(guildID, true)
+	if err != nil {
+		ce.Reply("Failed to fetch scheduled events: %v", err)
+		return
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].ScheduledStartTime.Before(events[j].ScheduledStartTime)
+	})
+	var items []string
+	for _, evt := range events {
+		if evt.Status != discordgo.GuildScheduledEventStatusScheduled && evt.Status != discordgo.GuildScheduledEventStatusActive {
+			continue
+		}
+		item := fmt.Sprintf(`<a href="%s">%s</a> - %s`, scheduledEventURL(evt), html.EscapeString(evt.Name), evt.ScheduledStartTime.UTC().Format(scheduledEventTimeFormat))
+		if evt.Status == discordgo.GuildScheduledEventStatusActive {
+			item += " (happening now)"
+		}
+		if _, location := ce.Bridge.scheduledEventLocationHTML(evt); location != "" {
+			item += " in " + location
+		}
+		if evt.UserCount > 0 {
+			item += fmt.Sprintf(" (%d interested)", evt.UserCount)
+		}
+		items = append(items, "<li>"+item+"</li>")
+	}
+	if len(items) == 0 {
+		ce.Reply("No upcoming events in %s", guild.PlainName)
+	} else {
+		ce.ReplyAdvanced(fmt.Sprintf("<p>Upcoming events in %s:</p><ul>%s</ul>", html.EscapeString(guild.PlainName), strings.Join(items, "")), false, true)
+	}
+}
@@ -17,7 +17,8 @@ type Thread struct {
 	*database.Thread
 	Parent *Portal
 
-	creationNoticeLock       sync.Mutex
+	creationNoticeLock sync.Mutex
+	// initialBackfillAttempted must only be accessed with the parent portal's forwardBackfillLock held.
 	initialBackfillAttempted bool
 }
 
@@ -79,6 +80,12 @@ func (br *DiscordBridge) loadThread(dbThread *database.Thread, id string, root *
 }
 
 func (br *DiscordBridge) threadFound(ctx context.Context, source *User, rootMessage *database.Message, id string, metadata *discordgo.Channel) {
+	if source != nil {
+		if parent := br.getThreadRoomParent(rootMessage.Channel.ChannelID, id); parent != nil {
+			parent.createThreadRoom(source, id, metadata)
+			return
+		}
+	}
 	thread := br.GetThreadByID(id, rootMessage)
 	log := zerolog.Ctx(ctx)
 	log.Debug().Msg("Marked message as thread root")
@@ -100,12 +107,14 @@ func (br *DiscordBridge) threadFound(ctx context.Context, source *User, rootMess
 	}
 }
 
+// maybeInitialBackfill backfills the history of the thread if nothing has been bridged into it yet.
 func (thread *Thread) maybeInitialBackfill(source *User) {
-	if thread.initialBackfillAttempted || thread.Parent.bridge.Config.Bridge.Backfill.Limits.Initial.Thread == 0 {
+	if thread.Parent == nil || thread.Parent.MXID == "" || thread.Parent.bridge.Config.Bridge.Backfill.Limits.Initial.Thread == 0 {
 		return
 	}
 	thread.Parent.forwardBackfillLock.Lock()
-	if thread.Parent.bridge.DB.Message.GetLastInThread(thread.Parent.Key, thread.ID) != nil {
+	if thread.initialBackfillAttempted || thread.Parent.bridge.DB.Message.GetLastInThread(thread.Parent.Key, thread.ID) != nil {
+		thread.initialBackfillAttempted = true
 		thread.Parent.forwardBackfillLock.Unlock()
 		return
 	}
@@ -118,27 +127,12 @@ func (thread *Thread) RefererOpt() discordgo.RequestOption {
 
 func (thread *Thread) Join(user *User) {
 	if user.IsInPortal(thread.ID) {
+		go thread.maybeInitialBackfill(user)
 		return
 	}
 	log := user.log.With().Str("thread_id", thread.ID).Str("channel_id", thread.ParentID).Logger()
 	log.Debug().Msg("Joining thread")
 
-	var doBackfill, backfillStarted bool
-	if !thread.initialBackfillAttempted && thread.Parent.bridge.Config.Bridge.Backfill.Limits.Initial.Thread > 0 {
-		thread.Parent.forwardBackfillLock.Lock()
-		lastMessage := thread.Parent.bridge.DB.Message.GetLastInThread(thread.Parent.Key, thread.ID)
-		if lastMessage != nil {
-			thread.Parent.forwardBackfillLock.Unlock()
-		} else {
-			doBackfill = true
-			defer func() {
-				if !backfillStarted {
-					thread.Parent.forwardBackfillLock.Unlock()
-				}
-			}()
-		}
-	}
-
 	var err error
 	if user.Session.IsUser {
 		err = user.Session.ThreadJoin(thread.ID, discordgo.WithLocationParam(discordgo.ThreadJoinLocationContextMenu), thread.RefererOpt())
@@ -153,9 +147,6 @@ func (thread *Thread) Join(user *User) {
 			Type:      database.UserPortalTypeThread,
 			Timestamp: time.Now(),
 		})
-		if doBackfill {
-			go thread.Parent.forwardBackfillInitial(user, thread)
-			backfillStarted = true
-		}
+		go thread.maybeInitialBackfill(user)
 	}
 }
@@ -0,0 +1,232 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"html"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"golang.org/x/exp/slices"
+	"maunium.net/go/mautrix/bridge/commands"
+	"maunium.net/go/mautrix/event"
+
+	"go.mau.fi/mautrix-discord/database"
+)
+
+// When thread rooms are enabled for a guild, new Discord threads get their own portal keyed by the thread ID
+// instead of being bridged as Matrix threads inside the parent portal. Thread rooms are placed in the same space
+// as the parent channel, and a notice linking to the new room is sent in the parent portal.
+// Threads that were already bridged as Matrix threads keep being bridged that way.
+
+func (portal *Portal) IsThread() bool {
+	switch portal.Type {
+	case discordgo.ChannelTypeGuildPublicThread, discordgo.ChannelTypeGuildPrivateThread, discordgo.ChannelTypeGuildNewsThread:
+		return true
+	default:
+		return false
+	}
+}
+
+func (portal *Portal) threadRoomsEnabled() bool {
+	// Forum posts are always bridged as Matrix threads, see forum.go
+	return portal.Guild != nil && portal.Guild.ThreadRooms && !portal.IsForum() && !portal.IsThread()
+}
+
+// getThreadRoomParent returns the parent portal if the given thread should be bridged as a separate room.
+func (br *DiscordBridge) getThreadRoomParent(parentID, threadID string) *Portal {
+	if parentID == "" {
+		return nil
+	}
+	parent := br.GetExistingPortalByID(database.NewPortalKey(parentID, ""))
+	if parent == nil || parent.MXID == "" || !parent.threadRoomsEnabled() || br.GetThreadByID(threadID, nil) != nil {
+		return nil
+	}
+	return parent
+}
+
+// createThreadRoom creates the room for a thread in this portal, or returns the existing one.
+func (portal *Portal) createThreadRoom(source *User, threadID string, meta *discordgo.Channel) *Portal {
+	if existing := portal.bridge.GetExistingPortalByID(database.NewPortalKey(threadID, "")); existing != nil && existing.MXID != "" {
+		return existing
+	}
+	log := portal.log.With().
+		Str("action", "create thread room").
+		Str("thread_id", threadID).
+		Logger()
+	if meta == nil || meta.Type == 0 {
+		var err error
+		meta, err = source.getDiscordChannel(threadID)
+		if err != nil {
+			log.Err(err).Msg("Failed to get thread info")
+			return nil
+		}
+	}
+	threadPortal := source.GetPortalByMeta(meta)
+	err := threadPortal.CreateMatrixRoom(source, meta)
+	if err != nil {
+		log.Err(err).Msg("Failed to create thread room")
+		return nil
+	}
+	return threadPortal
+}
+
+// linkThreadRoom sends notices linking the thread room and the parent portal to each other.
+func (portal *Portal) linkThreadRoom() {
+	parent := portal.Parent
+	if parent == nil || parent.MXID == "" {
+		return
+	}
+	via := portal.bridge.AS.HomeserverDomain
+	roomLink := portal.MXID.URI(via).MatrixToURL()
+	content := &event.MessageEventContent{
+		MsgType:       event.MsgNotice,
+		Body:          fmt.Sprintf("Thread created: %s (%s)", portal.PlainName, roomLink),
+		Format:        event.FormatHTML,
+		FormattedBody: fmt.Sprintf(`Thread created: <a href="%s">%s</a>`, roomLink, html.EscapeString(portal.PlainName)),
+	}
+	parentLink := parent.MXID.URI(via).MatrixToURL()
+	// Threads started from a message have the same ID as the message
+	if root := portal.bridge.DB.Message.GetFirstByDiscordID(parent.Key, portal.Key.ChannelID); root != nil {
+		content.RelatesTo = (&event.RelatesTo{}).SetReplyTo(root.MXID)
+		parentLink = parent.MXID.EventURI(root.MXID, via).MatrixToURL()
+	}
+	_, err := parent.sendMatrixMessage(parent.MainIntent(), event.EventMessage, content, nil, time.Now().UnixMilli())
+	if err != nil {
+		portal.log.Err(err).Msg("Failed to send thread room link to parent portal")
+	}
+	_, err = portal.sendMatrixMessage(portal.MainIntent(), event.EventMessage, &event.MessageEventContent{
+		MsgType:       event.MsgNotice,
+		Body:          fmt.Sprintf("This thread was started in %s (%s)", parent.Name, parentLink),
+		Format:        event.FormatHTML,
+		FormattedBody: fmt.Sprintf(`This thread was started in <a href="%s">%s</a>`, parentLink, html.EscapeString(parent.Name)),
+	}, nil, time.Now().UnixMilli())
+	if err != nil {
+		portal.log.Err(err).Msg("Failed to send parent portal link to thread room")
+	}
+}
+
+func (portal *Portal) handleThreadArchiveChange(archived bool) {
+	body := "This thread was unarchived on Discord."
+	if archived {
+		body = "This thread was archived on Discord. It will be unarchived if someone sends a message in it."
+	}
+	_, err := portal.sendMatrixMessage(portal.MainIntent(), event.EventMessage, &event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    body,
+	}, nil, time.Now().UnixMilli())
+	if err != nil {
+		portal.log.Err(err).Bool("archived", archived).Msg("Failed to send thread archive notice")
+	}
+}
+
+// JoinThread joins the user to the Discord thread of a thread room.
+func (portal *Portal) JoinThread(user *User) {
+	if !portal.IsThread() || user.Session == nil || user.IsInPortal(portal.Key.ChannelID) {
+		return
+	}
+	log := user.log.With().Str("thread_id", portal.Key.ChannelID).Str("channel_id", portal.ParentID).Logger()
+	log.Debug().Msg("Joining thread")
+	var err error
+	if user.Session.IsUser {
+		err = user.Session.ThreadJoin(portal.Key.ChannelID, discordgo.WithLocationParam(discordgo.ThreadJoinLocationContextMenu), portal.RefererOpt(""))
+	} else {
+		err = user.Session.ThreadJoin(portal.Key.ChannelID)
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Error joining thread")
+		return
+	}
+	user.MarkInPortal(database.UserPortal{
+		DiscordID: portal.Key.ChannelID,
+		Type:      database.UserPortalTypeThread,
+		Timestamp: time.Now(),
+	})
+}
+
+func (user *User) threadCreateHandler(t *discordgo.ThreadCreate) {
+	if parent := user.bridge.getThreadRoomParent(t.ParentID, t.ID); parent != nil {
+		parent.createThreadRoom(user, t.ID, t.Channel)
+	}
+}
+
+func (user *User) threadUpdateHandler(t *discordgo.ThreadUpdate) {
+	if t.BeforeUpdate == nil || t.BeforeUpdate.Name != t.Name || !slices.Equal(t.BeforeUpdate.AppliedTags, t.AppliedTags) {
+		// The title and tags of forum posts are rendered in the root message, which is in the forum portal
+		if parent := user.GetExistingPortalByID(t.ParentID); parent != nil && parent.MXID != "" && parent.IsForum() {
+			user.pushPortalMessage(t, "thread update", t.ID, t.GuildID)
+		}
+	}
+	portal := user.GetExistingPortalByID(t.ID)
+	if portal == nil || portal.MXID == "" || !portal.IsThread() {
+		return
+	}
+	portal.UpdateInfo(user, t.Channel)
+	if t.BeforeUpdate != nil && t.BeforeUpdate.ThreadMetadata != nil && t.ThreadMetadata != nil &&
+		t.BeforeUpdate.ThreadMetadata.Archived != t.ThreadMetadata.Archived {
+		portal.handleThreadArchiveChange(t.ThreadMetadata.Archived)
+	}
+}
+
+var cmdThreadRooms = &commands.FullHandler{
+	Func: wrapCommand(fnThreadRooms),
+	Name: "thread-rooms",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionGeneral,
+		Description: "Choose whether new Discord threads in a guild are bridged as separate rooms or as Matrix threads",
+		Args:        "<on | off> [_guild ID_]",
+	},
+	RequiresLogin: true,
+}
+
+func fnThreadRooms(ce *WrappedCommandEvent) {
+	var guildID string
+	if len(ce.Args) > 1 {
+		guildID = ce.Args[1]
+	} else if ce.Portal != nil {
+		guildID = ce.Portal.GuildID
+	}
+	if len(ce.Args) == 0 || guildID == "" {
+		ce.Reply("**Usage**: `$cmdprefix thread-rooms <on|off> [guild ID]` (the guild ID can be omitted in guild channel portals)")
+		return
+	}
+	guild := ce.Bridge.GetGuildByID(guildID, false)
+	if guild == nil {
+		ce.Reply("Guild not found")
+		return
+	} else if !ce.User.canManageGuild(guildID) {
+		ce.Reply("You need the Manage Server permission on Discord to change how threads are bridged")
+		return
+	}
+	switch strings.ToLower(ce.Args[0]) {
+	case "on", "true", "enable":
+		guild.ThreadRooms = true
+	case "off", "false", "disable":
+		guild.ThreadRooms = false
+	default:
+		ce.Reply("**Usage**: `$cmdprefix thread-rooms <on|off> [guild ID]`")
+		return
+	}
+	guild.Update()
+	if guild.ThreadRooms {
+		ce.Reply("New threads in %s will now be bridged as separate rooms", guild.PlainName)
+	} else {
+		ce.Reply("New threads in %s will now be bridged as Matrix threads", guild.PlainName)
+	}
+}
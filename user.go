@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"math/rand"
@@ -21,10 +22,12 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/rs/zerolog"
 	"go.mau.fi/util/dbutil"
+	"golang.org/x/exp/slices"
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/appservice"
 	"maunium.net/go/mautrix/bridge"
 	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/bridge/commands"
 	"maunium.net/go/mautrix/bridge/status"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
@@ -67,7 +70,18 @@ type User struct {
 
 	nextDiscordUploadID atomic.Int32
 
-	relationships map[string]*discordgo.Relationship
+	relationships     map[string]*discordgo.Relationship
+	relationshipsLock sync.RWMutex
+
+	commandState     *commands.CommandState
+	commandStateLock sync.Mutex
+
+	provisioningListeners     map[chan *ProvisioningEvent]struct{}
+	provisioningListenersLock sync.RWMutex
+
+	presenceLock          sync.Mutex
+	lastPresenceStatus    discordgo.Status
+	lastPresenceStatusMsg string
 }
 
 func (user *User) GetRemoteID() string {
@@ -119,8 +133,31 @@ func (user *User) GetMXID() id.UserID {
 	return user.MXID
 }
 
-func (user *User) GetCommandState() map[string]interface{} {
-	return nil
+func (user *User) GetCommandState() *commands.CommandState {
+	user.commandStateLock.Lock()
+	defer user.commandStateLock.Unlock()
+	return user.commandState
+}
+
+func (user *User) SetCommandState(state *commands.CommandState) {
+	user.commandStateLock.Lock()
+	defer user.commandStateLock.Unlock()
+	// Let ongoing actions like QR logins know that they were cancelled or replaced
+	if prev := user.commandState; prev != nil && prev != state {
+		if canceller, ok := prev.Meta.(interface{ Cancel() }); ok {
+			canceller.Cancel()
+		}
+	}
+	user.commandState = state
+}
+
+// clearCommandState removes the given command state if it hasn't been replaced by another one in the meantime.
+func (user *User) clearCommandState(state *commands.CommandState) {
+	user.commandStateLock.Lock()
+	defer user.commandStateLock.Unlock()
+	if user.commandState == state {
+		user.commandState = nil
+	}
 }
 
 func (user *User) GetIDoublePuppet() bridge.DoublePuppet {
@@ -263,7 +300,7 @@ func (br *DiscordBridge) startUsers() {
 }
 
 func (user *User) startupTryConnect(retryCount int) {
-	user.BridgeState.Send(status.BridgeState{StateEvent: status.StateConnecting})
+	user.sendBridgeState(status.BridgeState{StateEvent: status.StateConnecting})
 	err := user.Connect()
 	if err != nil {
 		user.log.Error().Err(err).Msg("Error connecting on startup")
@@ -271,13 +308,13 @@ func (user *User) startupTryConnect(retryCount int) {
 		if errors.As(err, &closeErr) && closeErr.Code == 4004 {
 			user.invalidAuthHandler(nil)
 		} else if retryCount < 6 {
-			user.BridgeState.Send(status.BridgeState{StateEvent: status.StateTransientDisconnect, Error: "dc-unknown-websocket-error", Message: err.Error()})
+			user.sendBridgeState(status.BridgeState{StateEvent: status.StateTransientDisconnect, Error: "dc-unknown-websocket-error", Message: err.Error()})
 			retryInSeconds := 2 << retryCount
 			user.log.Debug().Int("retry_in_seconds", retryInSeconds).Msg("Sleeping and retrying connection")
 			time.Sleep(time.Duration(retryInSeconds) * time.Second)
 			user.startupTryConnect(retryCount + 1)
 		} else {
-			user.BridgeState.Send(status.BridgeState{StateEvent: status.StateUnknownError, Error: "dc-unknown-websocket-error", Message: err.Error()})
+			user.sendBridgeState(status.BridgeState{StateEvent: status.StateUnknownError, Error: "dc-unknown-websocket-error", Message: err.Error()})
 		}
 	}
 }
@@ -448,6 +485,13 @@ Loop:
 		err = user.Connect()
 		if err == nil {
 			user.Update()
+			evt := respLogin{Success: true, ID: user.DiscordID}
+			if user.Session.State.User != nil {
+				evt.ID = user.Session.State.User.ID
+				evt.Username = user.Session.State.User.Username
+				evt.Discriminator = user.Session.State.User.Discriminator
+			}
+			user.sendProvisioningEvent(ProvisioningEventLoginSuccess, evt)
 			return nil
 		}
 		user.log.Error().Err(err).Msg("Error connecting for login")
@@ -465,6 +509,10 @@ Loop:
 		}
 	}
 	user.DiscordToken = ""
+	user.sendProvisioningEvent(ProvisioningEventLoginFailed, provisioningEventLoginError{
+		Error:   fmt.Sprintf("Failed to connect to Discord: %v", err),
+		ErrCode: ErrCodePostLoginConnFailed,
+	})
 	return err
 }
 
@@ -526,13 +574,12 @@ const BotIntents = discordgo.IntentGuilds |
 	discordgo.IntentGuildIntegrations |
 	discordgo.IntentGuildInvites |
 	//discordgo.IntentGuildVoiceStates |
-	//discordgo.IntentGuildScheduledEvents |
+	discordgo.IntentGuildScheduledEvents |
 	discordgo.IntentDirectMessages |
 	discordgo.IntentDirectMessageTyping |
 	discordgo.IntentDirectMessageTyping |
 	// Privileged intents
 	discordgo.IntentMessageContent |
-	//discordgo.IntentGuildPresences |
 	discordgo.IntentGuildMembers
 
 func (user *User) Connect() error {
@@ -574,6 +621,12 @@ func (user *User) Connect() error {
 	}
 	if !session.IsUser {
 		session.Identify.Intents = BotIntents
+		if user.bridge.Config.Bridge.PresenceFromDiscord {
+			session.Identify.Intents |= discordgo.IntentGuildPresences
+		}
+		if user.bridge.Config.Bridge.VoiceStateNotices {
+			session.Identify.Intents |= discordgo.IntentGuildVoiceStates
+		}
 	}
 	session.EventHandler = user.eventHandlerSync
 
@@ -638,8 +691,14 @@ func (user *User) eventHandler(rawEvt any) {
 		user.discordRoleToDB(evt.GuildID, evt.Role, nil, nil)
 	case *discordgo.GuildRoleUpdate:
 		user.discordRoleToDB(evt.GuildID, evt.Role, nil, nil)
+		user.updateGuildPowerLevels(evt.GuildID)
 	case *discordgo.GuildRoleDelete:
 		user.bridge.DB.Role.DeleteByID(evt.GuildID, evt.RoleID)
+		user.updateGuildPowerLevels(evt.GuildID)
+	case *discordgo.GuildMemberUpdate:
+		user.guildMemberUpdateHandler(evt)
+	case *discordgo.GuildEmojisUpdate:
+		user.guildEmojisUpdateHandler(evt)
 	case *discordgo.ChannelCreate:
 		user.channelCreateHandler(evt)
 	case *discordgo.ChannelDelete:
@@ -657,7 +716,7 @@ func (user *User) eventHandler(rawEvt any) {
 	case *discordgo.RelationshipUpdate:
 		user.relationshipUpdateHandler(evt)
 	case *discordgo.MessageCreate:
-		user.pushPortalMessage(evt, "message create", evt.ChannelID, evt.GuildID)
+		// Handled through the raw event below, which includes forwarded message snapshots
 	case *discordgo.MessageDelete:
 		user.pushPortalMessage(evt, "message delete", evt.ChannelID, evt.GuildID)
 	case *discordgo.MessageDeleteBulk:
@@ -668,16 +727,48 @@ func (user *User) eventHandler(rawEvt any) {
 		user.pushPortalMessage(evt, "reaction add", evt.ChannelID, evt.GuildID)
 	case *discordgo.MessageReactionRemove:
 		user.pushPortalMessage(evt, "reaction remove", evt.ChannelID, evt.GuildID)
+	case *discordgo.MessagePollVoteAdd:
+		user.pushPortalMessage(evt, "poll vote add", evt.ChannelID, evt.GuildID)
+	case *discordgo.MessagePollVoteRemove:
+		user.pushPortalMessage(evt, "poll vote remove", evt.ChannelID, evt.GuildID)
+	case *discordgo.ChannelPinsUpdate:
+		user.pushPortalMessage(evt, "pins update", evt.ChannelID, evt.GuildID)
+	case *discordgo.GuildScheduledEventCreate:
+		user.scheduledEventHandler(evt.GuildScheduledEvent, false)
+	case *discordgo.GuildScheduledEventUpdate:
+		user.scheduledEventHandler(evt.GuildScheduledEvent, false)
+	case *discordgo.GuildScheduledEventDelete:
+		user.scheduledEventHandler(evt.GuildScheduledEvent, true)
+	case *discordgo.GuildScheduledEventUserAdd:
+		user.scheduledEventInterestHandler(evt.GuildID, evt.GuildScheduledEventID)
+	case *discordgo.GuildScheduledEventUserRemove:
+		user.scheduledEventInterestHandler(evt.GuildID, evt.GuildScheduledEventID)
+	case *discordgo.VoiceStateUpdate:
+		user.voiceStateUpdateHandler(evt)
 	case *discordgo.MessageAck:
 		user.messageAckHandler(evt)
 	case *discordgo.TypingStart:
 		user.typingStartHandler(evt)
+	case *discordgo.PresenceUpdate:
+		user.presenceUpdateHandler(&evt.Presence)
 	case *discordgo.InteractionSuccess:
 		user.interactionSuccessHandler(evt)
 	case *discordgo.ThreadListSync:
 		user.threadListSyncHandler(evt)
+	case *discordgo.ThreadCreate:
+		user.threadCreateHandler(evt)
+	case *discordgo.ThreadUpdate:
+		user.threadUpdateHandler(evt)
+	case *discordgo.ThreadDelete:
+		user.channelDeleteHandler(&discordgo.ChannelDelete{Channel: evt.Channel})
 	case *discordgo.Event:
-		// Ignore
+		switch evt.Type {
+		case "GUILD_STICKERS_UPDATE":
+			// discordgo doesn't have a struct for sticker updates, so parse the raw event
+			user.guildStickersUpdateHandler(evt)
+		case "MESSAGE_CREATE":
+			user.messageCreateHandler(evt)
+		}
 	default:
 		user.log.Debug().Type("event_type", evt).Msg("Unhandled event")
 	}
@@ -746,12 +837,17 @@ func (user *User) readyHandler(r *discordgo.Ready) {
 		user.bridge.usersLock.Unlock()
 		user.Update()
 	}
-	user.BridgeState.Send(status.BridgeState{StateEvent: status.StateBackfilling})
+	user.sendBridgeState(status.BridgeState{StateEvent: status.StateBackfilling})
 	user.tryAutomaticDoublePuppeting()
 
+	user.relationshipsLock.Lock()
 	for _, relationship := range r.Relationships {
 		user.relationships[relationship.ID] = relationship
 	}
+	user.relationshipsLock.Unlock()
+	for _, presence := range r.Presences {
+		user.presenceUpdateHandler(presence)
+	}
 
 	updateTS := time.Now()
 	portalsInSpace := make(map[string]bool)
@@ -783,7 +879,7 @@ func (user *User) readyHandler(r *discordgo.Ready) {
 
 	go user.subscribeGuilds(2 * time.Second)
 
-	user.BridgeState.Send(status.BridgeState{StateEvent: status.StateConnected})
+	user.sendBridgeState(status.BridgeState{StateEvent: status.StateConnected})
 }
 
 func (user *User) subscribeGuilds(delay time.Duration) {
@@ -833,22 +929,47 @@ func (user *User) addPrivateChannelToSpace(portal *Portal) bool {
 
 func (user *User) relationshipAddHandler(r *discordgo.RelationshipAdd) {
 	user.log.Debug().Interface("relationship", r.Relationship).Msg("Relationship added")
+	user.relationshipsLock.Lock()
 	user.relationships[r.ID] = r.Relationship
+	user.relationshipsLock.Unlock()
 	user.handleRelationshipChange(r.ID, r.Nickname)
 }
 
 func (user *User) relationshipUpdateHandler(r *discordgo.RelationshipUpdate) {
 	user.log.Debug().Interface("relationship", r.Relationship).Msg("Relationship update")
+	user.relationshipsLock.Lock()
 	user.relationships[r.ID] = r.Relationship
+	user.relationshipsLock.Unlock()
 	user.handleRelationshipChange(r.ID, r.Nickname)
 }
 
 func (user *User) relationshipRemoveHandler(r *discordgo.RelationshipRemove) {
 	user.log.Debug().Str("other_user_id", r.ID).Msg("Relationship removed")
+	user.relationshipsLock.Lock()
 	delete(user.relationships, r.ID)
+	user.relationshipsLock.Unlock()
 	user.handleRelationshipChange(r.ID, "")
 }
 
+func (user *User) getRelationship(userID string) *discordgo.Relationship {
+	user.relationshipsLock.RLock()
+	defer user.relationshipsLock.RUnlock()
+	return user.relationships[userID]
+}
+
+// getFriends returns the relationships of the user whose type is friend.
+func (user *User) getFriends() []*discordgo.Relationship {
+	user.relationshipsLock.RLock()
+	defer user.relationshipsLock.RUnlock()
+	friends := make([]*discordgo.Relationship, 0, len(user.relationships))
+	for _, rel := range user.relationships {
+		if rel.Type == discordgo.RelationshipFriend {
+			friends = append(friends, rel)
+		}
+	}
+	return friends
+}
+
 func (user *User) handleRelationshipChange(userID, nickname string) {
 	puppet := user.bridge.GetPuppetByID(userID)
 	portal := user.FindPrivateChatWith(userID)
@@ -946,6 +1067,25 @@ func (user *User) discordRoleToDB(guildID string, role *discordgo.Role, dbRole *
 	return changed
 }
 
+func (user *User) updateGuildPowerLevels(guildID string) {
+	for _, portal := range user.bridge.GetAllPortalsInGuild(guildID) {
+		portal.schedulePowerLevelUpdate(user, nil)
+	}
+}
+
+func (user *User) guildMemberUpdateHandler(evt *discordgo.GuildMemberUpdate) {
+	if evt.User != nil && (evt.BeforeUpdate == nil || evt.BeforeUpdate.Nick != evt.Nick || evt.BeforeUpdate.Avatar != evt.Avatar) {
+		puppet := user.bridge.GetPuppetByID(evt.User.ID)
+		for _, portal := range user.bridge.GetAllPortalsInGuild(evt.GuildID) {
+			puppet.UpdateGuildMemberMeta(portal, evt.Member)
+		}
+	}
+	if evt.BeforeUpdate != nil && slices.Equal(evt.BeforeUpdate.Roles, evt.Roles) {
+		return
+	}
+	user.updateGuildPowerLevels(evt.GuildID)
+}
+
 func (user *User) handleGuildRoles(guildID string, newRoles []*discordgo.Role) {
 	existingRoles := user.bridge.DB.Role.GetAll(guildID)
 	existingRoleMap := make(map[string]*database.Role, len(existingRoles))
@@ -1000,9 +1140,18 @@ func (user *User) handleGuild(meta *discordgo.Guild, timestamp time.Time, isInSp
 			}
 		}
 	}
+	if len(meta.Threads) > 0 && (user.bridge.Config.Bridge.Backfill.MaxGuildMembers < 0 || meta.MemberCount < user.bridge.Config.Bridge.Backfill.MaxGuildMembers) {
+		user.handleGuildThreads(meta.Threads)
+	}
 	if len(meta.Roles) > 0 {
 		user.handleGuildRoles(meta.ID, meta.Roles)
 	}
+	if len(meta.Channels) > 0 {
+		user.handleGuildVoiceStates(meta)
+	}
+	if guild.MXID != "" && (meta.Emojis != nil || meta.Stickers != nil) {
+		guild.QueueEmotePackUpdate(meta.Emojis, meta.Stickers)
+	}
 	user.addGuildToSpace(guild, isInSpace, timestamp)
 }
 
@@ -1012,7 +1161,7 @@ func (user *User) connectedHandler(_ *discordgo.Connect) {
 	user.log.Debug().Msg("Connected to Discord")
 	if user.wasDisconnected {
 		user.wasDisconnected = false
-		user.BridgeState.Send(status.BridgeState{StateEvent: status.StateConnected})
+		user.sendBridgeState(status.BridgeState{StateEvent: status.StateConnected})
 	}
 }
 
@@ -1025,7 +1174,7 @@ func (user *User) disconnectedHandler(_ *discordgo.Disconnect) {
 	}
 	user.log.Debug().Msg("Disconnected from Discord")
 	user.wasDisconnected = true
-	user.BridgeState.Send(status.BridgeState{StateEvent: status.StateTransientDisconnect, Error: "dc-transient-disconnect", Message: "Temporarily disconnected from Discord, trying to reconnect"})
+	user.sendBridgeState(status.BridgeState{StateEvent: status.StateTransientDisconnect, Error: "dc-transient-disconnect", Message: "Temporarily disconnected from Discord, trying to reconnect"})
 }
 
 func (user *User) invalidAuthHandler(_ *discordgo.InvalidAuth) {
@@ -1033,7 +1182,7 @@ func (user *User) invalidAuthHandler(_ *discordgo.InvalidAuth) {
 	defer user.bridgeStateLock.Unlock()
 	user.log.Info().Msg("Got logged out from Discord due to invalid token")
 	user.wasLoggedOut = true
-	user.BridgeState.Send(status.BridgeState{StateEvent: status.StateBadCredentials, Error: "dc-websocket-disconnect-4004", Message: "Discord access token is no longer valid, please log in again"})
+	user.sendBridgeState(status.BridgeState{StateEvent: status.StateBadCredentials, Error: "dc-websocket-disconnect-4004", Message: "Discord access token is no longer valid, please log in again"})
 	go user.Logout(false)
 }
 
@@ -1042,7 +1191,7 @@ func (user *User) handlePossible40002(err error) bool {
 	if !errors.As(err, &restErr) || restErr.Message == nil || restErr.Message.Code != discordgo.ErrCodeActionRequiredVerifiedAccount {
 		return false
 	}
-	user.BridgeState.Send(status.BridgeState{StateEvent: status.StateBadCredentials, Error: "dc-http-40002", Message: restErr.Message.Message})
+	user.sendBridgeState(status.BridgeState{StateEvent: status.StateBadCredentials, Error: "dc-http-40002", Message: restErr.Message.Message})
 	return true
 }
 
@@ -1052,7 +1201,16 @@ func (user *User) guildCreateHandler(g *discordgo.GuildCreate) {
 		Str("name", g.Name).
 		Bool("unavailable", g.Unavailable).
 		Msg("Got guild create event")
+	// Guilds are also sent after connecting and when lazily loaded, only ones that aren't in the portal list yet are new joins.
+	isNewGuild := !user.IsInPortal(g.ID)
 	user.handleGuild(g.Guild, time.Now(), false)
+	if isNewGuild && !g.Unavailable {
+		evt := provisioningEventGuild{ID: g.ID, Name: g.Name}
+		if guild := user.bridge.GetGuildByID(g.ID, false); guild != nil {
+			evt.MXID = guild.MXID
+		}
+		user.sendProvisioningEvent(ProvisioningEventGuildJoin, evt)
+	}
 }
 
 func (user *User) guildDeleteHandler(g *discordgo.GuildDelete) {
@@ -1063,6 +1221,12 @@ func (user *User) guildDeleteHandler(g *discordgo.GuildDelete) {
 	user.log.Info().Str("guild_id", g.ID).Msg("Got guild delete event")
 	user.MarkNotInPortal(g.ID)
 	guild := user.bridge.GetGuildByID(g.ID, false)
+	evt := provisioningEventGuild{ID: g.ID}
+	if guild != nil {
+		evt.Name = guild.PlainName
+		evt.MXID = guild.MXID
+	}
+	user.sendProvisioningEvent(ProvisioningEventGuildLeave, evt)
 	if guild == nil || guild.MXID == "" {
 		return
 	}
@@ -1080,7 +1244,58 @@ func (user *User) guildUpdateHandler(g *discordgo.GuildUpdate) {
 	user.handleGuild(g.Guild, time.Now(), user.IsInSpace(g.ID))
 }
 
+func (user *User) guildEmojisUpdateHandler(evt *discordgo.GuildEmojisUpdate) {
+	guild := user.bridge.GetGuildByID(evt.GuildID, false)
+	if guild == nil || guild.MXID == "" {
+		return
+	}
+	user.log.Debug().Str("guild_id", evt.GuildID).Int("emoji_count", len(evt.Emojis)).Msg("Got guild emojis update event")
+	emojis := evt.Emojis
+	if emojis == nil {
+		emojis = []*discordgo.Emoji{}
+	}
+	guild.QueueEmotePackUpdate(emojis, nil)
+}
+
+type guildStickersUpdate struct {
+	GuildID  string               `json:"guild_id"`
+	Stickers []*discordgo.Sticker `json:"stickers"`
+}
+
+func (user *User) guildStickersUpdateHandler(rawEvt *discordgo.Event) {
+	var evt guildStickersUpdate
+	err := json.Unmarshal(rawEvt.RawData, &evt)
+	if err != nil {
+		user.log.Warn().Err(err).Msg("Failed to parse guild stickers update event")
+		return
+	}
+	guild := user.bridge.GetGuildByID(evt.GuildID, false)
+	if guild == nil || guild.MXID == "" {
+		return
+	}
+	user.log.Debug().Str("guild_id", evt.GuildID).Int("sticker_count", len(evt.Stickers)).Msg("Got guild stickers update event")
+	if evt.Stickers == nil {
+		evt.Stickers = []*discordgo.Sticker{}
+	}
+	guild.QueueEmotePackUpdate(nil, evt.Stickers)
+}
+
+func (user *User) messageCreateHandler(rawEvt *discordgo.Event) {
+	evt, ok := rawEvt.Struct.(*discordgo.MessageCreate)
+	if !ok || evt.Message == nil {
+		return
+	}
+	if isPossibleForward(evt.Message) {
+		user.bridge.cacheForwardSnapshots(user.log.With().Str("message_id", evt.ID).Logger(), rawEvt.RawData, false)
+	}
+	user.pushPortalMessage(evt, "message create", evt.ChannelID, evt.GuildID)
+}
+
 func (user *User) threadListSyncHandler(t *discordgo.ThreadListSync) {
+	joinedThreads := make(map[string]struct{}, len(t.Members))
+	for _, member := range t.Members {
+		joinedThreads[member.ID] = struct{}{}
+	}
 	for _, meta := range t.Threads {
 		log := user.log.With().
 			Str("action", "thread list sync").
@@ -1089,18 +1304,58 @@ func (user *User) threadListSyncHandler(t *discordgo.ThreadListSync) {
 			Str("thread_id", meta.ID).
 			Logger()
 		ctx := log.WithContext(context.Background())
+		if portal := user.GetExistingPortalByID(meta.ID); portal != nil && portal.IsThread() {
+			portal.ForwardBackfillMissed(user, meta.LastMessageID, nil)
+			continue
+		}
 		thread := user.bridge.GetThreadByID(meta.ID, nil)
 		if thread == nil {
 			msg := user.bridge.DB.Message.GetByDiscordID(database.NewPortalKey(meta.ParentID, ""), meta.ID)
 			if len(msg) == 0 {
 				log.Debug().Msg("Found unknown thread in thread list sync and don't have message")
-			} else {
-				log.Debug().Msg("Found unknown thread in thread list sync for existing message, creating thread")
-				user.bridge.threadFound(ctx, user, msg[0], meta.ID, meta)
+				continue
 			}
-		} else {
+			parent := user.bridge.GetExistingPortalByID(msg[0].Channel)
+			if parent == nil {
+				log.Debug().Msg("Found unknown thread in thread list sync, but parent portal doesn't exist")
+				continue
+			}
+			log.Debug().Msg("Found unknown thread in thread list sync for existing message, creating thread")
+			// Threads are found with the parent's backfill lock held everywhere else, as it protects the backfill state of the thread
+			parent.forwardBackfillLock.Lock()
+			user.bridge.threadFound(ctx, user, msg[0], meta.ID, meta)
+			parent.forwardBackfillLock.Unlock()
+			thread = user.bridge.GetThreadByID(meta.ID, nil)
+		} else if thread.Parent != nil {
 			thread.Parent.ForwardBackfillMissed(user, meta.LastMessageID, thread)
 		}
+		if _, joined := joinedThreads[meta.ID]; joined && thread != nil {
+			if !user.IsInPortal(thread.ID) {
+				user.MarkInPortal(database.UserPortal{
+					DiscordID: thread.ID,
+					Type:      database.UserPortalTypeThread,
+					Timestamp: time.Now(),
+				})
+			}
+			if meta.MessageCount > 0 {
+				go thread.maybeInitialBackfill(user)
+			}
+		}
+	}
+}
+
+// handleGuildThreads backfills missed messages in all known threads of the guild.
+func (user *User) handleGuildThreads(threads []*discordgo.Channel) {
+	for _, meta := range threads {
+		if portal := user.GetExistingPortalByID(meta.ID); portal != nil && portal.IsThread() {
+			portal.ForwardBackfillMissed(user, meta.LastMessageID, nil)
+			continue
+		}
+		thread := user.bridge.GetThreadByID(meta.ID, nil)
+		if thread == nil || thread.Parent == nil {
+			continue
+		}
+		thread.Parent.ForwardBackfillMissed(user, meta.LastMessageID, thread)
 	}
 }
 
@@ -1187,6 +1442,17 @@ func (user *User) findPortal(channelID string) (*Portal, *Thread) {
 	if thread != nil && thread.Parent != nil {
 		return thread.Parent, thread
 	}
+	if channel, _ := user.Session.State.Channel(channelID); channel != nil && channel.IsThread() {
+		// Unknown forum posts are bridged by the forum portal when it receives the first message
+		if parent := user.GetExistingPortalByID(channel.ParentID); parent != nil && parent.IsForum() {
+			return parent, nil
+		}
+		if parent := user.bridge.getThreadRoomParent(channel.ParentID, channelID); parent != nil {
+			if portal = parent.createThreadRoom(user, channelID, channel); portal != nil {
+				return portal, nil
+			}
+		}
+	}
 	if !user.Session.IsUser {
 		channel, _ := user.Session.State.Channel(channelID)
 		if channel == nil {
@@ -1473,6 +1739,7 @@ func (user *User) bridgeGuild(guildID string, everything bool) error {
 	}
 	log := user.log.With().Str("guild_id", guild.ID).Logger()
 	user.addGuildToSpace(guild, false, time.Now())
+	guild.QueueEmotePackUpdate(meta.Emojis, meta.Stickers)
 	for _, ch := range meta.Channels {
 		portal := user.GetPortalByMeta(ch)
 		if (everything && user.channelIsBridgeable(ch)) || ch.Type == discordgo.ChannelTypeGuildCategory {
@@ -1529,3 +1796,113 @@ func (user *User) unbridgeGuild(guildID string) error {
 	guild.RemoveMXID()
 	return nil
 }
+
+var (
+	errChannelNotFound       = errors.New("channel not found")
+	errChannelNotBridgeable  = errors.New("that channel can't be bridged")
+	errChannelAlreadyBridged = errors.New("that channel is already bridged")
+	errRoomAlreadyBridged    = errors.New("that room is already a portal")
+	errGuildBridgesNothing   = errors.New("that guild is set to not bridge any messages")
+	errNoUnbridgePermission  = errors.New("you don't have the permissions to unbridge the old room")
+)
+
+// canModerateRoom checks if the user has the power level required for portal management commands in the given room.
+func (user *User) canModerateRoom(intent *appservice.IntentAPI, roomID id.RoomID) (bool, error) {
+	if user.PermissionLevel >= bridgeconfig.PermissionLevelAdmin {
+		return true, nil
+	}
+	levels, err := intent.PowerLevels(roomID)
+	if err != nil {
+		return false, err
+	}
+	return levels.GetUserLevel(user.MXID) >= levels.GetEventLevel(roomModerator), nil
+}
+
+// bridgeChannel links an existing Matrix room to a Discord channel.
+// If the channel is already bridged, the old room is unbridged (and deleted if deleteOld is set) only if replace is set.
+func (user *User) bridgeChannel(channelID string, roomID id.RoomID, replace, deleteOld bool) (*Portal, error) {
+	if user.bridge.GetPortalByMXID(roomID) != nil {
+		return nil, errRoomAlreadyBridged
+	}
+	portal := user.GetExistingPortalByID(channelID)
+	if portal == nil {
+		return nil, errChannelNotFound
+	}
+	log := user.log.With().
+		Str("action", "bridge channel").
+		Str("channel_id", portal.Key.ChannelID).
+		Str("room_id", roomID.String()).
+		Logger()
+	portal.roomCreateLock.Lock()
+	defer portal.roomCreateLock.Unlock()
+	if portal.MXID != "" {
+		hasUnbridgePermission, err := user.canModerateRoom(portal.MainIntent(), portal.MXID)
+		if errors.Is(err, mautrix.MNotFound) {
+			log.Debug().Err(err).Msg("Got M_NOT_FOUND trying to get power levels to check if user can unbridge it, assuming the room is gone")
+			hasUnbridgePermission = true
+		} else if err != nil {
+			return portal, fmt.Errorf("failed to get power levels in old room: %w", err)
+		}
+		if !hasUnbridgePermission {
+			return portal, errNoUnbridgePermission
+		} else if !replace {
+			return portal, errChannelAlreadyBridged
+		}
+		log.Debug().
+			Str("old_room_id", portal.MXID.String()).
+			Bool("delete", deleteOld).
+			Msg("Unbridging old room")
+		portal.removeFromSpace()
+		portal.cleanup(!deleteOld)
+		portal.RemoveMXID()
+		log.Info().
+			Str("old_room_id", portal.MXID.String()).
+			Bool("delete", deleteOld).
+			Msg("Unbridged old room to make space for new bridge")
+	}
+	if portal.Guild != nil && portal.Guild.BridgingMode < database.GuildBridgeIfPortalExists {
+		log.Debug().Str("guild_id", portal.Guild.ID).Msg("Bumping bridging mode of portal guild to if-portal-exists")
+		portal.Guild.BridgingMode = database.GuildBridgeIfPortalExists
+		portal.Guild.Update()
+	}
+	log.Debug().Msg("Bridging room")
+	portal.MXID = roomID
+	portal.bridge.portalsLock.Lock()
+	portal.bridge.portalsByMXID[portal.MXID] = portal
+	portal.bridge.portalsLock.Unlock()
+	portal.updateRoomName()
+	portal.updateRoomAvatar()
+	portal.updateRoomTopic()
+	portal.updateSpace(user)
+	portal.UpdateBridgeInfo()
+	state, err := portal.MainIntent().State(portal.MXID)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to update state cache for room")
+	} else {
+		encryptionEvent, isEncrypted := state[event.StateEncryption][""]
+		portal.Encrypted = isEncrypted && encryptionEvent.Content.AsEncryption().Algorithm == id.AlgorithmMegolmV1
+	}
+	portal.Update()
+	log.Info().Bool("encrypted", portal.Encrypted).Msg("Manual bridging complete")
+	return portal, nil
+}
+
+// createPortal creates a new Matrix room for the given channel.
+func (user *User) createPortal(channelID string) (*Portal, error) {
+	meta, err := user.Session.Channel(channelID)
+	var restErr *discordgo.RESTError
+	if errors.As(err, &restErr) && (restErr.Response.StatusCode == http.StatusNotFound || restErr.Response.StatusCode == http.StatusForbidden) {
+		return nil, errChannelNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get channel info: %w", err)
+	} else if !user.channelIsBridgeable(meta) {
+		return nil, errChannelNotBridgeable
+	}
+	portal := user.GetPortalByMeta(meta)
+	if portal.Guild != nil && portal.Guild.BridgingMode == database.GuildBridgeNothing {
+		return portal, errGuildBridgesNothing
+	} else if portal.MXID != "" {
+		return portal, errChannelAlreadyBridged
+	}
+	return portal, portal.CreateMatrixRoom(user, meta)
+}
@@ -0,0 +1,163 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/bwmarrin/discordgo"
+	"go.mau.fi/util/ffmpeg"
+	"maunium.net/go/mautrix/event"
+)
+
+const (
+	// Discord waveforms have at most 256 samples with values from 0 to 255.
+	maxDiscordWaveformLength = 256
+	maxDiscordWaveformValue  = 255
+	// Matrix waveforms (MSC3246) have values from 0 to 1024.
+	maxMatrixWaveformValue = 1024
+
+	voiceMessageSampleRate = 8000
+	voiceMessageFilename   = "voice-message.ogg"
+	voiceMessageMimeType   = "audio/ogg"
+)
+
+const (
+	keyMSC1767Audio = "org.matrix.msc1767.audio"
+	keyMSC3245Voice = "org.matrix.msc3245.voice"
+)
+
+type VoiceMessage struct {
+	Data     []byte
+	Duration float64
+	Waveform []byte
+}
+
+func isMatrixVoiceMessage(evt *event.Event) bool {
+	_, isVoice := evt.Content.Raw[keyMSC3245Voice]
+	return isVoice
+}
+
+// resampleWaveform scales the waveform to Discord's value range and reduces it to at most maxDiscordWaveformLength samples.
+func resampleWaveform(samples []float64, maxValue float64) []byte {
+	if len(samples) == 0 || maxValue <= 0 {
+		return nil
+	}
+	length := len(samples)
+	if length > maxDiscordWaveformLength {
+		length = maxDiscordWaveformLength
+	}
+	waveform := make([]byte, length)
+	for i := range waveform {
+		start := i * len(samples) / length
+		end := (i + 1) * len(samples) / length
+		var peak float64
+		for _, sample := range samples[start:end] {
+			peak = math.Max(peak, sample)
+		}
+		waveform[i] = byte(math.Round(math.Min(peak/maxValue, 1) * maxDiscordWaveformValue))
+	}
+	return waveform
+}
+
+// parseMatrixVoiceMeta reads the duration (in seconds) and waveform from the extensible audio metadata of a Matrix event.
+func parseMatrixVoiceMeta(evt *event.Event, content *event.MessageEventContent) (duration float64, waveform []byte) {
+	if content.Info != nil && content.Info.Duration > 0 {
+		duration = float64(content.Info.Duration) / 1000
+	}
+	audio, ok := evt.Content.Raw[keyMSC1767Audio].(map[string]any)
+	if !ok {
+		return
+	}
+	if rawDuration, ok := audio["duration"].(float64); ok && rawDuration > 0 {
+		duration = rawDuration / 1000
+	}
+	if rawWaveform, ok := audio["waveform"].([]any); ok {
+		samples := make([]float64, 0, len(rawWaveform))
+		for _, rawSample := range rawWaveform {
+			sample, _ := rawSample.(float64)
+			samples = append(samples, sample)
+		}
+		waveform = resampleWaveform(samples, maxMatrixWaveformValue)
+	}
+	return
+}
+
+// decodeVoiceMessage decodes the audio into mono PCM with ffmpeg to compute the duration and waveform.
+func decodeVoiceMessage(ctx context.Context, data []byte, mimeType string) (duration float64, waveform []byte, err error) {
+	pcm, err := ffmpeg.ConvertBytes(ctx, data, ".raw", nil, []string{
+		"-f", "s16le", "-ac", "1", "-ar", fmt.Sprint(voiceMessageSampleRate),
+	}, mimeType)
+	if err != nil {
+		return 0, nil, err
+	}
+	samples := make([]float64, len(pcm)/2)
+	for i := range samples {
+		samples[i] = math.Abs(float64(int16(binary.LittleEndian.Uint16(pcm[i*2:]))))
+	}
+	duration = float64(len(samples)) / voiceMessageSampleRate
+	return duration, resampleWaveform(samples, math.MaxInt16), nil
+}
+
+// convertMatrixVoiceMessage prepares a Matrix voice message to be sent as a Discord voice message,
+// which must be ogg/opus and include the duration and waveform.
+func convertMatrixVoiceMessage(ctx context.Context, evt *event.Event, content *event.MessageEventContent, data []byte) (*VoiceMessage, error) {
+	var mimeType string
+	if content.Info != nil {
+		mimeType = content.Info.MimeType
+	}
+	voice := &VoiceMessage{Data: data}
+	voice.Duration, voice.Waveform = parseMatrixVoiceMeta(evt, content)
+	if mimeType != voiceMessageMimeType {
+		var err error
+		voice.Data, err = ffmpeg.ConvertBytes(ctx, data, ".ogg", nil, []string{"-c:a", "libopus"}, mimeType)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert audio to ogg/opus: %w", err)
+		}
+	}
+	if voice.Duration == 0 || len(voice.Waveform) == 0 {
+		duration, waveform, err := decodeVoiceMessage(ctx, data, mimeType)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode audio: %w", err)
+		}
+		if voice.Duration == 0 {
+			voice.Duration = duration
+		}
+		if len(voice.Waveform) == 0 {
+			voice.Waveform = waveform
+		}
+	}
+	return voice, nil
+}
+
+// convertDiscordVoiceMeta converts the waveform and duration of a Discord voice message into Matrix extensible event fields.
+func convertDiscordVoiceMeta(att *discordgo.MessageAttachment) map[string]any {
+	waveform := make([]int, len(att.Waveform))
+	for i, sample := range att.Waveform {
+		waveform[i] = int(sample) * maxMatrixWaveformValue / maxDiscordWaveformValue
+	}
+	return map[string]any{
+		keyMSC1767Audio: map[string]any{
+			"duration": int(att.DurationSeconds * 1000),
+			"waveform": waveform,
+		},
+		keyMSC3245Voice: map[string]any{},
+	}
+}
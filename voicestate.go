@@ -0,0 +1,211 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+
+	"github.com/bwmarrin/discordgo"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// Voice and stage channels are bridged like text channels using their built-in text chat.
+// If voice_state_notices is enabled, people joining and leaving the voice channel are sent as notices,
+// and the current participants are stored in a custom state event in the room.
+
+var StateVoiceParticipants = event.Type{Type: "fi.mau.discord.voice_participants", Class: event.StateEventType}
+
+type VoiceParticipantsEventContent struct {
+	Participants []id.UserID `json:"participants"`
+}
+
+func (portal *Portal) IsVoice() bool {
+	return portal.Type == discordgo.ChannelTypeGuildVoice || portal.Type == discordgo.ChannelTypeGuildStageVoice
+}
+
+func (user *User) voiceStateUpdateHandler(evt *discordgo.VoiceStateUpdate) {
+	if !user.bridge.Config.Bridge.VoiceStateNotices {
+		return
+	}
+	var prevChannelID string
+	if evt.BeforeUpdate != nil {
+		prevChannelID = evt.BeforeUpdate.ChannelID
+	} else {
+		// discordgo doesn't have the previous state if it wasn't cached, e.g. when the guild was loaded lazily,
+		// so fall back to the participant lists of the voice channel portals.
+		prevChannelID = user.findVoiceChannel(evt.GuildID, user.bridge.FormatPuppetMXID(evt.UserID))
+	}
+	if prevChannelID == evt.ChannelID {
+		// Mute, deafen, video and other changes within the same channel aren't bridged
+		return
+	}
+	puppet := user.bridge.GetPuppetByID(evt.UserID)
+	if evt.Member != nil && evt.Member.User != nil {
+		puppet.UpdateInfo(user, evt.Member.User, nil)
+	}
+	if prevChannelID != "" {
+		if portal := user.GetExistingPortalByID(prevChannelID); portal != nil && portal.MXID != "" && portal.IsVoice() {
+			portal.handleDiscordVoiceState(puppet, false)
+		}
+	}
+	if evt.ChannelID != "" {
+		if portal := user.GetExistingPortalByID(evt.ChannelID); portal != nil && portal.MXID != "" && portal.IsVoice() {
+			portal.handleDiscordVoiceState(puppet, true)
+		}
+	}
+}
+
+// findVoiceChannel returns the ID of the voice channel in the guild whose portal lists the given ghost as a participant.
+func (user *User) findVoiceChannel(guildID string, ghostMXID id.UserID) string {
+	if user.Session == nil {
+		return ""
+	}
+	guild, err := user.Session.State.Guild(guildID)
+	if err != nil {
+		return ""
+	}
+	var channelIDs []string
+	user.Session.State.RLock()
+	for _, ch := range guild.Channels {
+		if ch.Type == discordgo.ChannelTypeGuildVoice || ch.Type == discordgo.ChannelTypeGuildStageVoice {
+			channelIDs = append(channelIDs, ch.ID)
+		}
+	}
+	user.Session.State.RUnlock()
+	for _, channelID := range channelIDs {
+		if portal := user.GetExistingPortalByID(channelID); portal != nil && portal.MXID != "" && portal.hasVoiceParticipant(ghostMXID) {
+			return channelID
+		}
+	}
+	return ""
+}
+
+// handleGuildVoiceStates syncs the participant lists of voice channel portals from the voice states in a guild create event.
+// Notices aren't sent, as it's not known when the changes happened.
+func (user *User) handleGuildVoiceStates(meta *discordgo.Guild) {
+	if !user.bridge.Config.Bridge.VoiceStateNotices {
+		return
+	}
+	participants := make(map[string][]id.UserID)
+	for _, state := range meta.VoiceStates {
+		if state.ChannelID != "" {
+			participants[state.ChannelID] = append(participants[state.ChannelID], user.bridge.FormatPuppetMXID(state.UserID))
+		}
+	}
+	for _, ch := range meta.Channels {
+		if ch.Type != discordgo.ChannelTypeGuildVoice && ch.Type != discordgo.ChannelTypeGuildStageVoice {
+			continue
+		}
+		portal := user.GetExistingPortalByID(ch.ID)
+		if portal == nil || portal.MXID == "" {
+			continue
+		}
+		portal.syncVoiceParticipants(participants[ch.ID])
+	}
+}
+
+// loadVoiceParticipants fills the in-memory participant set from the room state if it hasn't been loaded yet.
+// The caller must hold voiceLock.
+func (portal *Portal) loadVoiceParticipants() {
+	if portal.voiceParticipants != nil {
+		return
+	}
+	portal.voiceParticipants = make(map[id.UserID]struct{})
+	var content VoiceParticipantsEventContent
+	err := portal.MainIntent().StateEvent(portal.MXID, StateVoiceParticipants, "", &content)
+	if err != nil && !errors.Is(err, mautrix.MNotFound) {
+		portal.log.Warn().Err(err).Msg("Failed to get voice participant state")
+	}
+	for _, userID := range content.Participants {
+		portal.voiceParticipants[userID] = struct{}{}
+	}
+}
+
+func (portal *Portal) hasVoiceParticipant(userID id.UserID) bool {
+	portal.voiceLock.Lock()
+	defer portal.voiceLock.Unlock()
+	portal.loadVoiceParticipants()
+	_, ok := portal.voiceParticipants[userID]
+	return ok
+}
+
+func (portal *Portal) updateVoiceParticipantState() {
+	participants := maps.Keys(portal.voiceParticipants)
+	slices.Sort(participants)
+	_, err := portal.MainIntent().SendStateEvent(portal.MXID, StateVoiceParticipants, "", &VoiceParticipantsEventContent{
+		Participants: participants,
+	})
+	if err != nil {
+		portal.log.Warn().Err(err).Msg("Failed to update voice participant state")
+	}
+}
+
+func (portal *Portal) syncVoiceParticipants(participants []id.UserID) {
+	portal.voiceLock.Lock()
+	defer portal.voiceLock.Unlock()
+	portal.loadVoiceParticipants()
+	changed := len(participants) != len(portal.voiceParticipants)
+	newParticipants := make(map[id.UserID]struct{}, len(participants))
+	for _, userID := range participants {
+		newParticipants[userID] = struct{}{}
+		if _, ok := portal.voiceParticipants[userID]; !ok {
+			changed = true
+		}
+	}
+	portal.voiceParticipants = newParticipants
+	if changed {
+		portal.updateVoiceParticipantState()
+	}
+}
+
+func (portal *Portal) handleDiscordVoiceState(puppet *Puppet, joined bool) {
+	portal.voiceLock.Lock()
+	defer portal.voiceLock.Unlock()
+	portal.loadVoiceParticipants()
+	// The same voice state update is received by every logged-in user in the guild, so only bridge actual changes
+	_, isParticipant := portal.voiceParticipants[puppet.MXID]
+	if isParticipant == joined {
+		return
+	}
+	log := portal.log.With().
+		Str("action", "discord voice state").
+		Str("ghost_mxid", puppet.MXID.String()).
+		Bool("joined", joined).
+		Logger()
+	body := "left the voice channel"
+	if joined {
+		portal.voiceParticipants[puppet.MXID] = struct{}{}
+		body = "joined the voice channel"
+	} else {
+		delete(portal.voiceParticipants, puppet.MXID)
+	}
+	portal.updateVoiceParticipantState()
+	// Notices are always sent by the ghost, as they shouldn't appear as messages sent by double puppeted users
+	_, err := portal.sendMatrixMessage(puppet.DefaultIntent(), event.EventMessage, &event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    body,
+	}, nil, 0)
+	if err != nil {
+		log.Err(err).Msg("Failed to send voice state notice")
+	} else {
+		log.Debug().Msg("Sent voice state notice")
+	}
+}